@@ -0,0 +1,202 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/gorilla/mux"
+)
+
+// Body of POST /apikeys
+type APIKeyRequest struct {
+	Label       string           `json:"label"`
+	Permissions auth.Permissions `json:"permissions"`
+	Packages    []string         `json:"packages,omitempty"`
+	Tags        []string         `json:"tags,omitempty"`
+	ExpiresAt   *time.Time       `json:"expiresAt,omitempty"`
+}
+
+// Returned once when a key is created, the key can't be read again
+type APIKeyResponse struct {
+	Key string `json:"key"`
+	auth.APIKey
+}
+
+// The API key store of the configured backend, a problem is written
+// when there is none
+func apiKeyStore(w http.ResponseWriter, r *http.Request) (auth.APIKeyStore, bool) {
+	if authenticator == nil {
+		writeProblem(w, r, http.StatusNotFound, ERR_AUTH_DISABLED, "Authentication is not configured")
+		return nil, false
+	}
+	store := authenticator.APIKeys()
+	if store == nil {
+		writeProblem(w, r, http.StatusNotImplemented, ERR_API_KEYS_NOT_SUPPORTED, "The authentication backend does not store API keys")
+		return nil, false
+	}
+	return store, true
+}
+
+// List API keys or create one
+func APIKeys(w http.ResponseWriter, r *http.Request) {
+	store, ok := apiKeyStore(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "POST" {
+		CreateAPIKey(w, r)
+		return
+	}
+
+	keys, err := store.GetAPIKeys()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	public := make([]auth.APIKey, len(keys))
+	for idx, key := range keys {
+		public[idx] = key.Public()
+	}
+	writeJSON(w, r, http.StatusOK, public)
+}
+
+// Create a key owned by the caller, it can't be given permissions
+// the caller doesn't have
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	identity, ok := auth.IdentityFrom(r)
+	if !ok || identity.KeyId != "" {
+		writeProblem(w, r, http.StatusForbidden, ERR_PERMISSION_DENIED, "API keys can only be created by a logged in user")
+		return
+	}
+	// Keys act as their owner, who has to stay a user for them to work
+	if _, err := authenticator.Backend.GetUser(identity.Subject); err == auth.ErrUserNotFound {
+		writeProblem(w, r, http.StatusForbidden, ERR_PERMISSION_DENIED, "API keys can only be created by users of the authentication backend")
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req APIKeyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse API key: "+err.Error())
+		return
+	}
+
+	var fields []FieldError
+	if req.Label == "" {
+		fields = append(fields, FieldError{Field: "label", Message: "is required"})
+	}
+	if len(req.Permissions) == 0 {
+		fields = append(fields, FieldError{Field: "permissions", Message: "at least one permission is required"})
+	}
+	for idx, permission := range req.Permissions {
+		if permission.Name != auth.AnyRoute && !routeExists(permission.Name) {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("permissions[%d].name", idx), Message: "no such route " + permission.Name})
+			continue
+		}
+		if permission.Flags == 0 {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("permissions[%d].flags", idx), Message: "at least one flag is required"})
+		}
+		for _, flag := range []int{auth.READ, auth.UPDATE, auth.CREATE, auth.DELETE} {
+			if permission.Flags&flag != 0 && !authenticator.Permits(identity, permission.Name, flag) {
+				fields = append(fields, FieldError{Field: fmt.Sprintf("permissions[%d].flags", idx), Message: "your roles don't grant " + auth.FlagName(flag) + " on " + permission.Name})
+			}
+		}
+	}
+	for idx, pattern := range req.Packages {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("packages[%d]", idx), Message: "is not a valid package id pattern"})
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		fields = append(fields, FieldError{Field: "expiresAt", Message: "must be in the future"})
+	}
+	if len(fields) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid API key", fields...)
+		return
+	}
+
+	secret, key, err := authenticator.NewAPIKey(identity.Subject, auth.APIKey{
+		Label:       req.Label,
+		Permissions: req.Permissions,
+		Packages:    req.Packages,
+		Tags:        req.Tags,
+		ExpiresAt:   req.ExpiresAt,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auditResource(r, "/apikeys/"+key.Id)
+	auditDetail(r, "label "+key.Label)
+	w.Header().Set("Location", APIVersionPrefix+"/apikeys/"+key.Id)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, http.StatusCreated, APIKeyResponse{Key: secret, APIKey: key.Public()})
+}
+
+// Return an API key or revoke it, revoked keys stay listed so their
+// last use remains visible
+func APIKeyDetails(w http.ResponseWriter, r *http.Request) {
+	store, ok := apiKeyStore(w, r)
+	if !ok {
+		return
+	}
+	keyId := mux.Vars(r)["keyId"]
+
+	if r.Method != "DELETE" {
+		key, err := store.GetAPIKey(keyId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, key.Public())
+		return
+	}
+
+	_, err := store.UpdateAPIKey(keyId, func(key *auth.APIKey) error {
+		if key.RevokedAt == nil {
+			revoked := time.Now().UTC()
+			key.RevokedAt = &revoked
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Every route is documented, looking them up in routes would make
+// the routes table depend on itself
+func routeExists(name string) bool {
+	_, ok := apiDocs[name]
+	return ok
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/deployment"
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyEndpoints(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-apikeys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	authenticator, err = auth.AuthFromConfig(map[string]interface{}{"path": dir, "secret": "0123456789abcdef0123456789abcdef"})
+	assert.Nil(t, err)
+	defer func() { authenticator = nil }()
+	_, err = authenticator.Users().CreateUser(auth.User{Id: "alice", Roles: []string{auth.OPERATOR, auth.ADMINISTRATOR}})
+	assert.Nil(t, err)
+	_, err = authenticator.Users().CreateUser(auth.User{Id: "bob", Roles: []string{auth.OPERATOR}})
+	assert.Nil(t, err)
+
+	router := NewRouter()
+	request := func(method string, path string, body string, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	aliceToken, _, err := authenticator.CreateToken(auth.User{Id: "alice", Roles: []string{auth.ADMINISTRATOR}})
+	assert.Nil(t, err)
+	bobToken, _, err := authenticator.CreateToken(auth.User{Id: "bob", Roles: []string{auth.OPERATOR}})
+	assert.Nil(t, err)
+
+	w := request("POST", "/v1/apikeys", `{"label": "ci", "permissions": [{"name": "Users", "flags": ["READ"]}]}`, "Bearer "+bobToken)
+	assert.Equal(t, 403, w.Code)
+	w = request("POST", "/v1/apikeys", `{"permissions": [{"name": "Nope", "flags": ["READ"]}], "packages": ["["]}`, "Bearer "+aliceToken)
+	assert.Equal(t, 400, w.Code)
+	assert.Len(t, decodeProblem(t, w).Errors, 3)
+
+	w = request("POST", "/v1/apikeys", `{"label": "ci", "permissions": [{"name": "CurrentUser", "flags": ["READ"]}], "packages": ["php-*"]}`, "Bearer "+aliceToken)
+	assert.Equal(t, 201, w.Code)
+	var created APIKeyResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.Key, auth.APIKeyPrefix))
+	assert.Empty(t, created.Hash)
+	assert.Equal(t, "alice", created.Owner)
+	stored, err := ioutil.ReadFile(dir + "/apikeys.json")
+	assert.Nil(t, err)
+	assert.NotContains(t, string(stored), created.Key[len(auth.APIKeyPrefix+created.Id)+1:])
+
+	// The key acts as alice, but only with its own permissions
+	w = request("GET", "/v1/auth", "", "ApiKey "+created.Key)
+	assert.Equal(t, 200, w.Code)
+	var identity auth.Identity
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &identity))
+	assert.Equal(t, "alice", identity.Subject)
+	assert.Equal(t, created.Id, identity.KeyId)
+	assert.Equal(t, []string{"php-*"}, identity.Packages)
+	assert.Equal(t, 403, request("GET", "/v1/users", "", "ApiKey "+created.Key).Code)
+	assert.Equal(t, 401, request("GET", "/v1/auth", "", "ApiKey "+created.Key+"x").Code)
+
+	w = request("GET", "/v1/apikeys/"+created.Id, "", "Bearer "+aliceToken)
+	assert.Equal(t, 200, w.Code)
+	var key auth.APIKey
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &key))
+	assert.NotNil(t, key.LastUsedAt)
+
+	assert.Equal(t, 204, request("DELETE", "/v1/apikeys/"+created.Id, "", "Bearer "+aliceToken).Code)
+	assert.Equal(t, 401, request("GET", "/v1/auth", "", "ApiKey "+created.Key).Code)
+	w = request("GET", "/v1/apikeys", "", "Bearer "+aliceToken)
+	var keys []auth.APIKey
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &keys))
+	if assert.Len(t, keys, 1) {
+		assert.NotNil(t, keys[0].RevokedAt)
+	}
+	assert.Equal(t, 404, request("DELETE", "/v1/apikeys/nope", "", "Bearer "+aliceToken).Code)
+}
+
+func TestScopedAPIKeyPackageRoutes(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-apikeys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "packages.json"), []byte(`[{"id": "php-fpm"}, {"id": "nginx"}]`), 0644))
+	repo = new(deployment.Repository)
+	repo.Init(dir, true, []string{"*"}, nil, nil, nil)
+	defer func() { repo = nil }()
+	authenticator, err = auth.AuthFromConfig(map[string]interface{}{"path": dir, "secret": "0123456789abcdef0123456789abcdef"})
+	assert.Nil(t, err)
+	defer func() { authenticator = nil }()
+	_, err = authenticator.Users().CreateUser(auth.User{Id: "alice", Roles: []string{auth.ADMINISTRATOR}})
+	assert.Nil(t, err)
+	aliceToken, _, err := authenticator.CreateToken(auth.User{Id: "alice", Roles: []string{auth.ADMINISTRATOR}})
+	assert.Nil(t, err)
+
+	router := NewRouter()
+	request := func(method string, path string, body []byte, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		r.Header.Set("Authorization", authorization)
+		r.Header.Set("If-Match", "*")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	permissions := `[{"name": "PackageDetails", "flags": ["READ", "UPDATE"]}, {"name": "PackageBundle", "flags": ["READ"]}, {"name": "PackageImport", "flags": ["CREATE"]}]`
+	w := request("POST", "/v1/apikeys", []byte(`{"label": "php", "permissions": `+permissions+`, "packages": ["php-*"]}`), "Bearer "+aliceToken)
+	assert.Equal(t, 201, w.Code)
+	var created APIKeyResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	key := "ApiKey " + created.Key
+
+	assert.Equal(t, 200, request("GET", "/v1/packages/php-fpm", nil, key).Code)
+	assert.Equal(t, 403, request("GET", "/v1/packages/nginx", nil, key).Code)
+	w = request("PUT", "/v1/packages/nginx", []byte(`{"name": "Nginx", "template_before": ["rm -rf /"]}`), key)
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "PackageDetails:UPDATE", decodeProblem(t, w).Permission)
+	assert.Equal(t, 200, request("GET", "/v1/packages/php-fpm/bundle", nil, key).Code)
+	w = request("GET", "/v1/packages/nginx/bundle", nil, key)
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "PackageBundle:READ", decodeProblem(t, w).Permission)
+
+	// Imports are checked under the id they would be installed as
+	var bundle bytes.Buffer
+	assert.Nil(t, repo.ExportBundle("php-fpm", &bundle))
+	w = request("POST", "/v1/packages/import?id=nginx-copy", bundle.Bytes(), key)
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "PackageImport:CREATE", decodeProblem(t, w).Permission)
+	_, err = repo.FindPackage("nginx-copy")
+	assert.Equal(t, deployment.ErrPackageNotFound, err)
+	assert.Equal(t, 201, request("POST", "/v1/packages/import?id=php-copy", bundle.Bytes(), key).Code)
+}
@@ -0,0 +1,32 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployd-atomicfile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "conf", "users.json")
+	assert.Nil(t, Write(dest, []byte("first"), 0600))
+	assert.Nil(t, Write(dest, []byte("second"), 0600))
+
+	data, err := ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(data))
+	info, err := os.Stat(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(filepath.Dir(dest))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,168 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cchamplin/deployd/audit"
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+)
+
+// Nil when no audit section is configured
+var auditLog *audit.Log
+
+// What a handler adds to the entry of its request
+type auditDetails struct {
+	resource  string
+	detail    string
+	variables map[string]string
+}
+
+type auditDetailsKey struct{}
+
+// Record every request that changes something once its handler is
+// done, handlers name the resource and variables with auditResource
+// and auditVariables. Logins are recorded by Authenticate.
+func auditRoute(routeName string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auditLog == nil || auth.MethodFlag(r.Method) == auth.READ || routeName == "Login" {
+			fn(w, r)
+			return
+		}
+		details := &auditDetails{resource: strings.TrimPrefix(r.URL.Path, APIVersionPrefix)}
+		recorder := &log.StatusRecorder{ResponseWriter: w}
+		fn(recorder, r.WithContext(context.WithValue(r.Context(), auditDetailsKey{}, details)))
+
+		entry := newAuditEntry(r, routeName)
+		entry.Resource = details.resource
+		entry.Variables = details.variables
+		entry.Detail = details.detail
+		entry.Status = recorder.Status
+		recordAudit(entry)
+	}
+}
+
+func newAuditEntry(r *http.Request, action string) audit.Entry {
+	entry := audit.Entry{
+		Action:    action,
+		Method:    r.Method,
+		Principal: auth.ANONYMOUS,
+		SourceIP:  r.RemoteAddr,
+		RequestId: log.RequestId(r),
+	}
+	if identity, ok := auth.IdentityFrom(r); ok {
+		entry.Principal = identity.Subject
+		entry.KeyId = identity.KeyId
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.SourceIP = host
+	}
+	return entry
+}
+
+func recordAudit(entry audit.Entry) {
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Record(entry); err != nil {
+		log.Error.Printf("Failed to record %s of %s by %s in the audit log: %v", entry.Action, entry.Resource, entry.Principal, err)
+	}
+}
+
+// Name what the request acted on, e.g. the deployment it started
+func auditResource(r *http.Request, resource string) {
+	if details, ok := r.Context().Value(auditDetailsKey{}).(*auditDetails); ok {
+		details.resource = resource
+	}
+}
+
+// Add a note such as the id of the deployment a request started
+func auditDetail(r *http.Request, detail string) {
+	if details, ok := r.Context().Value(auditDetailsKey{}).(*auditDetails); ok {
+		details.detail = detail
+	}
+}
+
+// Record the variables the request was made with, secret values are
+// redacted before they are stored
+func auditVariables(r *http.Request, variables map[string]string) {
+	if details, ok := r.Context().Value(auditDetailsKey{}).(*auditDetails); ok && len(variables) > 0 {
+		if details.variables == nil {
+			details.variables = make(map[string]string, len(variables))
+		}
+		for name, value := range variables {
+			details.variables[name] = value
+		}
+	}
+}
+
+// Query the audit log, entries are filtered by action, principal,
+// resource prefix and time and returned newest first
+func Audit(w http.ResponseWriter, r *http.Request) {
+	if auditLog == nil {
+		writeProblem(w, r, http.StatusNotFound, ERR_AUDIT_DISABLED, "The audit log is not configured")
+		return
+	}
+	values := r.URL.Query()
+	query := audit.Query{
+		Action:    values.Get("action"),
+		Principal: values.Get("principal"),
+		Resource:  values.Get("resource"),
+		Limit:     100,
+	}
+	var fields []FieldError
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			fields = append(fields, FieldError{Field: "since", Message: "must be an RFC 3339 time"})
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			fields = append(fields, FieldError{Field: "until", Message: "must be an RFC 3339 time"})
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 || query.Limit > audit.MaxQueryLimit {
+			fields = append(fields, FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(audit.MaxQueryLimit)})
+		}
+	}
+	if len(fields) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid audit query", fields...)
+		return
+	}
+
+	entries, err := auditLog.Store.Query(query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, entries)
+}
@@ -0,0 +1,200 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Values of variables whose name matches one of these are never
+// stored, patterns are matched against the lower-cased name
+var DefaultRedactPatterns = []string{"*password*", "*passwd*", "*secret*", "*token*", "*key*", "*credential*", "*private*"}
+
+const Redacted = "[REDACTED]"
+
+// Queries return at most this many entries
+const MaxQueryLimit = 1000
+
+// One authenticated action, entries are only ever appended
+type Entry struct {
+	Id        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Method    string    `json:"method"`
+	Resource  string    `json:"resource"`
+	Status    int       `json:"status"`
+	Principal string    `json:"principal"`
+	// Set when the action was made with an API key
+	KeyId     string            `json:"keyId,omitempty"`
+	SourceIP  string            `json:"sourceIp"`
+	RequestId string            `json:"requestId"`
+	Variables map[string]string `json:"variables,omitempty"`
+	Detail    string            `json:"detail,omitempty"`
+}
+
+// Entries match when they match every field that is set, resources
+// match by prefix
+type Query struct {
+	Action    string
+	Principal string
+	Resource  string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (q Query) Matches(entry Entry) bool {
+	if q.Action != "" && !strings.EqualFold(q.Action, entry.Action) {
+		return false
+	}
+	if q.Principal != "" && q.Principal != entry.Principal {
+		return false
+	}
+	if q.Resource != "" && !strings.HasPrefix(entry.Resource, q.Resource) {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !entry.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Sort matching entries newest first and apply the limit
+func (q Query) Apply(entries []Entry) []Entry {
+	matched := []Entry{}
+	for _, entry := range entries {
+		if q.Matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.After(matched[j].Time) })
+	limit := q.Limit
+	if limit <= 0 || limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched
+}
+
+// Where entries are kept, stores must never change or drop entries
+type Store interface {
+	Append(entry Entry) error
+	Query(query Query) ([]Entry, error)
+}
+
+// Creates a store from the audit section of the configuration
+type StoreFactory func(config map[string]interface{}) (Store, error)
+
+var storeFactories = make(map[string]StoreFactory)
+
+// Make a store available to FromConfig by its type name, stores
+// register themselves when their package is imported
+func RegisterStore(name string, factory StoreFactory) {
+	storeFactories[strings.ToLower(name)] = factory
+}
+
+// Redacts entries before they reach the store
+type Log struct {
+	Store  Store
+	redact []string
+}
+
+func FromConfig(config map[string]interface{}) (*Log, error) {
+	storeType := ConfigString(config, "type", "file")
+	factory, ok := storeFactories[strings.ToLower(storeType)]
+	if !ok {
+		return nil, fmt.Errorf("%s is an unknown audit store", storeType)
+	}
+	store, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+	l := NewLog(store)
+	if patterns, ok := config["redact"].([]interface{}); ok {
+		for _, pattern := range patterns {
+			pattern, ok := pattern.(string)
+			if !ok {
+				return nil, errors.New("Invalid audit redact patterns: every pattern must be a string")
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid audit redact pattern %s: %v", pattern, err)
+			}
+			l.redact = append(l.redact, strings.ToLower(pattern))
+		}
+	}
+	return l, nil
+}
+
+func NewLog(store Store) *Log {
+	return &Log{Store: store, redact: DefaultRedactPatterns}
+}
+
+// Look up a string in a configuration section
+func ConfigString(config map[string]interface{}, key string, fallback string) string {
+	if value, ok := config[key].(string); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Store an entry, it is given an id and time when it has none
+func (l *Log) Record(entry Entry) error {
+	if entry.Id == "" {
+		entry.Id = uuid.NewV4().String()
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.Variables = l.Redact(entry.Variables)
+	return l.Store.Append(entry)
+}
+
+// A copy of the variables with secret values replaced
+func (l *Log) Redact(variables map[string]string) map[string]string {
+	if len(variables) == 0 {
+		return nil
+	}
+	redacted := make(map[string]string, len(variables))
+	for name, value := range variables {
+		redacted[name] = value
+		for _, pattern := range l.redact {
+			if matched, _ := path.Match(pattern, strings.ToLower(name)); matched {
+				redacted[name] = Redacted
+				break
+			}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryStore struct {
+	entries []Entry
+}
+
+func (m *memoryStore) Append(entry Entry) error {
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *memoryStore) Query(query Query) ([]Entry, error) {
+	return query.Apply(m.entries), nil
+}
+
+func TestRecordRedactsSecrets(t *testing.T) {
+	RegisterStore("memory", func(config map[string]interface{}) (Store, error) {
+		return &memoryStore{}, nil
+	})
+	l, err := FromConfig(map[string]interface{}{"type": "memory", "redact": []interface{}{"db_*"}})
+	assert.Nil(t, err)
+
+	assert.Nil(t, l.Record(Entry{Action: "PackageDeploy", Variables: map[string]string{
+		"service_id":   "web-1",
+		"DB_PASSWORD":  "hunter2",
+		"api_key":      "abc",
+		"db_host":      "10.0.0.1",
+		"0.auth_token": "xyz",
+	}}))
+	entries, err := l.Store.Query(Query{})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.NotEmpty(t, entries[0].Id)
+		assert.False(t, entries[0].Time.IsZero())
+		assert.Equal(t, map[string]string{
+			"service_id":   "web-1",
+			"DB_PASSWORD":  Redacted,
+			"api_key":      Redacted,
+			"db_host":      Redacted,
+			"0.auth_token": Redacted,
+		}, entries[0].Variables)
+	}
+
+	_, err = FromConfig(map[string]interface{}{"type": "memory", "redact": []interface{}{"["}})
+	assert.NotNil(t, err)
+	_, err = FromConfig(map[string]interface{}{"type": "nope"})
+	assert.NotNil(t, err)
+}
+
+func TestQueryApply(t *testing.T) {
+	now := time.Now()
+	entries := []Entry{
+		{Id: "1", Time: now.Add(-time.Hour), Action: "Login", Principal: "alice", Resource: "/auth"},
+		{Id: "2", Time: now.Add(-time.Minute), Action: "PackageDeploy", Principal: "alice", Resource: "/packages/php/deploy"},
+		{Id: "3", Time: now, Action: "PackageDeploy", Principal: "bob", Resource: "/packages/db/deploy"},
+	}
+	ids := func(entries []Entry) (ids []string) {
+		for _, entry := range entries {
+			ids = append(ids, entry.Id)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"3", "2", "1"}, ids(Query{}.Apply(entries)))
+	assert.Equal(t, []string{"3", "2"}, ids(Query{Action: "packagedeploy"}.Apply(entries)))
+	assert.Equal(t, []string{"2", "1"}, ids(Query{Principal: "alice"}.Apply(entries)))
+	assert.Equal(t, []string{"2"}, ids(Query{Resource: "/packages/php"}.Apply(entries)))
+	assert.Equal(t, []string{"2"}, ids(Query{Since: now.Add(-time.Minute), Until: now}.Apply(entries)))
+	assert.Equal(t, []string{"3"}, ids(Query{Limit: 1}.Apply(entries)))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cchamplin/deployd/audit"
+	"github.com/cchamplin/deployd/auth"
+	backends "github.com/cchamplin/deployd/backends/audit"
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	authenticator, err = auth.AuthFromConfig(map[string]interface{}{"path": dir, "secret": "0123456789abcdef0123456789abcdef"})
+	assert.Nil(t, err)
+	defer func() { authenticator = nil }()
+	store := &backends.FileAudit{}
+	assert.Nil(t, store.Init(filepath.Join(dir, "audit.log")))
+	auditLog = audit.NewLog(store)
+	defer func() { auditLog = nil }()
+	token, _, err := authenticator.CreateToken(auth.User{Id: "root", Roles: []string{auth.ADMINISTRATOR}})
+	assert.Nil(t, err)
+
+	router := NewRouter()
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(log.RequestIdHeader, "audited-request")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, 201, request("POST", "/v1/users", `{"id": "alice", "roles": ["operator"], "password": "correct horse"}`).Code)
+	assert.Equal(t, 401, request("POST", "/v1/auth", `{"username": "alice", "password": "wrong password"}`).Code)
+	assert.Equal(t, 200, request("POST", "/v1/auth", `{"username": "alice", "password": "correct horse"}`).Code)
+	// Reads are not recorded
+	assert.Equal(t, 200, request("GET", "/v1/users", "").Code)
+
+	w := request("GET", "/v1/audit", "")
+	assert.Equal(t, 200, w.Code)
+	var entries []audit.Entry
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 3) {
+		created := entries[2]
+		assert.Equal(t, "Users", created.Action)
+		assert.Equal(t, "/users/alice", created.Resource)
+		assert.Equal(t, "root", created.Principal)
+		assert.Equal(t, 201, created.Status)
+		assert.Equal(t, "audited-request", created.RequestId)
+		assert.Equal(t, "192.0.2.1", created.SourceIP)
+	}
+
+	w = request("GET", "/v1/audit?action=Login&principal=alice&limit=1", "")
+	entries = nil
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, 200, entries[0].Status)
+	}
+	assert.Equal(t, 400, request("GET", "/v1/audit?since=yesterday", "").Code)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "correct horse")
+}
@@ -0,0 +1,214 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/satori/go.uuid"
+)
+
+var ErrAPIKeyNotFound = errors.New("No such API key exist")
+var ErrInvalidAPIKey = errors.New("Invalid, expired or revoked API key")
+
+// Keys are handed out as dpk_<id>_<secret>, the prefix makes them easy
+// to find with secret scanners
+const APIKeyPrefix = "dpk_"
+
+// Key ids are the uuids they were created with
+var apiKeyIdPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// The last-used time of a key is only written when it is older than
+// this, so a busy key doesn't cause a write on every request
+var APIKeyUsedResolution = time.Minute
+
+// A key for automation. It acts as its owner but only with its own
+// permissions and, when packages or tags are given, only on packages
+// matching one of them. Only a hash of the secret is stored.
+type APIKey struct {
+	Id          string      `json:"id"`
+	Label       string      `json:"label"`
+	Owner       string      `json:"owner"`
+	Permissions Permissions `json:"permissions"`
+	// Package id globs such as php-*
+	Packages   []string   `json:"packages,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Implemented by backends that can store API keys
+type APIKeyStore interface {
+	GetAPIKeys() ([]APIKey, error)
+	GetAPIKey(id string) (APIKey, error)
+	CreateAPIKey(key APIKey) (APIKey, error)
+	// Apply update to the current key and store the result
+	UpdateAPIKey(id string, update func(key *APIKey) error) (APIKey, error)
+}
+
+// A copy of the key that is safe to return from the API
+func ValidAPIKeyId(id string) bool {
+	return apiKeyIdPattern.MatchString(id)
+}
+
+func (k APIKey) Public() APIKey {
+	k.Hash = ""
+	return k
+}
+
+func (k APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// The backend's API key store, nil when it can't store keys
+func (a *Auth) APIKeys() APIKeyStore {
+	store, _ := a.Backend.(APIKeyStore)
+	return store
+}
+
+// Store a new key for owner, the returned string is the only time the
+// key's secret is available
+func (a *Auth) NewAPIKey(owner string, key APIKey) (string, APIKey, error) {
+	store := a.APIKeys()
+	if store == nil {
+		return "", APIKey{}, errors.New("The authentication backend does not store API keys")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key.Id = uuid.NewV4().String()
+	key.Owner = owner
+	key.Hash = hashAPIKeySecret(hex.EncodeToString(secret))
+	key.CreatedAt = time.Now().UTC()
+	key.LastUsedAt = nil
+	key.RevokedAt = nil
+	key, err := store.CreateAPIKey(key)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	log.Info.Printf("Created API key %s (%s) for %s", key.Id, key.Label, owner)
+	return APIKeyPrefix + key.Id + "_" + hex.EncodeToString(secret), key, nil
+}
+
+// Verify a key and return the identity requests made with it have,
+// the owner's current roles limited to the key's permissions
+func (a *Auth) ParseAPIKey(value string) (Identity, error) {
+	store := a.APIKeys()
+	if store == nil || !strings.HasPrefix(value, APIKeyPrefix) {
+		return Identity{}, ErrInvalidAPIKey
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, APIKeyPrefix), "_", 2)
+	if len(parts) != 2 || !ValidAPIKeyId(parts[0]) {
+		return Identity{}, ErrInvalidAPIKey
+	}
+	key, err := store.GetAPIKey(parts[0])
+	if err != nil {
+		if err != ErrAPIKeyNotFound {
+			log.Error.Printf("Failed to read API key %s: %v", parts[0], err)
+		}
+		return Identity{}, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(parts[1])), []byte(key.Hash)) != 1 || key.Revoked() || key.Expired(now) {
+		return Identity{}, ErrInvalidAPIKey
+	}
+	owner, err := a.Backend.GetUser(key.Owner)
+	if err != nil || owner.Disabled {
+		log.Trace.Printf("Rejected API key %s, its owner %s can't be used", key.Id, key.Owner)
+		return Identity{}, ErrInvalidAPIKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= APIKeyUsedResolution {
+		_, err := store.UpdateAPIKey(key.Id, func(key *APIKey) error {
+			used := now.UTC()
+			key.LastUsedAt = &used
+			return nil
+		})
+		if err != nil {
+			log.Warning.Printf("Failed to record the use of API key %s: %v", key.Id, err)
+		}
+	}
+	return Identity{
+		Subject:     owner.Id,
+		Name:        owner.Name,
+		Roles:       owner.Roles,
+		ExpiresAt:   key.ExpiresAt,
+		KeyId:       key.Id,
+		Permissions: key.Permissions,
+		Packages:    key.Packages,
+		Tags:        key.Tags,
+	}, nil
+}
+
+// The key of an Authorization: ApiKey header, empty when there is none
+func APIKeyToken(r *http.Request) string {
+	value := r.Header.Get("Authorization")
+	if len(value) > 7 && strings.EqualFold(value[:7], "ApiKey ") {
+		return strings.TrimSpace(value[7:])
+	}
+	return ""
+}
+
+// Whether the identity may act on a package. Identities without
+// package or tag limits may act on every package, the others on the
+// packages whose id matches one of their globs or that carry one of
+// their tags.
+func (i Identity) PackageAllowed(id string, tags []string) bool {
+	if len(i.Packages) == 0 && len(i.Tags) == 0 {
+		return true
+	}
+	for _, pattern := range i.Packages {
+		if matched, _ := path.Match(pattern, id); matched {
+			return true
+		}
+	}
+	for _, tag := range i.Tags {
+		if hasTag(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityPackageAllowed(t *testing.T) {
+	assert.True(t, Identity{}.PackageAllowed("db", nil))
+
+	identity := Identity{Packages: []string{"php-*"}, Tags: []string{"web"}}
+	assert.True(t, identity.PackageAllowed("php-fpm", nil))
+	assert.True(t, identity.PackageAllowed("nginx", []string{"edge", "web"}))
+	assert.False(t, identity.PackageAllowed("db", []string{"db"}))
+}
+
+func TestPermitsLimitsAPIKeys(t *testing.T) {
+	a := &Auth{Roles: BuiltinRoles()}
+	user := Identity{Subject: "alice", Roles: []string{OPERATOR}}
+	assert.True(t, a.Permits(user, "PackageDeploy", CREATE))
+
+	key := user
+	key.KeyId = "key"
+	key.Permissions = Permissions{{Name: "PackageDeploy", Flags: CREATE}, {Name: "Users", Flags: READ}}
+	assert.True(t, a.Permits(key, "PackageDeploy", CREATE))
+	assert.False(t, a.Permits(key, "Deployments", READ))
+	// The owner's roles still apply
+	assert.False(t, a.Permits(key, "Users", READ))
+}
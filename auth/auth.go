@@ -1,71 +1,339 @@
 package auth
 
 import (
-	backends "github.com/cchamplin/deployd/backends/auth"
-	"github.com/dgrijalva/jwt-go"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"strings"
 	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/satori/go.uuid"
 )
 
+// Access tokens are short-lived, clients keep their session with the
+// refresh token they get at login
+const DefaultTokenTTL = time.Minute * 15
+const DefaultRefreshTTL = time.Hour * 24
+
+var ErrInvalidCredentials = errors.New("Invalid username or password")
+var ErrInvalidToken = errors.New("Invalid or expired token")
+var ErrUserNotFound = errors.New("No such user exist")
+var ErrNoSigningKey = errors.New("Authentication requires a secret or a key-file")
+
 type Auth struct {
-	AuthToken    string
-	AuthEndpoint string
-	Backend      AuthenticationBackend
+	Backend AuthenticationBackend
+	Roles   Roles
+	Issuer  string
+	// Roles from the configuration
+	configured Roles
+	TokenTTL   time.Duration
+	RefreshTTL time.Duration
+	// Token ids that are no longer accepted, nil when tokens can't be
+	// revoked
+	Revocations RevocationList
+	// Map verified client certificates to identities
+	CertRules CertRules
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifKey  interface{}
 }
 
-func CreatToken(accountID int, roles Roles) string {
-	token := jwt.New(jwt.SigningMethodHS256)
-	token.Claims["account"] = accountID
-	token.Claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
-	tokenString, err := token.SignedString("temp")
-	if err != nil {
+// An account as it is stored by a backend
+type User struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name,omitempty"`
+	Roles        []string `json:"roles"`
+	PasswordHash string   `json:"passwordHash,omitempty"`
+	Disabled     bool     `json:"disabled,omitempty"`
+}
 
-	}
-	return tokenString
+// Requests without a token are made as the anonymous role
+var Anonymous = Identity{Subject: ANONYMOUS, Roles: []string{ANONYMOUS}}
+
+// Who a request was made by, taken from its token
+type Identity struct {
+	Subject   string     `json:"subject"`
+	Name      string     `json:"name,omitempty"`
+	Roles     []string   `json:"roles"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	TokenId   string     `json:"-"`
+	// Set when the request was made with an API key, the key's
+	// permissions and package limits apply on top of the roles
+	KeyId       string      `json:"keyId,omitempty"`
+	Permissions Permissions `json:"permissions,omitempty"`
+	Packages    []string    `json:"packages,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
 }
 
 type AuthenticationBackend interface {
-	Authenticate(authParams map[string]string) (interface{}, error)
-	GetRoles() Roles
-	GetRole(id string) Role
-	GetUsers() interface{}
-	GetUser(id string) interface{}
-	DeleteUser(id string) error
-	UpdateUser(id string, userData map[string]string) (interface{}, error)
-	CreateUser(id string, userData map[string]string) (interface{}, error)
-	CreateRole(roleData map[string]string) (Role, error)
-	UpdateRole(roleData map[string]string) (Role, error)
-}
-
-func AuthFromConfig(config map[string]interface{}) Auth {
-	t, ok := config["type"]
-	var backendType string
+	// Verify credentials, ErrInvalidCredentials is returned when
+	// they don't match a user
+	Authenticate(authParams map[string]string) (User, error)
+	GetUser(id string) (User, error)
+}
+
+// Implemented by backends that accept bearer tokens issued by someone
+// else, such as an OIDC provider. They are asked about every token
+// deployd didn't sign itself.
+type TokenVerifier interface {
+	VerifyToken(tokenString string) (Identity, error)
+}
+
+// Creates a backend from the auth section of the configuration
+type BackendFactory func(config map[string]interface{}) (AuthenticationBackend, error)
+
+var backendFactories = make(map[string]BackendFactory)
+
+// Make a backend available to AuthFromConfig by its type name,
+// backends register themselves when their package is imported
+func RegisterBackend(name string, factory BackendFactory) {
+	backendFactories[strings.ToLower(name)] = factory
+}
+
+func AuthFromConfig(config map[string]interface{}) (*Auth, error) {
+	backendType := ConfigString(config, "type", "default")
+	factory, ok := backendFactories[strings.ToLower(backendType)]
 	if !ok {
-		backendType = "default"
-	} else {
-		backendType = t.(string)
+		return nil, fmt.Errorf("%s is an unknown authentication backend", backendType)
+	}
+	backend, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &Auth{
+		Backend:     backend,
+		Roles:       BuiltinRoles(),
+		Issuer:      ConfigString(config, "issuer", "deployd"),
+		TokenTTL:    DefaultTokenTTL,
+		RefreshTTL:  DefaultRefreshTTL,
+		Revocations: NewMemoryRevocations(),
+	}
+	if roles, ok := config["roles"]; ok {
+		custom, err := rolesFromConfig(roles)
+		if err != nil {
+			return nil, err
+		}
+		auth.configured = custom
+		auth.Roles = auth.Roles.Merge(custom)
+	}
+	if rules, ok := config["client-certs"]; ok {
+		if auth.CertRules, err = certRulesFromConfig(rules); err != nil {
+			return nil, err
+		}
+	}
+	if ttl := ConfigString(config, "token-ttl", ""); ttl != "" {
+		if auth.TokenTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("Invalid token-ttl %s: %v", ttl, err)
+		}
+	}
+	if ttl := ConfigString(config, "refresh-ttl", ""); ttl != "" {
+		if auth.RefreshTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("Invalid refresh-ttl %s: %v", ttl, err)
+		}
+	}
+	if err := auth.loadSigningKey(ConfigString(config, "secret", ""), ConfigString(config, "key-file", "")); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// Custom roles are listed in the roles member of the auth section
+func rolesFromConfig(value interface{}) (Roles, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var roles Roles
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, fmt.Errorf("Invalid roles: %v", err)
+	}
+	for _, role := range roles {
+		if role.Id == "" {
+			return nil, errors.New("Invalid roles: every role needs an id")
+		}
+	}
+	return roles, nil
+}
+
+// Whether any of the role ids grants flag on the named route
+func (a *Auth) Allowed(roles []string, route string, flag int) bool {
+	return a.AllRoles().Allowed(roles, route, flag)
+}
+
+// Whether the identity may use flag on the named route, API keys
+// need both their owner's roles and the key to grant it
+func (a *Auth) Permits(identity Identity, route string, flag int) bool {
+	if identity.KeyId != "" && !identity.Permissions.Allowed(route, flag) {
+		return false
+	}
+	return a.Allowed(identity.Roles, route, flag)
+}
+
+// Whether the identity may use flag on the named route for a package,
+// permissions can be limited to some packages and API keys to some
+// packages and tags
+func (a *Auth) PermitsPackage(identity Identity, route string, flag int, packageId string, tags []string) bool {
+	if identity.KeyId != "" {
+		if !identity.PackageAllowed(packageId, tags) || !identity.Permissions.AllowedOn(route, flag, packageId, tags) {
+			return false
+		}
 	}
+	return a.AllRoles().AllowedOn(identity.Roles, route, flag, packageId, tags)
+}
 
-	t, ok = config["authtoken"]
-	var token string
+// The built-in roles and the ones stored by the backend, roles from
+// the configuration take precedence over both
+func (a *Auth) AllRoles() Roles {
+	source, ok := a.Backend.(RoleSource)
 	if !ok {
-		// TODO error
-	} else {
-		token = t.(string)
+		return a.Roles
+	}
+	stored, err := source.GetRoles()
+	if err != nil {
+		log.Error.Printf("Failed to read roles: %v", err)
+		return a.Roles
+	}
+	return BuiltinRoles().Merge(stored).Merge(a.configured)
+}
+
+// Look up a string in a configuration section
+func ConfigString(config map[string]interface{}, key string, fallback string) string {
+	if value, ok := config[key].(string); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Check credentials against the backend and sign a token for the user
+func (a *Auth) Login(authParams map[string]string) (string, Identity, error) {
+	user, err := a.Backend.Authenticate(authParams)
+	if err != nil {
+		return "", Identity{}, err
+	}
+	if user.Disabled {
+		return "", Identity{}, ErrInvalidCredentials
+	}
+	return a.CreateToken(user)
+}
+
+func (a *Auth) CreateToken(user User) (string, Identity, error) {
+	now := time.Now()
+	expires := now.Add(a.TokenTTL).UTC()
+	identity := Identity{Subject: user.Id, Name: user.Name, Roles: user.Roles, ExpiresAt: &expires, TokenId: uuid.NewV4().String()}
+	token := jwt.NewWithClaims(a.method, jwt.MapClaims{
+		"sub":   identity.Subject,
+		"name":  identity.Name,
+		"roles": identity.Roles,
+		"iss":   a.Issuer,
+		"iat":   now.Unix(),
+		"exp":   expires.Unix(),
+		"jti":   identity.TokenId,
+		"typ":   accessTokenType,
+	})
+	tokenString, err := token.SignedString(a.signKey)
+	if err != nil {
+		return "", Identity{}, err
+	}
+	return tokenString, identity, nil
+}
+
+// Verify a token's signature, expiry and issuer and return who it
+// was issued to
+func (a *Auth) ParseToken(tokenString string) (Identity, error) {
+	identity, err := a.parseToken(tokenString)
+	verifier, ok := a.Backend.(TokenVerifier)
+	if err != ErrInvalidToken || !ok {
+		return identity, err
+	}
+	if identity, err = verifier.VerifyToken(tokenString); err != nil {
+		return Identity{}, err
+	}
+	if identity.TokenId != "" && a.Revocations != nil && a.Revocations.Revoked(identity.TokenId) {
+		log.Trace.Printf("Rejected revoked token %s", identity.TokenId)
+		return Identity{}, ErrInvalidToken
 	}
+	return identity, nil
+}
+
+func (a *Auth) parseToken(tokenString string) (Identity, error) {
+	claims, err := a.parseClaims(tokenString)
+	if err != nil {
+		return Identity{}, err
+	}
+	// Refresh tokens are only good for POST /auth/refresh
+	if typ, _ := claims["typ"].(string); typ == refreshTokenType {
+		return Identity{}, ErrInvalidToken
+	}
+
+	identity := Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.TokenId, _ = claims["jti"].(string)
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if role, ok := role.(string); ok {
+				identity.Roles = append(identity.Roles, role)
+			}
+		}
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		expires := time.Unix(int64(exp), 0).UTC()
+		identity.ExpiresAt = &expires
+	}
+	if identity.Subject == "" {
+		return Identity{}, ErrInvalidToken
+	}
+	return identity, nil
+}
 
-	var auth Auth
-	auth = Auth{AuthToken: token}
-	switch strings.ToLower(backendType) {
-	case "default":
-		defaultAuth := backends.DefaultAuth{}
-		defaultAuth.Init(auth.AuthEndpoint)
-		auth.Backend = etcdAuth
-	case "etcd":
-		etcdAuth := backends.EtcdAuth{}
-		etcdAuth.Init(auth.AuthEndpoint)
-		auth.Backend = etcdAuth
+// The claims of a token signed by us that is neither expired nor
+// revoked
+func (a *Auth) parseClaims(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		// Only accept the algorithm we sign with, a token can't pick
+		// how it is verified
+		if token.Method.Alg() != a.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return a.verifKey, nil
+	})
+	if err != nil {
+		log.Trace.Printf("Rejected token: %v", err)
+		return nil, ErrInvalidToken
+	}
+	if _, ok := claims["exp"]; !ok || !claims.VerifyIssuer(a.Issuer, true) {
+		return nil, ErrInvalidToken
+	}
+	if jti, _ := claims["jti"].(string); jti != "" && a.Revocations != nil && a.Revocations.Revoked(jti) {
+		log.Trace.Printf("Rejected revoked token %s", jti)
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// The bearer token of a request, empty when there is none
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
 	}
+	return ""
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
 
-	return j
+// The identity a request was authenticated as
+func IdentityFrom(r *http.Request) (Identity, bool) {
+	identity, ok := r.Context().Value(identityKey{}).(Identity)
+	return identity, ok
 }
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKey(t *testing.T, dir string, key interface{}) string {
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	file := filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600))
+	return file
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-auth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	for alg, configure := range map[string]func(a *Auth) error{
+		"HS256": func(a *Auth) error { return a.loadSigningKey("0123456789abcdef0123456789abcdef", "") },
+		"RS256": func(a *Auth) error { return a.loadSigningKey("", writeKey(t, dir, rsaKey)) },
+		"EdDSA": func(a *Auth) error { return a.loadSigningKey("", writeKey(t, dir, edKey)) },
+	} {
+		a := &Auth{Issuer: "deployd", TokenTTL: time.Hour}
+		assert.Nil(t, configure(a), alg)
+		assert.Equal(t, alg, a.method.Alg())
+
+		token, issued, err := a.CreateToken(User{Id: "alice", Name: "Alice", Roles: []string{"operator"}})
+		assert.Nil(t, err, alg)
+		identity, err := a.ParseToken(token)
+		assert.Nil(t, err, alg)
+		assert.Equal(t, "alice", identity.Subject)
+		assert.Equal(t, []string{"operator"}, identity.Roles)
+		assert.Equal(t, issued.TokenId, identity.TokenId)
+
+		_, err = a.ParseToken(token[:len(token)-4] + "AAAA")
+		assert.Equal(t, ErrInvalidToken, err, alg)
+	}
+}
+
+func TestParseTokenRejects(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	a := &Auth{Issuer: "deployd", TokenTTL: time.Hour}
+	assert.Nil(t, a.loadSigningKey("0123456789abcdef0123456789abcdef", ""))
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		assert.Nil(t, err)
+		return token
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "alice", "iss": "deployd", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	_, err := a.ParseToken(sign(jwt.SigningMethodHS256, a.signKey, valid()))
+	assert.Nil(t, err)
+
+	expired := valid()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = a.ParseToken(sign(jwt.SigningMethodHS256, a.signKey, expired))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	foreign := valid()
+	foreign["iss"] = "someone-else"
+	_, err = a.ParseToken(sign(jwt.SigningMethodHS256, a.signKey, foreign))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	noExpiry := valid()
+	delete(noExpiry, "exp")
+	_, err = a.ParseToken(sign(jwt.SigningMethodHS256, a.signKey, noExpiry))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// The token can't choose a different algorithm
+	_, err = a.ParseToken(sign(jwt.SigningMethodHS512, a.signKey, valid()))
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = a.ParseToken(sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid()))
+	assert.Equal(t, ErrInvalidToken, err)
+}
@@ -0,0 +1,163 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/cchamplin/deployd/log"
+)
+
+var ErrInvalidCertificate = errors.New("The client certificate maps to a missing or disabled user")
+
+// Subjects of identities mapped straight to roles start with this, so
+// they can't be confused with users of the backend
+const CertificateSubjectPrefix = "cert:"
+
+// Maps client certificates to a user of the backend or to roles. The
+// CN, URI and DNS globs are matched with path.Match against the
+// certificate's common name and SAN URIs and DNS names, every glob
+// that is given has to match. * doesn't match a / so URI globs name
+// each path segment, e.g. spiffe://example.org/deployer/*
+type CertRule struct {
+	CN    string   `json:"cn,omitempty"`
+	URI   string   `json:"uri,omitempty"`
+	DNS   string   `json:"dns,omitempty"`
+	User  string   `json:"user,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// The first rule that matches a certificate decides who it is
+type CertRules []CertRule
+
+func certRulesFromConfig(value interface{}) (CertRules, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var rules CertRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Invalid client-certs: %v", err)
+	}
+	for i, rule := range rules {
+		if rule.CN == "" && rule.URI == "" && rule.DNS == "" {
+			return nil, fmt.Errorf("Invalid client-certs: rule %d needs a cn, uri or dns", i)
+		}
+		for _, pattern := range []string{rule.CN, rule.URI, rule.DNS} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid client-certs: rule %d has an invalid glob %s", i, pattern)
+			}
+		}
+		if (rule.User == "") == (len(rule.Roles) == 0) {
+			return nil, fmt.Errorf("Invalid client-certs: rule %d needs either a user or roles", i)
+		}
+	}
+	return rules, nil
+}
+
+// The first rule matching the certificate and the certificate name it
+// matched on
+func (rules CertRules) Match(cert *x509.Certificate) (CertRule, string, bool) {
+	for _, rule := range rules {
+		if name, ok := rule.matches(cert); ok {
+			return rule, name, true
+		}
+	}
+	return CertRule{}, "", false
+}
+
+func (rule CertRule) matches(cert *x509.Certificate) (string, bool) {
+	var name string
+	if rule.CN != "" {
+		if matched, _ := path.Match(rule.CN, cert.Subject.CommonName); !matched || cert.Subject.CommonName == "" {
+			return "", false
+		}
+		name = cert.Subject.CommonName
+	}
+	if rule.URI != "" {
+		uri, ok := matchAny(rule.URI, certURIs(cert))
+		if !ok {
+			return "", false
+		}
+		name = uri
+	}
+	if rule.DNS != "" {
+		// Host names are case-insensitive
+		hosts := make([]string, 0, len(cert.DNSNames))
+		for _, host := range cert.DNSNames {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+		host, ok := matchAny(strings.ToLower(rule.DNS), hosts)
+		if !ok {
+			return "", false
+		}
+		if name == "" {
+			name = host
+		}
+	}
+	return name, true
+}
+
+func matchAny(pattern string, values []string) (string, bool) {
+	for _, value := range values {
+		if matched, _ := path.Match(pattern, value); matched {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func certURIs(cert *x509.Certificate) []string {
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	return uris
+}
+
+// The identity of a verified client certificate, false when no rule
+// maps it. Certificates mapped to a user act as that user with its
+// current roles, others get the rule's roles.
+func (a *Auth) ParseCertificate(cert *x509.Certificate) (Identity, bool, error) {
+	rule, name, ok := a.CertRules.Match(cert)
+	if !ok {
+		log.Trace.Printf("No client-certs rule maps certificate %s", cert.Subject)
+		return Identity{}, false, nil
+	}
+	if rule.User == "" {
+		return Identity{Subject: CertificateSubjectPrefix + name, Name: name, Roles: rule.Roles}, true, nil
+	}
+	user, err := a.Backend.GetUser(rule.User)
+	if err == ErrUserNotFound || (err == nil && user.Disabled) {
+		log.Warning.Printf("Certificate %s maps to missing or disabled user %s", cert.Subject, rule.User)
+		return Identity{}, true, ErrInvalidCertificate
+	} else if err != nil {
+		return Identity{}, true, err
+	}
+	return Identity{Subject: user.Id, Name: user.Name, Roles: user.Roles}, true, nil
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertRules(t *testing.T) {
+	_, err := certRulesFromConfig([]interface{}{map[string]interface{}{"roles": []interface{}{"operator"}}})
+	assert.NotNil(t, err)
+	_, err = certRulesFromConfig([]interface{}{map[string]interface{}{"cn": "ci", "user": "ci", "roles": []interface{}{"operator"}}})
+	assert.NotNil(t, err)
+	_, err = certRulesFromConfig([]interface{}{map[string]interface{}{"cn": "[", "user": "ci"}})
+	assert.NotNil(t, err)
+
+	rules, err := certRulesFromConfig([]interface{}{
+		map[string]interface{}{"cn": "build-*", "user": "ci"},
+		map[string]interface{}{"uri": "spiffe://example.org/deployer/*", "roles": []interface{}{"operator"}},
+		map[string]interface{}{"dns": "*.nodes.example.org", "roles": []interface{}{"cluster"}},
+	})
+	assert.Nil(t, err)
+
+	spiffe, _ := url.Parse("spiffe://example.org/deployer/web")
+	nested, _ := url.Parse("spiffe://example.org/deployer/web/admin")
+	for _, test := range []struct {
+		cert *x509.Certificate
+		user string
+		name string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "build-7"}}, "ci", "build-7"},
+		{&x509.Certificate{URIs: []*url.URL{spiffe}}, "", "spiffe://example.org/deployer/web"},
+		{&x509.Certificate{URIs: []*url.URL{nested}}, "-", ""},
+		{&x509.Certificate{DNSNames: []string{"A.Nodes.Example.org"}}, "", "a.nodes.example.org"},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}}, "-", ""},
+	} {
+		rule, name, ok := rules.Match(test.cert)
+		if test.user == "-" {
+			assert.False(t, ok, test.cert.Subject.String())
+			continue
+		}
+		assert.True(t, ok)
+		assert.Equal(t, test.user, rule.User)
+		assert.Equal(t, test.name, name)
+	}
+}
+
+func TestParseCertificate(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	backend := refreshBackend{"ci": {Id: "ci", Roles: []string{OPERATOR}}}
+	a := &Auth{Backend: backend, CertRules: CertRules{
+		{CN: "build-*", User: "ci"},
+		{CN: "deployer", Roles: []string{ADMINISTRATOR}},
+		{CN: "gone", User: "bob"},
+	}}
+
+	identity, ok, err := a.ParseCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "build-1"}})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", identity.Subject)
+	assert.Equal(t, []string{OPERATOR}, identity.Roles)
+
+	identity, ok, err = a.ParseCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "deployer"}})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, "cert:deployer", identity.Subject)
+	assert.Equal(t, []string{ADMINISTRATOR}, identity.Roles)
+
+	_, ok, err = a.ParseCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "gone"}})
+	assert.True(t, ok)
+	assert.Equal(t, ErrInvalidCertificate, err)
+
+	backend["ci"] = User{Id: "ci", Disabled: true}
+	_, _, err = a.ParseCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "build-1"}})
+	assert.Equal(t, ErrInvalidCertificate, err)
+
+	_, ok, err = a.ParseCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}})
+	assert.False(t, ok)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,128 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// HMAC secrets shorter than this are accepted with a warning
+const MinSecretLength = 32
+
+// Pick the signing method from the configured key, a secret signs
+// with HS256 and a PEM private key with RS256 or EdDSA
+func (a *Auth) loadSigningKey(secret string, keyFile string) error {
+	if keyFile == "" {
+		if secret == "" {
+			return ErrNoSigningKey
+		}
+		if len(secret) < MinSecretLength {
+			log.Warning.Printf("The authentication secret is shorter than %d bytes", MinSecretLength)
+		}
+		a.method = jwt.SigningMethodHS256
+		a.signKey = []byte(secret)
+		a.verifKey = a.signKey
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not read key-file: %v", err)
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("Could not parse key-file %s: %v", keyFile, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		a.method = jwt.SigningMethodRS256
+		a.signKey = key
+		a.verifKey = &key.PublicKey
+	case ed25519.PrivateKey:
+		a.method = SigningMethodEdDSA
+		a.signKey = key
+		a.verifKey = key.Public()
+	default:
+		return fmt.Errorf("key-file %s is not an RSA or Ed25519 private key", keyFile)
+	}
+	return nil
+}
+
+func parsePrivateKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// Ed25519 signatures as described by RFC 8037, jwt-go only ships
+// the HMAC, RSA and ECDSA methods
+type signingMethodEdDSA struct{}
+
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString string, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
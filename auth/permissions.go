@@ -1,8 +1,22 @@
 package auth
 
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
 type Permission struct {
 	Name  string `json:"name"`
 	Flags int    `json:"flags"`
+	// Limit the permission to packages whose id matches one of the
+	// globs or that carry one of the tags. Selectors starting with !
+	// exclude packages instead. Only routes that act on packages
+	// look at them.
+	Packages []string `json:"packages,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
 }
 
 type Permissions []Permission
@@ -33,3 +47,145 @@ func (p *Permission) CanCreate() bool {
 func (p *Permission) CanDelete() bool {
 	return p.Flags&DELETE != 0
 }
+
+// Whether one of the permissions grants flag on the named route
+func (permissions Permissions) Allowed(name string, flag int) bool {
+	for _, permission := range permissions {
+		if (permission.Name == name || permission.Name == AnyRoute) && permission.Flags&flag != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether one of the permissions grants flag on the named route for
+// a package
+func (permissions Permissions) AllowedOn(name string, flag int, packageId string, tags []string) bool {
+	for _, permission := range permissions {
+		if (permission.Name == name || permission.Name == AnyRoute) && permission.Flags&flag != 0 && permission.Selects(packageId, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the permission's selectors include a package. Permissions
+// without selectors include every package, excluding selectors win
+// over including ones.
+func (p *Permission) Selects(packageId string, tags []string) bool {
+	included, hasIncludes := false, false
+	for _, pattern := range p.Packages {
+		exclude := strings.HasPrefix(pattern, "!")
+		matched, _ := path.Match(strings.TrimPrefix(pattern, "!"), packageId)
+		if exclude && matched {
+			return false
+		}
+		hasIncludes = hasIncludes || !exclude
+		included = included || (!exclude && matched)
+	}
+	for _, selector := range p.Tags {
+		exclude := strings.HasPrefix(selector, "!")
+		tagged := hasTag(tags, strings.TrimPrefix(selector, "!"))
+		if exclude && tagged {
+			return false
+		}
+		hasIncludes = hasIncludes || !exclude
+		included = included || (!exclude && tagged)
+	}
+	return included || !hasIncludes
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that package selectors are valid globs
+func (p *Permission) validSelectors() error {
+	for _, pattern := range p.Packages {
+		if _, err := path.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil || strings.TrimPrefix(pattern, "!") == "" {
+			return fmt.Errorf("permission %s: invalid package selector %q", p.Name, pattern)
+		}
+	}
+	return nil
+}
+
+var flagNames = []struct {
+	flag int
+	name string
+}{
+	{READ, "READ"},
+	{UPDATE, "UPDATE"},
+	{CREATE, "CREATE"},
+	{DELETE, "DELETE"},
+}
+
+// The flag a request method needs on its route
+func MethodFlag(method string) int {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return READ
+	case "PUT", "PATCH":
+		return UPDATE
+	case "DELETE":
+		return DELETE
+	}
+	return CREATE
+}
+
+func FlagName(flag int) string {
+	for _, f := range flagNames {
+		if f.flag == flag {
+			return f.name
+		}
+	}
+	return strconv.Itoa(flag)
+}
+
+// Flags are either the bit mask or a list of flag names such as
+// ["READ", "CREATE"]
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Name     string          `json:"name"`
+		Flags    json.RawMessage `json:"flags"`
+		Packages []string        `json:"packages"`
+		Tags     []string        `json:"tags"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	p.Name = raw.Name
+	p.Flags = 0
+	p.Packages = raw.Packages
+	p.Tags = raw.Tags
+	if err := p.validSelectors(); err != nil {
+		return err
+	}
+	if len(raw.Flags) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Flags, &p.Flags); err == nil {
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(raw.Flags, &names); err != nil {
+		return fmt.Errorf("permission %s: flags must be a number or a list of flag names", raw.Name)
+	}
+	for _, name := range names {
+		found := false
+		for _, f := range flagNames {
+			if strings.EqualFold(f.name, name) {
+				p.Flags |= f.flag
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("permission %s: unknown flag %s", raw.Name, name)
+		}
+	}
+	return nil
+}
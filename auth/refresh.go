@@ -0,0 +1,186 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/satori/go.uuid"
+)
+
+const accessTokenType = "access"
+const refreshTokenType = "refresh"
+
+var ErrRevocationFailed = errors.New("Failed to revoke token")
+var ErrAlreadyRevoked = errors.New("Token has already been revoked")
+
+// Token ids that are no longer accepted, entries can be forgotten once
+// the token they belong to has expired. Revoke checks and adds the id
+// in one step and returns ErrAlreadyRevoked if it's already listed,
+// so only one caller can consume a single use token.
+type RevocationList interface {
+	Revoke(tokenId string, expires time.Time) error
+	Revoked(tokenId string) bool
+}
+
+// A revocation list only known to this node
+type MemoryRevocations struct {
+	mutex   sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func NewMemoryRevocations() *MemoryRevocations {
+	return &MemoryRevocations{revoked: make(map[string]time.Time)}
+}
+
+func (m *MemoryRevocations) Revoke(tokenId string, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for id, until := range m.revoked {
+		if until.Before(now) {
+			delete(m.revoked, id)
+		}
+	}
+	if _, ok := m.revoked[tokenId]; ok {
+		return ErrAlreadyRevoked
+	}
+	m.revoked[tokenId] = expires
+	return nil
+}
+
+func (m *MemoryRevocations) Revoked(tokenId string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.revoked[tokenId]
+	return ok
+}
+
+// Sign a refresh token for the user, it can only be exchanged for a
+// new pair of tokens
+func (a *Auth) CreateRefreshToken(user User) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(a.RefreshTTL).UTC()
+	token := jwt.NewWithClaims(a.method, jwt.MapClaims{
+		"sub": user.Id,
+		"iss": a.Issuer,
+		"iat": now.Unix(),
+		"exp": expires.Unix(),
+		"jti": uuid.NewV4().String(),
+		"typ": refreshTokenType,
+	})
+	tokenString, err := token.SignedString(a.signKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expires, nil
+}
+
+// Exchange a refresh token for a new access token and refresh token,
+// the old refresh token is revoked so it can only be used once
+func (a *Auth) Refresh(refreshToken string) (string, Identity, string, time.Time, error) {
+	claims, err := a.parseClaims(refreshToken)
+	if err != nil {
+		return "", Identity{}, "", time.Time{}, err
+	}
+	subject, _ := claims["sub"].(string)
+	tokenId, _ := claims["jti"].(string)
+	if typ, _ := claims["typ"].(string); typ != refreshTokenType || subject == "" || tokenId == "" {
+		return "", Identity{}, "", time.Time{}, ErrInvalidToken
+	}
+	// Roles and the disabled flag may have changed since login
+	user, err := a.Backend.GetUser(subject)
+	if err == ErrUserNotFound {
+		return "", Identity{}, "", time.Time{}, ErrInvalidToken
+	} else if err != nil {
+		return "", Identity{}, "", time.Time{}, err
+	}
+	if user.Disabled {
+		return "", Identity{}, "", time.Time{}, ErrInvalidToken
+	}
+	expires := time.Now().Add(a.RefreshTTL)
+	if exp, ok := claims["exp"].(float64); ok {
+		expires = time.Unix(int64(exp), 0)
+	}
+	if err := a.Revoke(tokenId, expires); err != nil {
+		return "", Identity{}, "", time.Time{}, err
+	}
+
+	token, identity, err := a.CreateToken(user)
+	if err != nil {
+		return "", Identity{}, "", time.Time{}, err
+	}
+	refresh, refreshExpires, err := a.CreateRefreshToken(user)
+	if err != nil {
+		return "", Identity{}, "", time.Time{}, err
+	}
+	return token, identity, refresh, refreshExpires, nil
+}
+
+// Revoke the access token of an identity and, when given, a refresh
+// token of the same user
+func (a *Auth) Logout(identity Identity, refreshToken string) error {
+	if identity.TokenId != "" && identity.ExpiresAt != nil {
+		if err := a.Revoke(identity.TokenId, *identity.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	if refreshToken == "" {
+		return nil
+	}
+	claims, err := a.parseClaims(refreshToken)
+	if err != nil {
+		return err
+	}
+	subject, _ := claims["sub"].(string)
+	tokenId, _ := claims["jti"].(string)
+	if typ, _ := claims["typ"].(string); typ != refreshTokenType || tokenId == "" {
+		return ErrInvalidToken
+	}
+	if identity.TokenId != "" && subject != identity.Subject {
+		return ErrInvalidToken
+	}
+	expires := time.Now().Add(a.RefreshTTL)
+	if exp, ok := claims["exp"].(float64); ok {
+		expires = time.Unix(int64(exp), 0)
+	}
+	return a.Revoke(tokenId, expires)
+}
+
+// Stop accepting a token before it expires
+func (a *Auth) Revoke(tokenId string, expires time.Time) error {
+	if a.Revocations == nil {
+		return ErrRevocationFailed
+	}
+	if err := a.Revocations.Revoke(tokenId, expires); err == ErrAlreadyRevoked {
+		return ErrInvalidToken
+	} else if err != nil {
+		log.Error.Printf("Failed to revoke token %s: %v", tokenId, err)
+		return ErrRevocationFailed
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type refreshBackend map[string]User
+
+func (b refreshBackend) Authenticate(authParams map[string]string) (User, error) {
+	return User{}, ErrInvalidCredentials
+}
+
+func (b refreshBackend) GetUser(id string) (User, error) {
+	if user, ok := b[id]; ok {
+		return user, nil
+	}
+	return User{}, ErrUserNotFound
+}
+
+func TestRefresh(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	backend := refreshBackend{"alice": {Id: "alice", Roles: []string{OPERATOR}}}
+	a := &Auth{Backend: backend, Issuer: "deployd", TokenTTL: time.Minute, RefreshTTL: time.Hour, Revocations: NewMemoryRevocations()}
+	assert.Nil(t, a.loadSigningKey("0123456789abcdef0123456789abcdef", ""))
+
+	refresh, _, err := a.CreateRefreshToken(backend["alice"])
+	assert.Nil(t, err)
+	_, err = a.ParseToken(refresh)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// Roles are read again, refreshing picks up changes
+	backend["alice"] = User{Id: "alice", Roles: []string{ADMINISTRATOR}}
+	token, identity, next, _, err := a.Refresh(refresh)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ADMINISTRATOR}, identity.Roles)
+	_, _, _, _, err = a.Refresh(refresh)
+	assert.Equal(t, ErrInvalidToken, err)
+	_, _, _, _, err = a.Refresh(token)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	parsed, err := a.ParseToken(token)
+	assert.Nil(t, err)
+	assert.Nil(t, a.Logout(parsed, ""))
+	_, err = a.ParseToken(token)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	backend["alice"] = User{Id: "alice", Disabled: true}
+	_, _, _, _, err = a.Refresh(next)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// Tokens can't be revoked without a list, refreshing fails closed
+	a.Revocations = nil
+	backend["alice"] = User{Id: "alice"}
+	refresh, _, err = a.CreateRefreshToken(backend["alice"])
+	assert.Nil(t, err)
+	_, _, _, _, err = a.Refresh(refresh)
+	assert.Equal(t, ErrRevocationFailed, err)
+}
+
+func TestMemoryRevocationsForgetExpired(t *testing.T) {
+	list := NewMemoryRevocations()
+	assert.Nil(t, list.Revoke("old", time.Now().Add(-time.Minute)))
+	assert.True(t, list.Revoked("old"))
+	assert.Nil(t, list.Revoke("new", time.Now().Add(time.Minute)))
+	assert.False(t, list.Revoked("old"))
+	assert.True(t, list.Revoked("new"))
+}
+
+func TestRefreshTokenSingleUse(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	backend := refreshBackend{"alice": {Id: "alice", Roles: []string{OPERATOR}}}
+	a := &Auth{Backend: backend, Issuer: "deployd", TokenTTL: time.Minute, RefreshTTL: time.Hour, Revocations: NewMemoryRevocations()}
+	assert.Nil(t, a.loadSigningKey("0123456789abcdef0123456789abcdef", ""))
+	refresh, _, err := a.CreateRefreshToken(backend["alice"])
+	assert.Nil(t, err)
+
+	// Every racing refresh gets past parsing, only one may win
+	var wg sync.WaitGroup
+	var succeeded int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, _, err := a.Refresh(refresh); err == nil {
+				atomic.AddInt32(&succeeded, 1)
+			} else {
+				assert.Equal(t, ErrInvalidToken, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), succeeded)
+
+	list := NewMemoryRevocations()
+	assert.Nil(t, list.Revoke("id", time.Now().Add(time.Minute)))
+	assert.Equal(t, ErrAlreadyRevoked, list.Revoke("id", time.Now().Add(time.Minute)))
+}
@@ -6,35 +6,115 @@ type Role struct {
 	Permissions Permissions `json:"permissions"`
 }
 
-type Roles [256]Role
-
-func initBuiltin(roles Roles) {
-	var role Role
-	role = Role{}
-	role.Id = "anonymous"
-	role.Name = "Anonymous Users"
-	var permissions Permissions
-	permissions = make([]Permission, 1)
-	permissions[0] = Permission{Name: "Login", Flags: READ & CREATE & UPDATE}
-	role.Permissions = permissions
-	roles[0] = role
-
-	role = Role{}
-	role.Id = "administrator"
-	role.Name = "Administrator"
-	permissions = make([]Permission, 11)
-	permissions[0] = Permission{Name: "Login", Flags: READ & CREATE & UPDATE & DELETE}
-	permissions[1] = Permission{Name: "Index", Flags: READ}
-	permissions[2] = Permission{Name: "Packages", Flags: READ & CREATE}
-	permissions[3] = Permission{Name: "PackageDetails", Flags: READ & UPDATE & DELETE}
-	permissions[4] = Permission{Name: "PackageDeploy", Flags: CREATE}
-	permissions[5] = Permission{Name: "PackageDeployTemplate", Flags: CREATE}
-	permissions[6] = Permission{Name: "Deployments", Flags: READ}
-	permissions[7] = Permission{Name: "DeploymentDetails", Flags: READ}
-	permissions[8] = Permission{Name: "CurrentUser", Flags: READ}
-	permissions[9] = Permission{Name: "Users", Flags: READ & CREATE}
-	permissions[10] = Permission{Name: "UserDetails", Flags: READ & CREATE & DELETE}
-	role.Permissions = permissions
-	roles[1] = role
+type Roles []Role
 
+// Role ids given special meaning
+const (
+	ANONYMOUS     = "anonymous"
+	OPERATOR      = "operator"
+	ADMINISTRATOR = "administrator"
+	// Held by tokens other machines forward deployments with
+	CLUSTER = "cluster"
+)
+
+// Permissions named * apply to every route
+const AnyRoute = "*"
+
+// The roles every deployd knows about, configured roles with the
+// same id replace them
+func BuiltinRoles() Roles {
+	return Roles{
+		{
+			Id:   ANONYMOUS,
+			Name: "Anonymous Users",
+			Permissions: Permissions{
+				{Name: "Login", Flags: CREATE},
+				{Name: "RefreshToken", Flags: CREATE},
+				{Name: "Logout", Flags: DELETE},
+				{Name: "Healthz", Flags: READ},
+				{Name: "Readyz", Flags: READ},
+			},
+		},
+		{
+			Id:   OPERATOR,
+			Name: "Operator",
+			Permissions: Permissions{
+				{Name: "Login", Flags: CREATE},
+				{Name: "RefreshToken", Flags: CREATE},
+				{Name: "Logout", Flags: DELETE},
+				{Name: "CurrentUser", Flags: READ},
+				{Name: "Index", Flags: READ},
+				{Name: "OpenAPI", Flags: READ},
+				{Name: "Healthz", Flags: READ},
+				{Name: "Readyz", Flags: READ},
+				{Name: "Packages", Flags: READ},
+				{Name: "PackageDetails", Flags: READ},
+				{Name: "PackageBundle", Flags: READ},
+				{Name: "PackageDeploy", Flags: CREATE},
+				{Name: "PackageDeployTemplate", Flags: CREATE},
+				{Name: "Deployments", Flags: READ},
+				{Name: "DeploymentDetails", Flags: READ},
+				{Name: "DeploymentRedeploy", Flags: CREATE},
+				{Name: "DeploymentUndeploy", Flags: CREATE},
+				{Name: "DeploymentBatch", Flags: CREATE},
+				{Name: "BatchDetails", Flags: READ},
+			},
+		},
+		{
+			Id:          ADMINISTRATOR,
+			Name:        "Administrator",
+			Permissions: Permissions{{Name: AnyRoute, Flags: READ | CREATE | UPDATE | DELETE}},
+		},
+		{
+			Id:          CLUSTER,
+			Name:        "Cluster Machines",
+			Permissions: Permissions{{Name: "DeploymentForward", Flags: CREATE}},
+		},
+	}
+}
+
+func (roles Roles) Find(id string) (Role, bool) {
+	for _, role := range roles {
+		if role.Id == id {
+			return role, true
+		}
+	}
+	return Role{}, false
+}
+
+// Add roles, replacing the ones with the same id
+func (roles Roles) Merge(more Roles) Roles {
+	merged := make(Roles, 0, len(roles)+len(more))
+	for _, role := range roles {
+		if _, ok := more.Find(role.Id); !ok {
+			merged = append(merged, role)
+		}
+	}
+	return append(merged, more...)
+}
+
+// Whether any of the role ids grants flag on the named route for a
+// package
+func (roles Roles) AllowedOn(ids []string, name string, flag int, packageId string, tags []string) bool {
+	for _, id := range ids {
+		role, ok := roles.Find(id)
+		if ok && role.Permissions.AllowedOn(name, flag, packageId, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any of the role ids grants flag on the named route
+func (roles Roles) Allowed(ids []string, name string, flag int) bool {
+	for _, id := range ids {
+		role, ok := roles.Find(id)
+		if !ok {
+			continue
+		}
+		if role.Permissions.Allowed(name, flag) {
+			return true
+		}
+	}
+	return false
 }
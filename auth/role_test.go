@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinRoles(t *testing.T) {
+	roles := BuiltinRoles()
+	assert.True(t, roles.Allowed([]string{ANONYMOUS}, "Login", CREATE))
+	assert.False(t, roles.Allowed([]string{ANONYMOUS}, "Packages", READ))
+	assert.True(t, roles.Allowed([]string{OPERATOR}, "PackageDeploy", CREATE))
+	assert.False(t, roles.Allowed([]string{OPERATOR}, "PackageDetails", UPDATE))
+	assert.True(t, roles.Allowed([]string{ADMINISTRATOR}, "PackageDetails", UPDATE|DELETE))
+	assert.True(t, roles.Allowed([]string{"unknown", ADMINISTRATOR}, "Users", DELETE))
+	assert.False(t, roles.Allowed([]string{"unknown"}, "Login", CREATE))
+}
+
+func TestRolesFromConfig(t *testing.T) {
+	var config interface{}
+	assert.Nil(t, json.Unmarshal([]byte(`[
+		{"id": "operator", "permissions": [{"name": "Deployments", "flags": ["READ"]}]},
+		{"id": "packager", "permissions": [{"name": "PackageDetails", "flags": 3}, {"name": "PackageImport", "flags": ["create"]}]}
+	]`), &config))
+	custom, err := rolesFromConfig(config)
+	assert.Nil(t, err)
+	roles := BuiltinRoles().Merge(custom)
+
+	assert.True(t, roles.Allowed([]string{"packager"}, "PackageDetails", UPDATE))
+	assert.True(t, roles.Allowed([]string{"packager"}, "PackageImport", CREATE))
+	// The configured operator replaces the built-in one
+	assert.True(t, roles.Allowed([]string{OPERATOR}, "Deployments", READ))
+	assert.False(t, roles.Allowed([]string{OPERATOR}, "PackageDeploy", CREATE))
+
+	assert.Nil(t, json.Unmarshal([]byte(`[{"id": "x", "permissions": [{"name": "Packages", "flags": ["WRITE"]}]}]`), &config))
+	_, err = rolesFromConfig(config)
+	assert.NotNil(t, err)
+}
+
+func TestPermissionSelectors(t *testing.T) {
+	var permission Permission
+	assert.Nil(t, json.Unmarshal([]byte(`{"name": "PackageDeploy", "flags": ["CREATE"], "packages": ["php-*", "!php-legacy"], "tags": ["web", "!db"]}`), &permission))
+	assert.True(t, permission.Selects("php-fpm", nil))
+	assert.True(t, permission.Selects("nginx", []string{"web"}))
+	assert.False(t, permission.Selects("php-legacy", []string{"web"}))
+	assert.False(t, permission.Selects("php-db", []string{"db"}))
+	assert.False(t, permission.Selects("redis", nil))
+	// Only excluding selectors include everything else
+	assert.True(t, (&Permission{Tags: []string{"!db"}}).Selects("redis", nil))
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"name": "PackageDeploy", "packages": ["["]}`), &permission))
+
+	roles := Roles{{Id: "team-a", Permissions: Permissions{{Name: "PackageDeploy", Flags: CREATE, Packages: []string{"php-*"}}}}}
+	assert.True(t, roles.AllowedOn([]string{"team-a"}, "PackageDeploy", CREATE, "php-fpm", nil))
+	assert.False(t, roles.AllowedOn([]string{"team-a"}, "PackageDeploy", CREATE, "db", nil))
+	// The route itself is allowed, handlers check the package
+	assert.True(t, roles.Allowed([]string{"team-a"}, "PackageDeploy", CREATE))
+}
@@ -0,0 +1,81 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"regexp"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUserExists = errors.New("A user with that id already exist")
+var ErrUserChanged = errors.New("User changed since it was read")
+var ErrInvalidUserId = errors.New("User ids may only contain letters, digits and . _ @ -")
+
+// Passwords shorter than this are refused
+const MinPasswordLength = 8
+
+var userIdPattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,128}$`)
+
+// Implemented by backends that can manage their users, changes are
+// applied with check-and-set so concurrent edits don't overwrite
+// each other
+type UserStore interface {
+	GetUsers() ([]User, error)
+	CreateUser(user User) (User, error)
+	// Apply update to the current user and store the result, an
+	// error from update leaves the user unchanged
+	UpdateUser(id string, update func(user *User) error) (User, error)
+	// Delete the user unless check returns an error
+	DeleteUser(id string, check func(user User) error) error
+}
+
+// Implemented by backends that store roles next to their users
+type RoleSource interface {
+	GetRoles() (Roles, error)
+}
+
+func ValidUserId(id string) bool {
+	return userIdPattern.MatchString(id)
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// A copy of the user that is safe to return from the API
+func (u User) Public() User {
+	u.PasswordHash = ""
+	return u
+}
+
+// The backend's user store, nil when it can't manage users
+func (a *Auth) Users() UserStore {
+	store, _ := a.Backend.(UserStore)
+	return store
+}
@@ -0,0 +1,305 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cchamplin/deployd/auth"
+)
+
+// Nil when no auth section is configured, the API is open then
+var authenticator *auth.Auth
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type TokenResponse struct {
+	Token            string        `json:"token"`
+	TokenType        string        `json:"tokenType"`
+	ExpiresAt        time.Time     `json:"expiresAt"`
+	RefreshToken     string        `json:"refreshToken"`
+	RefreshExpiresAt time.Time     `json:"refreshExpiresAt"`
+	Identity         auth.Identity `json:"identity"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Authenticate the request's bearer token, API key or client
+// certificate and check that its roles grant the flag the method needs
+// on the route. Requests without any are made with the anonymous role.
+func authorizeRoute(routeName string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authenticator == nil {
+			fn(w, r)
+			return
+		}
+		identity, authenticated := auth.Anonymous, false
+		if token := auth.BearerToken(r); token != "" {
+			var err error
+			if identity, err = authenticator.ParseToken(token); err != nil {
+				unauthorized(w, r, err.Error())
+				return
+			}
+			authenticated = true
+		} else if key := auth.APIKeyToken(r); key != "" {
+			var err error
+			if identity, err = authenticator.ParseAPIKey(key); err != nil {
+				unauthorized(w, r, err.Error())
+				return
+			}
+			authenticated = true
+		} else if cert := clientCertificate(r); cert != nil {
+			var err error
+			if identity, authenticated, err = authenticator.ParseCertificate(cert); err != nil {
+				unauthorized(w, r, err.Error())
+				return
+			} else if !authenticated {
+				identity = auth.Anonymous
+			}
+		}
+
+		flag := auth.MethodFlag(r.Method)
+		if !authenticator.Permits(identity, routeName, flag) {
+			if !authenticated {
+				unauthorized(w, r, "A bearer token or API key is required, see POST /v1/auth")
+				return
+			}
+			forbidden(w, r, identity, routeName, flag)
+			return
+		}
+		if authenticated {
+			r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+		}
+		fn(w, r)
+	}
+}
+
+// The verified client certificate of a TLS request, nil when there is
+// none. Certificates the server didn't verify against client-ca are
+// never trusted.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Name the permission that is missing so it can be granted
+func forbidden(w http.ResponseWriter, r *http.Request, identity auth.Identity, routeName string, flag int) {
+	permission := routeName + ":" + auth.FlagName(flag)
+	detail := "None of your roles grant " + auth.FlagName(flag) + " on " + routeName
+	if identity.KeyId != "" {
+		detail = "Your API key or its owner's roles don't grant " + auth.FlagName(flag) + " on " + routeName
+	}
+	problem := newProblem(r, http.StatusForbidden, ERR_PERMISSION_DENIED, detail)
+	problem.Permission = permission
+	sendProblem(w, problem)
+}
+
+// Whether the request may use the method's flag on the route for a
+// package, roles and API keys can be limited to some packages. A 403
+// is written when it may not.
+func packageAllowed(w http.ResponseWriter, r *http.Request, routeName string, packageId string, tags []string) bool {
+	if packagePermitted(r, routeName, packageId, tags) {
+		return true
+	}
+	flag := auth.MethodFlag(r.Method)
+	problem := newProblem(r, http.StatusForbidden, ERR_PERMISSION_DENIED, "You are not allowed to "+auth.FlagName(flag)+" "+routeName+" on package "+packageId)
+	problem.Permission = routeName + ":" + auth.FlagName(flag)
+	sendProblem(w, problem)
+	return false
+}
+
+func packagePermitted(r *http.Request, routeName string, packageId string, tags []string) bool {
+	if authenticator == nil {
+		return true
+	}
+	identity, ok := auth.IdentityFrom(r)
+	if !ok {
+		identity = auth.Anonymous
+	}
+	return authenticator.PermitsPackage(identity, routeName, auth.MethodFlag(r.Method), packageId, tags)
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="deployd"`)
+	w.Header().Add("WWW-Authenticate", `ApiKey realm="deployd"`)
+	writeProblem(w, r, http.StatusUnauthorized, ERR_UNAUTHENTICATED, detail)
+}
+
+// Return the identity and roles of the token the request was made with
+func CurrentUser(w http.ResponseWriter, r *http.Request) {
+	if authenticator == nil {
+		writeProblem(w, r, http.StatusNotFound, ERR_AUTH_DISABLED, "Authentication is not configured")
+		return
+	}
+	identity, _ := auth.IdentityFrom(r)
+	writeJSON(w, r, http.StatusOK, identity)
+}
+
+// Exchange a username and password for a token, the credentials are
+// a JSON body or form fields
+func Authenticate(w http.ResponseWriter, r *http.Request) {
+	if authenticator == nil {
+		writeProblem(w, r, http.StatusNotFound, ERR_AUTH_DISABLED, "Authentication is not configured")
+		return
+	}
+
+	var login LoginRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&login); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse login request: "+err.Error())
+			return
+		}
+	} else {
+		login.Username = r.FormValue("username")
+		login.Password = r.FormValue("password")
+	}
+	var fields []FieldError
+	if login.Username == "" {
+		fields = append(fields, FieldError{Field: "username", Message: "is required"})
+	}
+	if login.Password == "" {
+		fields = append(fields, FieldError{Field: "password", Message: "is required"})
+	}
+	if len(fields) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid login request", fields...)
+		return
+	}
+
+	token, identity, err := authenticator.Login(map[string]string{"username": login.Username, "password": login.Password})
+	// Failed logins are recorded with the username that was tried
+	entry := newAuditEntry(r, "Login")
+	entry.Principal = login.Username
+	entry.Resource = "/auth"
+	switch err {
+	case nil:
+		entry.Status = http.StatusOK
+	case auth.ErrInvalidCredentials:
+		entry.Status = http.StatusUnauthorized
+	default:
+		entry.Status = http.StatusInternalServerError
+		entry.Detail = err.Error()
+	}
+	recordAudit(entry)
+	var refresh string
+	var refreshExpires time.Time
+	if err == nil {
+		if refresh, refreshExpires, err = authenticator.CreateRefreshToken(auth.User{Id: identity.Subject}); err != nil {
+			err = fmt.Errorf("failed to sign refresh token: %v", err)
+		}
+	}
+	switch err {
+	case nil:
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, r, http.StatusOK, TokenResponse{Token: token, TokenType: "Bearer", ExpiresAt: *identity.ExpiresAt, RefreshToken: refresh, RefreshExpiresAt: refreshExpires, Identity: identity})
+	case auth.ErrInvalidCredentials:
+		writeProblem(w, r, http.StatusUnauthorized, ERR_INVALID_CREDENTIALS, err.Error())
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to authenticate: "+err.Error())
+	}
+}
+
+// The refresh token of a JSON body or form field, a 400 is written
+// when the body can't be parsed
+func readRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request RefreshRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil && err != io.EOF {
+			writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse request: "+err.Error())
+			return "", false
+		}
+	} else {
+		request.RefreshToken = r.FormValue("refreshToken")
+	}
+	return request.RefreshToken, true
+}
+
+// Exchange a refresh token for a new access token and refresh token,
+// each refresh token can only be used once
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	if authenticator == nil {
+		writeProblem(w, r, http.StatusNotFound, ERR_AUTH_DISABLED, "Authentication is not configured")
+		return
+	}
+	refreshToken, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	if refreshToken == "" {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid refresh request", FieldError{Field: "refreshToken", Message: "is required"})
+		return
+	}
+
+	token, identity, refresh, refreshExpires, err := authenticator.Refresh(refreshToken)
+	switch err {
+	case nil:
+		auditResource(r, "/auth")
+		auditDetail(r, "user "+identity.Subject)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, r, http.StatusOK, TokenResponse{Token: token, TokenType: "Bearer", ExpiresAt: *identity.ExpiresAt, RefreshToken: refresh, RefreshExpiresAt: refreshExpires, Identity: identity})
+	case auth.ErrInvalidToken:
+		unauthorized(w, r, "The refresh token is invalid, expired or was already used")
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to refresh token: "+err.Error())
+	}
+}
+
+// Revoke the request's bearer token and the refresh token in the
+// body, either may be missing but not both
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if authenticator == nil {
+		writeProblem(w, r, http.StatusNotFound, ERR_AUTH_DISABLED, "Authentication is not configured")
+		return
+	}
+	refreshToken, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	identity, _ := auth.IdentityFrom(r)
+	if identity.TokenId == "" && refreshToken == "" {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "A bearer token or a refresh token is required to log out")
+		return
+	}
+
+	switch err := authenticator.Logout(identity, refreshToken); err {
+	case nil:
+		auditResource(r, "/auth")
+		w.WriteHeader(http.StatusNoContent)
+	case auth.ErrInvalidToken:
+		unauthorized(w, r, "The refresh token is invalid or belongs to another user")
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to log out: "+err.Error())
+	}
+}
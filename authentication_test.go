@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cchamplin/deployd/audit"
+	"github.com/cchamplin/deployd/auth"
+	backends "github.com/cchamplin/deployd/backends/audit"
+	"github.com/cchamplin/deployd/deployment"
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type testAuthBackend struct{}
+
+func (b testAuthBackend) Authenticate(authParams map[string]string) (auth.User, error) {
+	if authParams["username"] == "alice" && authParams["password"] == "secret" {
+		return auth.User{Id: "alice", Roles: []string{"operator"}}, nil
+	}
+	return auth.User{}, auth.ErrInvalidCredentials
+}
+
+func (b testAuthBackend) GetUser(id string) (auth.User, error) {
+	if id == "alice" {
+		return auth.User{Id: "alice", Roles: []string{"operator"}}, nil
+	}
+	return auth.User{}, auth.ErrUserNotFound
+}
+
+func withTestAuthenticator(t *testing.T) func() {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	a, err := auth.AuthFromConfig(map[string]interface{}{
+		"type":   "test",
+		"secret": "0123456789abcdef0123456789abcdef",
+		"roles": []interface{}{
+			map[string]interface{}{"id": "auditor", "permissions": []interface{}{
+				map[string]interface{}{"name": "Deployments", "flags": []interface{}{"read"}},
+			}},
+		},
+	})
+	assert.Nil(t, err)
+	authenticator = a
+	return func() { authenticator = nil }
+}
+
+func init() {
+	auth.RegisterBackend("test", func(config map[string]interface{}) (auth.AuthenticationBackend, error) {
+		return testAuthBackend{}, nil
+	})
+}
+
+func TestLoginFlow(t *testing.T) {
+	defer withTestAuthenticator(t)()
+	router := NewRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/auth", nil))
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, `Bearer realm="deployd"`, w.Header().Get("WWW-Authenticate"))
+
+	r := httptest.NewRequest("POST", "/v1/auth", strings.NewReader(`{"username": "alice", "password": "wrong"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, ERR_INVALID_CREDENTIALS, decodeProblem(t, w).Code)
+
+	r = httptest.NewRequest("POST", "/v1/auth", strings.NewReader(`{"username": "alice", "password": "secret"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	var token TokenResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &token))
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.True(t, token.ExpiresAt.After(time.Now()))
+
+	r = httptest.NewRequest("GET", "/v1/auth", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	var identity auth.Identity
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &identity))
+	assert.Equal(t, "alice", identity.Subject)
+	assert.Equal(t, []string{"operator"}, identity.Roles)
+
+	r = httptest.NewRequest("GET", "/v1/auth", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Token+"x")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+
+	// Only the login and probe routes answer without a token
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	defer withTestAuthenticator(t)()
+	router := NewRouter()
+	send := func(method string, path string, bearer string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("POST", "/v1/auth", "", `{"username": "alice", "password": "secret"}`)
+	assert.Equal(t, 200, w.Code)
+	var login TokenResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &login))
+	assert.NotEmpty(t, login.RefreshToken)
+	assert.True(t, login.RefreshExpiresAt.After(login.ExpiresAt))
+
+	// A refresh token is not an access token
+	assert.Equal(t, 401, send("GET", "/v1/auth", login.RefreshToken, "").Code)
+
+	w = send("POST", "/v1/auth/refresh", "", `{"refreshToken": "`+login.RefreshToken+`"}`)
+	assert.Equal(t, 200, w.Code)
+	var refreshed TokenResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.Equal(t, "alice", refreshed.Identity.Subject)
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, 200, send("GET", "/v1/auth", refreshed.Token, "").Code)
+
+	// Refresh tokens are rotated, the old one can't be used again
+	assert.Equal(t, 401, send("POST", "/v1/auth/refresh", "", `{"refreshToken": "`+login.RefreshToken+`"}`).Code)
+	assert.Equal(t, 400, send("POST", "/v1/auth/refresh", "", `{}`).Code)
+
+	assert.Equal(t, 400, send("DELETE", "/v1/auth", "", "").Code)
+	assert.Equal(t, 204, send("DELETE", "/v1/auth", refreshed.Token, `{"refreshToken": "`+refreshed.RefreshToken+`"}`).Code)
+	assert.Equal(t, 401, send("GET", "/v1/auth", refreshed.Token, "").Code)
+	assert.Equal(t, 401, send("POST", "/v1/auth/refresh", "", `{"refreshToken": "`+refreshed.RefreshToken+`"}`).Code)
+	// The first access token was never revoked
+	assert.Equal(t, 200, send("GET", "/v1/auth", login.Token, "").Code)
+}
+
+func TestClientCertificateIdentity(t *testing.T) {
+	defer withTestAuthenticator(t)()
+	dir, err := ioutil.TempDir("", "deployd-audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := &backends.FileAudit{}
+	assert.Nil(t, store.Init(filepath.Join(dir, "audit.log")))
+	auditLog = audit.NewLog(store)
+	defer func() { auditLog = nil }()
+	authenticator.CertRules = auth.CertRules{
+		{CN: "build-*", User: "alice"},
+		{CN: "auditor", Roles: []string{"auditor"}},
+	}
+	router := NewRouter()
+	request := func(method string, path string, cn string, verified bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("GET", "/v1/auth", "build-1", true)
+	assert.Equal(t, 200, w.Code)
+	var identity auth.Identity
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &identity))
+	assert.Equal(t, "alice", identity.Subject)
+	assert.Equal(t, []string{"operator"}, identity.Roles)
+
+	// Mapped straight to a role, which doesn't grant CurrentUser
+	w = request("GET", "/v1/auth", "auditor", true)
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "CurrentUser:READ", decodeProblem(t, w).Permission)
+	// Unverified and unmapped certificates are anonymous
+	assert.Equal(t, 401, request("GET", "/v1/auth", "build-1", false).Code)
+	assert.Equal(t, 401, request("GET", "/v1/auth", "laptop", true).Code)
+
+	// Mapped certificates are recorded as who they map to
+	assert.Equal(t, 400, request("DELETE", "/v1/auth", "build-1", true).Code)
+	entries, err := store.Query(audit.Query{Action: "Logout"})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "alice", entries[0].Principal)
+	}
+}
+
+func TestAuthorizeRoute(t *testing.T) {
+	defer withTestAuthenticator(t)()
+	router := NewRouter()
+	request := func(method string, path string, roles ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if len(roles) > 0 {
+			token, _, err := authenticator.CreateToken(auth.User{Id: "alice", Roles: roles})
+			assert.Nil(t, err)
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, 200, request("GET", "/v1/openapi.json", auth.OPERATOR).Code)
+	assert.Equal(t, 401, request("GET", "/v1/openapi.json").Code)
+
+	w := request("PUT", "/v1/packages/php", auth.OPERATOR)
+	assert.Equal(t, 403, w.Code)
+	problem := decodeProblem(t, w)
+	assert.Equal(t, ERR_PERMISSION_DENIED, problem.Code)
+	assert.Equal(t, "PackageDetails:UPDATE", problem.Permission)
+
+	w = request("GET", "/v1/openapi.json", "auditor")
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "OpenAPI:READ", decodeProblem(t, w).Permission)
+	assert.Equal(t, 403, request("POST", "/v1/deployments/forward", auth.OPERATOR).Code)
+	assert.Equal(t, 200, request("GET", "/v1/openapi.json", "auditor", auth.ADMINISTRATOR).Code)
+}
+
+func TestPackagePermissions(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-packages")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	packages := `[{"id": "php-fpm"}, {"id": "nginx", "tags": ["web"]}, {"id": "pg", "tags": ["web", "db"]}, {"id": "redis"}]`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "packages.json"), []byte(packages), 0644))
+	repo = new(deployment.Repository)
+	repo.Init(dir, true, []string{"*"}, nil, nil, nil)
+	defer func() { repo = nil }()
+
+	teamA := []interface{}{"php-*"}
+	teamATags := []interface{}{"web", "!db"}
+	a, err := auth.AuthFromConfig(map[string]interface{}{
+		"type":   "test",
+		"secret": "0123456789abcdef0123456789abcdef",
+		"roles": []interface{}{
+			map[string]interface{}{"id": "team-a", "permissions": []interface{}{
+				map[string]interface{}{"name": "Packages", "flags": []interface{}{"read"}, "packages": teamA, "tags": teamATags},
+				map[string]interface{}{"name": "PackageDeploy", "flags": []interface{}{"create"}, "packages": teamA, "tags": teamATags},
+			}},
+		},
+	})
+	assert.Nil(t, err)
+	authenticator = a
+	defer func() { authenticator = nil }()
+	token, _, err := authenticator.CreateToken(auth.User{Id: "alice", Roles: []string{"team-a"}})
+	assert.Nil(t, err)
+
+	router := NewRouter()
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("GET", "/v1/packages")
+	assert.Equal(t, 200, w.Code)
+	var listed []deployment.Package
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	var ids []string
+	for _, pkg := range listed {
+		ids = append(ids, pkg.Id)
+	}
+	assert.ElementsMatch(t, []string{"php-fpm", "nginx"}, ids)
+
+	for _, id := range []string{"pg", "redis"} {
+		w = request("POST", "/v1/packages/"+id+"/deploy")
+		assert.Equal(t, 403, w.Code, id)
+		assert.Equal(t, "PackageDeploy:CREATE", decodeProblem(t, w).Permission)
+	}
+}
@@ -0,0 +1,118 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cchamplin/deployd/audit"
+	"github.com/cchamplin/deployd/log"
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	DefaultEtcdAuditEndpoint = "127.0.0.1:4001"
+	DefaultEtcdAuditPrefix   = "/deployd/audit"
+)
+
+// Entries stored as in-order keys under <prefix>/entries so every
+// machine of the cluster writes to and reads from the same log
+type EtcdAudit struct {
+	kapi   client.KeysAPI
+	prefix string
+}
+
+func init() {
+	audit.RegisterStore("etcd", func(config map[string]interface{}) (audit.Store, error) {
+		var endpoints []string
+		if list, ok := config["endpoints"].([]interface{}); ok {
+			for _, endpoint := range list {
+				if endpoint, ok := endpoint.(string); ok {
+					endpoints = append(endpoints, endpoint)
+				}
+			}
+		}
+		if len(endpoints) == 0 {
+			endpoints = []string{"http://" + audit.ConfigString(config, "endpoint", DefaultEtcdAuditEndpoint)}
+		}
+		etcdAudit := &EtcdAudit{}
+		if err := etcdAudit.Init(endpoints, audit.ConfigString(config, "prefix", DefaultEtcdAuditPrefix)); err != nil {
+			return nil, err
+		}
+		return etcdAudit, nil
+	})
+}
+
+func (e *EtcdAudit) Init(endpoints []string, prefix string) error {
+	c, err := client.New(client.Config{
+		Endpoints:               endpoints,
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second * 5,
+	})
+	if err != nil {
+		log.Error.Printf("Failed to initialize etcd client: %v", err)
+		return fmt.Errorf("Could not connect to etcd for the audit log: %v", err)
+	}
+	e.kapi = client.NewKeysAPI(c)
+	e.prefix = strings.TrimSuffix(prefix, "/")
+	log.Info.Printf("Writing the audit log to %s", e.prefix)
+	return nil
+}
+
+func (e *EtcdAudit) entriesKey() string {
+	return e.prefix + "/entries"
+}
+
+func (e *EtcdAudit) Append(entry audit.Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = e.kapi.CreateInOrder(context.Background(), e.entriesKey(), string(data), nil)
+	return err
+}
+
+func (e *EtcdAudit) Query(query audit.Query) ([]audit.Entry, error) {
+	result, err := e.kapi.Get(context.Background(), e.entriesKey(), &client.GetOptions{Recursive: true, Sort: true, Quorum: true})
+	if client.IsKeyNotFound(err) {
+		return []audit.Entry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []audit.Entry
+	for _, node := range result.Node.Nodes {
+		var entry audit.Entry
+		if err := json.Unmarshal([]byte(node.Value), &entry); err != nil {
+			log.Warning.Printf("Skipping unreadable audit entry %s: %v", node.Key, err)
+			continue
+		}
+		if query.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return query.Apply(entries), nil
+}
@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cchamplin/deployd/audit"
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileAudit(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit", "audit.log")
+
+	f := &FileAudit{}
+	assert.Nil(t, f.Init(path))
+	l := audit.NewLog(f)
+	assert.Nil(t, l.Record(audit.Entry{Action: "Login", Principal: "alice"}))
+	assert.Nil(t, l.Record(audit.Entry{Action: "PackageDeploy", Principal: "alice", Variables: map[string]string{"password": "hunter2"}}))
+
+	// A partial line left by a crash doesn't hide the other entries
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	file.WriteString(`{"id": "partial`)
+	file.Close()
+
+	entries, err := f.Query(audit.Query{Principal: "alice"})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "PackageDeploy", entries[0].Action)
+		assert.Equal(t, audit.Redacted, entries[0].Variables["password"])
+	}
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -21,6 +21,284 @@
 // THE SOFTWARE.
 package auth
 
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cchamplin/deployd/atomicfile"
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+)
+
+const DefaultAuthPath = "/etc/deployd"
+
+// Users, roles and API keys kept in users.json, roles.json and
+// apikeys.json in the configured directory. Missing files are treated
+// as empty.
 type DefaultAuth struct {
-	path string
+	path  string
+	mutex *sync.Mutex
+	// roles.json is read again when it changes
+	roles        auth.Roles
+	rolesModTime time.Time
+}
+
+func init() {
+	auth.RegisterBackend("default", func(config map[string]interface{}) (auth.AuthenticationBackend, error) {
+		defaultAuth := &DefaultAuth{}
+		defaultAuth.Init(auth.ConfigString(config, "path", DefaultAuthPath))
+		return defaultAuth, nil
+	})
+}
+
+func (d *DefaultAuth) Init(path string) {
+	d.path = path
+	d.mutex = &sync.Mutex{}
+	log.Info.Printf("Reading users from %s", d.usersFile())
+}
+
+func (d *DefaultAuth) usersFile() string {
+	return filepath.Join(d.path, "users.json")
+}
+
+func (d *DefaultAuth) rolesFile() string {
+	return filepath.Join(d.path, "roles.json")
+}
+
+func (d *DefaultAuth) apiKeysFile() string {
+	return filepath.Join(d.path, "apikeys.json")
+}
+
+// The file is read on every lookup so edits apply without a restart
+func (d *DefaultAuth) readUsers() ([]auth.User, error) {
+	data, err := ioutil.ReadFile(d.usersFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var users []auth.User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (d *DefaultAuth) writeUsers(users []auth.User) error {
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(d.usersFile(), data, 0600)
+}
+
+func (d *DefaultAuth) GetUsers() ([]auth.User, error) {
+	users, err := d.readUsers()
+	if err != nil {
+		log.Error.Printf("Failed to read %s: %v", d.usersFile(), err)
+		return nil, err
+	}
+	if users == nil {
+		users = []auth.User{}
+	}
+	return users, nil
+}
+
+func (d *DefaultAuth) GetUser(id string) (auth.User, error) {
+	users, err := d.GetUsers()
+	if err != nil {
+		return auth.User{}, err
+	}
+	for _, user := range users {
+		if user.Id == id {
+			return user, nil
+		}
+	}
+	return auth.User{}, auth.ErrUserNotFound
+}
+
+func (d *DefaultAuth) Authenticate(authParams map[string]string) (auth.User, error) {
+	user, err := d.GetUser(authParams["username"])
+	if err != nil && err != auth.ErrUserNotFound {
+		return auth.User{}, err
+	}
+	return checkPassword(user, err == nil, authParams["password"])
+}
+
+func (d *DefaultAuth) CreateUser(user auth.User) (auth.User, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	users, err := d.GetUsers()
+	if err != nil {
+		return auth.User{}, err
+	}
+	for _, existing := range users {
+		if existing.Id == user.Id {
+			return auth.User{}, auth.ErrUserExists
+		}
+	}
+	if err := d.writeUsers(append(users, user)); err != nil {
+		return auth.User{}, err
+	}
+	log.Info.Printf("Created user %s", user.Id)
+	return user, nil
+}
+
+func (d *DefaultAuth) UpdateUser(id string, update func(user *auth.User) error) (auth.User, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	users, err := d.GetUsers()
+	if err != nil {
+		return auth.User{}, err
+	}
+	for idx := range users {
+		if users[idx].Id != id {
+			continue
+		}
+		user := users[idx]
+		if err := update(&user); err != nil {
+			return auth.User{}, err
+		}
+		user.Id = id
+		users[idx] = user
+		if err := d.writeUsers(users); err != nil {
+			return auth.User{}, err
+		}
+		log.Info.Printf("Updated user %s", id)
+		return user, nil
+	}
+	return auth.User{}, auth.ErrUserNotFound
+}
+
+func (d *DefaultAuth) DeleteUser(id string, check func(user auth.User) error) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	users, err := d.GetUsers()
+	if err != nil {
+		return err
+	}
+	for idx := range users {
+		if users[idx].Id != id {
+			continue
+		}
+		if err := check(users[idx]); err != nil {
+			return err
+		}
+		if err := d.writeUsers(append(users[:idx], users[idx+1:]...)); err != nil {
+			return err
+		}
+		log.Info.Printf("Deleted user %s", id)
+		return nil
+	}
+	return auth.ErrUserNotFound
+}
+
+// Roles are checked on every request, roles.json is only parsed
+// again when its modification time changes
+func (d *DefaultAuth) GetRoles() (auth.Roles, error) {
+	info, err := os.Stat(d.rolesFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.roles != nil && info.ModTime().Equal(d.rolesModTime) {
+		return d.roles, nil
+	}
+	data, err := ioutil.ReadFile(d.rolesFile())
+	if err != nil {
+		return nil, err
+	}
+	var roles auth.Roles
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, err
+	}
+	d.roles = roles
+	d.rolesModTime = info.ModTime()
+	return roles, nil
+}
+
+func (d *DefaultAuth) GetAPIKeys() ([]auth.APIKey, error) {
+	data, err := ioutil.ReadFile(d.apiKeysFile())
+	if os.IsNotExist(err) {
+		return []auth.APIKey{}, nil
+	} else if err != nil {
+		log.Error.Printf("Failed to read %s: %v", d.apiKeysFile(), err)
+		return nil, err
+	}
+	keys := []auth.APIKey{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		log.Error.Printf("Failed to parse %s: %v", d.apiKeysFile(), err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (d *DefaultAuth) writeAPIKeys(keys []auth.APIKey) error {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(d.apiKeysFile(), data, 0600)
+}
+
+func (d *DefaultAuth) GetAPIKey(id string) (auth.APIKey, error) {
+	keys, err := d.GetAPIKeys()
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	for _, key := range keys {
+		if key.Id == id {
+			return key, nil
+		}
+	}
+	return auth.APIKey{}, auth.ErrAPIKeyNotFound
+}
+
+func (d *DefaultAuth) CreateAPIKey(key auth.APIKey) (auth.APIKey, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	keys, err := d.GetAPIKeys()
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	if err := d.writeAPIKeys(append(keys, key)); err != nil {
+		return auth.APIKey{}, err
+	}
+	return key, nil
+}
+
+func (d *DefaultAuth) UpdateAPIKey(id string, update func(key *auth.APIKey) error) (auth.APIKey, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	keys, err := d.GetAPIKeys()
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	for idx := range keys {
+		if keys[idx].Id != id {
+			continue
+		}
+		key := keys[idx]
+		if err := update(&key); err != nil {
+			return auth.APIKey{}, err
+		}
+		key.Id = id
+		keys[idx] = key
+		if err := d.writeAPIKeys(keys); err != nil {
+			return auth.APIKey{}, err
+		}
+		return key, nil
+	}
+	return auth.APIKey{}, auth.ErrAPIKeyNotFound
 }
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDefaultAuthAuthenticate(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-users")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	users := `[{"id": "alice", "roles": ["operator"], "passwordHash": "` + string(hash) + `"}, {"id": "bob", "roles": []}]`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "users.json"), []byte(users), 0600))
+
+	d := &DefaultAuth{}
+	d.Init(dir)
+	user, err := d.Authenticate(map[string]string{"username": "alice", "password": "secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"operator"}, user.Roles)
+
+	_, err = d.Authenticate(map[string]string{"username": "alice", "password": "wrong"})
+	assert.Equal(t, auth.ErrInvalidCredentials, err)
+	_, err = d.Authenticate(map[string]string{"username": "carol", "password": "secret"})
+	assert.Equal(t, auth.ErrInvalidCredentials, err)
+	// Users without a password can't log in with one
+	_, err = d.Authenticate(map[string]string{"username": "bob", "password": ""})
+	assert.Equal(t, auth.ErrInvalidCredentials, err)
+}
+
+func TestDefaultAuthUsers(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-users")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	d := &DefaultAuth{}
+	d.Init(dir)
+	users, err := d.GetUsers()
+	assert.Nil(t, err)
+	assert.Empty(t, users)
+
+	_, err = d.CreateUser(auth.User{Id: "bob", Roles: []string{"operator"}})
+	assert.Nil(t, err)
+	_, err = d.CreateUser(auth.User{Id: "alice"})
+	assert.Nil(t, err)
+	_, err = d.CreateUser(auth.User{Id: "bob"})
+	assert.Equal(t, auth.ErrUserExists, err)
+	info, err := os.Stat(filepath.Join(dir, "users.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = d.UpdateUser("bob", func(user *auth.User) error { return auth.ErrUserChanged })
+	assert.Equal(t, auth.ErrUserChanged, err)
+	user, err := d.UpdateUser("bob", func(user *auth.User) error {
+		user.Name = "Bob"
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"operator"}, user.Roles)
+	user, _ = d.GetUser("bob")
+	assert.Equal(t, "Bob", user.Name)
+
+	assert.Nil(t, d.DeleteUser("alice", func(user auth.User) error { return nil }))
+	assert.Equal(t, auth.ErrUserNotFound, d.DeleteUser("alice", func(user auth.User) error { return nil }))
+	users, _ = d.GetUsers()
+	assert.Len(t, users, 1)
+}
+
+func TestDefaultAuthRoles(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-roles")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	d := &DefaultAuth{}
+	d.Init(dir)
+	roles, err := d.GetRoles()
+	assert.Nil(t, err)
+	assert.Empty(t, roles)
+
+	file := filepath.Join(dir, "roles.json")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`[{"id": "deployer", "permissions": [{"name": "PackageDeploy", "flags": ["CREATE"]}]}]`), 0600))
+	roles, err = d.GetRoles()
+	assert.Nil(t, err)
+	assert.True(t, roles.Allowed([]string{"deployer"}, "PackageDeploy", auth.CREATE))
+
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`[{"id": "viewer", "permissions": []}]`), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(file, later, later))
+	roles, _ = d.GetRoles()
+	_, ok := roles.Find("viewer")
+	assert.True(t, ok)
+}
@@ -25,25 +25,73 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cchamplin/deployd/auth"
 	"github.com/cchamplin/deployd/log"
 	"github.com/coreos/etcd/client"
 	"golang.org/x/net/context"
 )
 
+const (
+	DefaultEtcdAuthEndpoint = "127.0.0.1:4001"
+	DefaultEtcdAuthPrefix   = "/deployd/auth"
+	// How often a check-and-set is retried when another node changed
+	// the key first
+	etcdAuthRetries = 5
+)
+
+// How long to wait before watching again after the watch failed
+var EtcdAuthRewatchDelay = time.Second * 5
+
+// Users, roles and API keys stored as JSON under <prefix>/users/<id>,
+// <prefix>/roles/<id> and <prefix>/apikeys/<id>. Every node keeps a
+// copy that a watch keeps current, writes go to etcd with
+// compare-and-swap.
 type EtcdAuth struct {
 	etcdConfig client.Config
 	etcdClient client.Client
 	kapi       client.KeysAPI
-	path       string
+	prefix     string
+	mutex      *sync.RWMutex
+	cache      *etcdAuthCache
+	stop       chan struct{}
 }
 
-func (e *EtcdAuth) Init(endpoint string, path string) {
-	e.path = path
-	var endpoints []string
-	endpoints = append(endpoints, fmt.Sprintf("http://%s", endpoint))
+type etcdAuthCache struct {
+	users   map[string]auth.User
+	roles   map[string]auth.Role
+	apiKeys map[string]auth.APIKey
+	// The etcd index every key was last changed at, deleted keys
+	// keep theirs so an older write can't bring them back
+	indexes map[string]uint64
+}
 
+func init() {
+	auth.RegisterBackend("etcd", func(config map[string]interface{}) (auth.AuthenticationBackend, error) {
+		var endpoints []string
+		if list, ok := config["endpoints"].([]interface{}); ok {
+			for _, endpoint := range list {
+				if endpoint, ok := endpoint.(string); ok {
+					endpoints = append(endpoints, endpoint)
+				}
+			}
+		}
+		if len(endpoints) == 0 {
+			endpoints = []string{"http://" + auth.ConfigString(config, "endpoint", DefaultEtcdAuthEndpoint)}
+		}
+		etcdAuth := &EtcdAuth{}
+		if err := etcdAuth.Init(endpoints, auth.ConfigString(config, "prefix", DefaultEtcdAuthPrefix)); err != nil {
+			return nil, err
+		}
+		return etcdAuth, nil
+	})
+}
+
+func (e *EtcdAuth) Init(endpoints []string, prefix string) error {
 	e.etcdConfig = client.Config{
 		Endpoints:               endpoints,
 		Transport:               client.DefaultTransport,
@@ -55,82 +103,448 @@ func (e *EtcdAuth) Init(endpoint string, path string) {
 	e.etcdClient = c
 	if err != nil {
 		log.Error.Printf("Failed to initialize etcd client: %v", err)
-		return
+		return fmt.Errorf("Could not connect to etcd for authentication: %v", err)
+	}
+	return e.start(client.NewKeysAPI(e.etcdClient), prefix)
+}
+
+// Load everything under the prefix and start watching for changes
+func (e *EtcdAuth) start(kapi client.KeysAPI, prefix string) error {
+	e.kapi = kapi
+	e.prefix = strings.TrimSuffix(prefix, "/")
+	e.mutex = &sync.RWMutex{}
+	e.stop = make(chan struct{})
+	index, err := e.load()
+	if err != nil {
+		return fmt.Errorf("Could not load users from etcd: %v", err)
 	}
+	log.Info.Printf("Loaded %d users and %d roles from %s", len(e.cache.users), len(e.cache.roles), e.prefix)
+	go e.watch(index)
+	return nil
+}
 
-	// Create a keys api
-	// Are we okay to use this instances for the lifetime
-	// of the application? What happens if the etcd
-	// instance we are connecting dies?
-	e.kapi = client.NewKeysAPI(e.etcdClient)
+// Stop watching for changes
+func (e *EtcdAuth) Close() {
+	close(e.stop)
+}
 
+func (e *EtcdAuth) userKey(id string) string {
+	return e.prefix + "/users/" + id
 }
 
-func (e *EtcdAuth) GetPath() string {
-	return e.path
+func (e *EtcdAuth) apiKeyKey(id string) string {
+	return e.prefix + "/apikeys/" + id
 }
 
-func (e *EtcdAuth) GetValue(key string) map[string]interface{} {
-	result, err := e.kapi.Get(context.Background(), key, nil)
+// Read the whole tree, returns the etcd index the copy is current to
+func (e *EtcdAuth) load() (uint64, error) {
+	cache := &etcdAuthCache{
+		users:   make(map[string]auth.User),
+		roles:   make(map[string]auth.Role),
+		apiKeys: make(map[string]auth.APIKey),
+		indexes: make(map[string]uint64),
+	}
+	result, err := e.kapi.Get(context.Background(), e.prefix, &client.GetOptions{Recursive: true, Quorum: true})
+	if client.IsKeyNotFound(err) {
+		e.replace(cache)
+		return etcdErrorIndex(err), nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if node.Dir {
+			for _, child := range node.Nodes {
+				walk(child)
+			}
+			return
+		}
+		e.applyNode(cache, node, false, node.ModifiedIndex)
+	}
+	walk(result.Node)
+	e.replace(cache)
+	return result.Index, nil
+}
+
+func (e *EtcdAuth) replace(cache *etcdAuthCache) {
+	e.mutex.Lock()
+	e.cache = cache
+	e.mutex.Unlock()
+}
+
+// Apply a key changed at index to the copy, removed keys are deleted
+// from it. Changes older than the one the copy has are ignored.
+func (e *EtcdAuth) applyNode(cache *etcdAuthCache, node *client.Node, removed bool, index uint64) {
+	if index <= cache.indexes[node.Key] {
+		return
+	}
+	cache.indexes[node.Key] = index
+	rel := strings.TrimPrefix(node.Key, e.prefix+"/")
+	parts := strings.SplitN(rel, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return
+	}
+	id := parts[1]
+	var err error
+	switch parts[0] {
+	case "users":
+		if removed {
+			delete(cache.users, id)
+			return
+		}
+		var user auth.User
+		if err = json.Unmarshal([]byte(node.Value), &user); err == nil {
+			user.Id = id
+			cache.users[id] = user
+		}
+	case "roles":
+		if removed {
+			delete(cache.roles, id)
+			return
+		}
+		var role auth.Role
+		if err = json.Unmarshal([]byte(node.Value), &role); err == nil {
+			role.Id = id
+			cache.roles[id] = role
+		}
+	case "apikeys":
+		if removed {
+			delete(cache.apiKeys, id)
+			return
+		}
+		var key auth.APIKey
+		if err = json.Unmarshal([]byte(node.Value), &key); err == nil {
+			key.Id = id
+			cache.apiKeys[id] = key
+		}
+	}
 	if err != nil {
-		log.Warning.Printf("Could not load key value: %s", key)
-		return nil
+		log.Error.Printf("Failed to parse %s: %v", node.Key, err)
 	}
-	// Return the first value if it's a list
-	if result.Node.Nodes != nil && len(result.Node.Nodes) > 1 {
-		nodes := result.Node.Nodes
-		for _, node := range nodes {
-			var output map[string]interface{}
-			if err = json.Unmarshal([]byte(node.Value), &output); err != nil {
-				log.Error.Printf("Failed to parse file %s: %v", node.Value, err)
-				return nil
+}
+
+// Follow changes made on any node. When the watch fails, for example
+// because etcd compacted the index we were at, everything is read
+// again before watching resumes.
+func (e *EtcdAuth) watch(index uint64) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	go func() {
+		<-e.stop
+		cancelFunc()
+	}()
+	for {
+		watcher := e.kapi.Watcher(e.prefix, &client.WatcherOptions{AfterIndex: index, Recursive: true})
+		for {
+			resp, err := watcher.Next(ctx)
+			if err != nil {
+				break
+			}
+			index = resp.Index
+			removed := resp.Action == "delete" || resp.Action == "expire" || resp.Action == "compareAndDelete"
+			node := resp.Node
+			if removed && resp.PrevNode != nil {
+				node = resp.PrevNode
+			}
+			if node == nil {
+				continue
+			}
+			changed := resp.Index
+			if resp.Node != nil {
+				changed = resp.Node.ModifiedIndex
 			}
-			return output
+			e.mutex.Lock()
+			e.applyNode(e.cache, node, removed, changed)
+			e.mutex.Unlock()
+			log.Trace.Printf("Applied %s of %s", resp.Action, node.Key)
 		}
-	} else {
-		var output map[string]interface{}
-		if err = json.Unmarshal([]byte(result.Node.Value), &output); err != nil {
-			log.Error.Printf("Failed to parse file %s: %v", result.Node.Value, err)
-			return nil
+
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(EtcdAuthRewatchDelay):
+		}
+		log.Warning.Printf("Watching %s failed, reading users and roles again", e.prefix)
+		if reloaded, err := e.load(); err != nil {
+			log.Error.Printf("Failed to read users from etcd: %v", err)
+		} else {
+			index = reloaded
 		}
-		return output
 	}
-	return nil
 }
 
-func (e *EtcdAuth) GetString(key string) string {
-	result, err := e.kapi.Get(context.Background(), key, nil)
+// Read a value with quorum, notFound is returned when it is missing
+func (e *EtcdAuth) readRaw(key string, notFound error) (string, uint64, error) {
+	result, err := e.kapi.Get(context.Background(), key, &client.GetOptions{Quorum: true})
+	if client.IsKeyNotFound(err) {
+		return "", 0, notFound
+	} else if err != nil {
+		log.Error.Printf("Failed to read %s: %v", key, err)
+		return "", 0, err
+	}
+	return result.Node.Value, result.Node.ModifiedIndex, nil
+}
+
+func (e *EtcdAuth) read(key string, value interface{}, notFound error) (uint64, error) {
+	data, index, err := e.readRaw(key, notFound)
 	if err != nil {
-		log.Warning.Printf("Could not load key value: %s", key)
-		return ""
+		return 0, err
+	}
+	if err := json.Unmarshal([]byte(data), value); err != nil {
+		log.Error.Printf("Failed to parse %s: %v", key, err)
+		return 0, err
 	}
-	// Return the first value if it's a list
-	if result.Node.Nodes != nil && len(result.Node.Nodes) > 1 {
-		nodes := result.Node.Nodes
-		for _, node := range nodes {
-			return node.Value
+	return index, nil
+}
+
+// Read a value, let update build the new one and write it back unless
+// the key was modified in between, in which case everything is tried
+// again. Returns the index the value was written at.
+func (e *EtcdAuth) compareAndSwap(key string, notFound error, update func(data []byte) (interface{}, error)) (uint64, error) {
+	for attempt := 0; attempt < etcdAuthRetries; attempt++ {
+		current, index, err := e.readRaw(key, notFound)
+		if err != nil {
+			return 0, err
+		}
+		value, err := update([]byte(current))
+		if err != nil {
+			return 0, err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return 0, err
 		}
-	} else {
-		return result.Node.Value
+		resp, err := e.kapi.Set(context.Background(), key, string(data), &client.SetOptions{PrevIndex: index})
+		if etcdErrorCode(err) == client.ErrorCodeTestFailed {
+			log.Trace.Printf("%s changed while it was updated, retrying", key)
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		return resp.Node.ModifiedIndex, nil
 	}
-	return ""
+	return 0, auth.ErrUserChanged
 }
 
-func (e *EtcdAuth) GetValues(key string) map[string]interface{} {
-	result, err := e.kapi.Get(context.Background(), key, nil)
+// Write a value that must not exist yet, returns the index it was
+// written at
+func (e *EtcdAuth) create(key string, value interface{}, exists error) (uint64, error) {
+	data, err := json.Marshal(value)
 	if err != nil {
-		log.Warning.Printf("Could not load key value: %s", key)
-		return nil
+		return 0, err
 	}
-	nodes := result.Node.Nodes
-	var results = make(map[string]interface{})
-	for _, node := range nodes {
-		var output map[string]interface{}
-		if err = json.Unmarshal([]byte(node.Value), &output); err != nil {
-			log.Error.Printf("Failed to parse file %s: %v", node.Value, err)
+	resp, err := e.kapi.Set(context.Background(), key, string(data), &client.SetOptions{PrevExist: client.PrevNoExist})
+	if etcdErrorCode(err) == client.ErrorCodeNodeExist {
+		return 0, exists
+	} else if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+// Our own writes are visible right away unless the watch already
+// applied a newer change of the key, which is then left in place
+func (e *EtcdAuth) cacheWrite(key string, index uint64, apply func(cache *etcdAuthCache)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if index <= e.cache.indexes[key] {
+		return
+	}
+	e.cache.indexes[key] = index
+	apply(e.cache)
+}
+
+func (e *EtcdAuth) GetUsers() ([]auth.User, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	users := make([]auth.User, 0, len(e.cache.users))
+	for _, user := range e.cache.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+// Users missing from the copy are read from etcd so a user created on
+// another node can log in before the watch delivers it
+func (e *EtcdAuth) GetUser(id string) (auth.User, error) {
+	if !auth.ValidUserId(id) {
+		return auth.User{}, auth.ErrUserNotFound
+	}
+	e.mutex.RLock()
+	user, ok := e.cache.users[id]
+	e.mutex.RUnlock()
+	if ok {
+		return user, nil
+	}
+	if _, err := e.read(e.userKey(id), &user, auth.ErrUserNotFound); err != nil {
+		return auth.User{}, err
+	}
+	user.Id = id
+	return user, nil
+}
+
+func (e *EtcdAuth) Authenticate(authParams map[string]string) (auth.User, error) {
+	user, err := e.GetUser(authParams["username"])
+	if err != nil && err != auth.ErrUserNotFound {
+		return auth.User{}, err
+	}
+	return checkPassword(user, err == nil, authParams["password"])
+}
+
+func (e *EtcdAuth) CreateUser(user auth.User) (auth.User, error) {
+	index, err := e.create(e.userKey(user.Id), user, auth.ErrUserExists)
+	if err != nil {
+		return auth.User{}, err
+	}
+	e.cacheWrite(e.userKey(user.Id), index, func(cache *etcdAuthCache) {
+		cache.users[user.Id] = user
+	})
+	log.Info.Printf("Created user %s", user.Id)
+	return user, nil
+}
+
+func (e *EtcdAuth) UpdateUser(id string, update func(user *auth.User) error) (auth.User, error) {
+	var user auth.User
+	index, err := e.compareAndSwap(e.userKey(id), auth.ErrUserNotFound, func(data []byte) (interface{}, error) {
+		user = auth.User{}
+		if err := json.Unmarshal(data, &user); err != nil {
+			return nil, err
+		}
+		user.Id = id
+		if err := update(&user); err != nil {
+			return nil, err
+		}
+		user.Id = id
+		return user, nil
+	})
+	if err != nil {
+		return auth.User{}, err
+	}
+	e.cacheWrite(e.userKey(id), index, func(cache *etcdAuthCache) {
+		cache.users[id] = user
+	})
+	log.Info.Printf("Updated user %s", id)
+	return user, nil
+}
+
+func (e *EtcdAuth) DeleteUser(id string, check func(user auth.User) error) error {
+	for attempt := 0; attempt < etcdAuthRetries; attempt++ {
+		var user auth.User
+		index, err := e.read(e.userKey(id), &user, auth.ErrUserNotFound)
+		if err != nil {
+			return err
+		}
+		user.Id = id
+		if err := check(user); err != nil {
+			return err
+		}
+		resp, err := e.kapi.Delete(context.Background(), e.userKey(id), &client.DeleteOptions{PrevIndex: index})
+		if etcdErrorCode(err) == client.ErrorCodeTestFailed {
 			continue
+		} else if client.IsKeyNotFound(err) {
+			return auth.ErrUserNotFound
+		} else if err != nil {
+			return err
 		}
-		results[node.Key] = output
+		e.cacheWrite(e.userKey(id), resp.Node.ModifiedIndex, func(cache *etcdAuthCache) {
+			delete(cache.users, id)
+		})
+		log.Info.Printf("Deleted user %s", id)
+		return nil
+	}
+	return auth.ErrUserChanged
+}
+
+func (e *EtcdAuth) GetRoles() (auth.Roles, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	roles := make(auth.Roles, 0, len(e.cache.roles))
+	for _, role := range e.cache.roles {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Id < roles[j].Id })
+	return roles, nil
+}
+
+func (e *EtcdAuth) GetAPIKeys() ([]auth.APIKey, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	keys := make([]auth.APIKey, 0, len(e.cache.apiKeys))
+	for _, key := range e.cache.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// Keys are checked on every request made with one, revocations made
+// on other nodes arrive through the watch
+func (e *EtcdAuth) GetAPIKey(id string) (auth.APIKey, error) {
+	if !auth.ValidAPIKeyId(id) {
+		return auth.APIKey{}, auth.ErrAPIKeyNotFound
+	}
+	e.mutex.RLock()
+	key, ok := e.cache.apiKeys[id]
+	e.mutex.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if _, err := e.read(e.apiKeyKey(id), &key, auth.ErrAPIKeyNotFound); err != nil {
+		return auth.APIKey{}, err
+	}
+	key.Id = id
+	return key, nil
+}
+
+func (e *EtcdAuth) CreateAPIKey(key auth.APIKey) (auth.APIKey, error) {
+	index, err := e.create(e.apiKeyKey(key.Id), key, fmt.Errorf("API key %s already exists", key.Id))
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	e.cacheWrite(e.apiKeyKey(key.Id), index, func(cache *etcdAuthCache) {
+		cache.apiKeys[key.Id] = key
+	})
+	return key, nil
+}
+
+func (e *EtcdAuth) UpdateAPIKey(id string, update func(key *auth.APIKey) error) (auth.APIKey, error) {
+	if !auth.ValidAPIKeyId(id) {
+		return auth.APIKey{}, auth.ErrAPIKeyNotFound
+	}
+	var key auth.APIKey
+	index, err := e.compareAndSwap(e.apiKeyKey(id), auth.ErrAPIKeyNotFound, func(data []byte) (interface{}, error) {
+		key = auth.APIKey{}
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, err
+		}
+		key.Id = id
+		if err := update(&key); err != nil {
+			return nil, err
+		}
+		key.Id = id
+		return key, nil
+	})
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	e.cacheWrite(e.apiKeyKey(id), index, func(cache *etcdAuthCache) {
+		cache.apiKeys[id] = key
+	})
+	return key, nil
+}
+
+func etcdErrorCode(err error) int {
+	if cErr, ok := err.(client.Error); ok {
+		return cErr.Code
+	}
+	return 0
+}
+
+// The index etcd was at when it answered with an error
+func etcdErrorIndex(err error) uint64 {
+	if cErr, ok := err.(client.Error); ok {
+		return cErr.Index
 	}
-	return results
+	return 0
 }
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// Enough of etcd's keys API for the auth backend, watchers see every
+// change after the index they start at
+type fakeKeys struct {
+	client.KeysAPI
+	mutex  sync.Mutex
+	index  uint64
+	nodes  map[string]*client.Node
+	events []*client.Response
+}
+
+func newFakeKeys() *fakeKeys {
+	return &fakeKeys{nodes: make(map[string]*client.Node)}
+}
+
+func (f *fakeKeys) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if node, ok := f.nodes[key]; ok {
+		return &client.Response{Action: "get", Node: node, Index: f.index}, nil
+	}
+	dir := &client.Node{Key: key, Dir: true}
+	for k, node := range f.nodes {
+		if strings.HasPrefix(k, key+"/") {
+			dir.Nodes = append(dir.Nodes, node)
+		}
+	}
+	if len(dir.Nodes) == 0 {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Index: f.index}
+	}
+	return &client.Response{Action: "get", Node: dir, Index: f.index}, nil
+}
+
+func (f *fakeKeys) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	prev, exists := f.nodes[key]
+	if opts != nil && opts.PrevExist == client.PrevNoExist && exists {
+		return nil, client.Error{Code: client.ErrorCodeNodeExist, Index: f.index}
+	}
+	if opts != nil && opts.PrevIndex != 0 && (!exists || prev.ModifiedIndex != opts.PrevIndex) {
+		return nil, client.Error{Code: client.ErrorCodeTestFailed, Index: f.index}
+	}
+	f.index++
+	node := &client.Node{Key: key, Value: value, ModifiedIndex: f.index}
+	f.nodes[key] = node
+	resp := &client.Response{Action: "set", Node: node, PrevNode: prev, Index: f.index}
+	f.events = append(f.events, resp)
+	return resp, nil
+}
+
+func (f *fakeKeys) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	prev, exists := f.nodes[key]
+	if !exists {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Index: f.index}
+	}
+	if opts != nil && opts.PrevIndex != 0 && prev.ModifiedIndex != opts.PrevIndex {
+		return nil, client.Error{Code: client.ErrorCodeTestFailed, Index: f.index}
+	}
+	f.index++
+	delete(f.nodes, key)
+	resp := &client.Response{Action: "delete", Node: &client.Node{Key: key, ModifiedIndex: f.index}, PrevNode: prev, Index: f.index}
+	f.events = append(f.events, resp)
+	return resp, nil
+}
+
+func (f *fakeKeys) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return &fakeWatcher{keys: f, after: opts.AfterIndex}
+}
+
+type fakeWatcher struct {
+	keys  *fakeKeys
+	after uint64
+}
+
+func (w *fakeWatcher) Next(ctx context.Context) (*client.Response, error) {
+	for {
+		w.keys.mutex.Lock()
+		for _, resp := range w.keys.events {
+			if resp.Index > w.after {
+				w.after = resp.Index
+				w.keys.mutex.Unlock()
+				return resp, nil
+			}
+		}
+		w.keys.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond * 5):
+		}
+	}
+}
+
+func TestEtcdAuthUsers(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	keys := newFakeKeys()
+	keys.Set(context.Background(), "/deployd/auth/roles/viewer", `{"name": "Viewer", "permissions": [{"name": "Packages", "flags": ["READ"]}]}`, nil)
+
+	node1, node2 := &EtcdAuth{}, &EtcdAuth{}
+	assert.Nil(t, node1.start(keys, DefaultEtcdAuthPrefix))
+	defer node1.Close()
+	assert.Nil(t, node2.start(keys, DefaultEtcdAuthPrefix+"/"))
+	defer node2.Close()
+
+	roles, err := node1.GetRoles()
+	assert.Nil(t, err)
+	if assert.Len(t, roles, 1) {
+		assert.Equal(t, "viewer", roles[0].Id)
+	}
+
+	_, err = node1.CreateUser(auth.User{Id: "alice", Roles: []string{"operator"}})
+	assert.Nil(t, err)
+	_, err = node2.CreateUser(auth.User{Id: "alice"})
+	assert.Equal(t, auth.ErrUserExists, err)
+
+	// A user created on another node is found before the watch
+	// delivers it
+	user, err := node2.GetUser("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"operator"}, user.Roles)
+
+	_, err = node2.UpdateUser("alice", func(user *auth.User) error {
+		user.Roles = []string{"viewer"}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		user, err := node1.GetUser("alice")
+		return err == nil && len(user.Roles) == 1 && user.Roles[0] == "viewer"
+	}, time.Second, time.Millisecond*10)
+
+	// Updates made between reading and writing a user are retried
+	attempts := 0
+	_, err = node1.UpdateUser("alice", func(user *auth.User) error {
+		attempts++
+		if attempts == 1 {
+			keys.Set(context.Background(), "/deployd/auth/users/alice", `{"id": "alice", "name": "Alice"}`, nil)
+		}
+		user.Disabled = true
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	user, err = node1.GetUser("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "Alice", user.Name)
+	assert.True(t, user.Disabled)
+
+	assert.Nil(t, node1.DeleteUser("alice", func(auth.User) error { return nil }))
+	assert.Equal(t, auth.ErrUserNotFound, node1.DeleteUser("alice", func(auth.User) error { return nil }))
+	assert.Eventually(t, func() bool {
+		users, _ := node2.GetUsers()
+		return len(users) == 0
+	}, time.Second, time.Millisecond*10)
+	_, err = node2.GetUser("alice")
+	assert.Equal(t, auth.ErrUserNotFound, err)
+}
+
+// Runs after once a Set succeeded, before the caller sees the response
+type racingKeys struct {
+	*fakeKeys
+	after func()
+}
+
+func (r *racingKeys) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	resp, err := r.fakeKeys.Set(ctx, key, value, opts)
+	if err == nil && r.after != nil {
+		after := r.after
+		r.after = nil
+		after()
+	}
+	return resp, err
+}
+
+func TestEtcdAuthKeepsNewerWatchedChanges(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	keys := &racingKeys{fakeKeys: newFakeKeys()}
+	node := &EtcdAuth{}
+	assert.Nil(t, node.start(keys, DefaultEtcdAuthPrefix))
+	defer node.Close()
+	_, err := node.CreateUser(auth.User{Id: "alice"})
+	assert.Nil(t, err)
+
+	// Another node renames alice right after our update is written,
+	// and the watch applies that before our update returns
+	keys.after = func() {
+		keys.fakeKeys.Set(context.Background(), "/deployd/auth/users/alice", `{"id": "alice", "name": "Alice"}`, nil)
+		assert.Eventually(t, func() bool {
+			user, _ := node.GetUser("alice")
+			return user.Name == "Alice"
+		}, time.Second, time.Millisecond*10)
+	}
+	_, err = node.UpdateUser("alice", func(user *auth.User) error {
+		user.Disabled = true
+		return nil
+	})
+	assert.Nil(t, err)
+
+	user, err := node.GetUser("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "Alice", user.Name)
+	assert.False(t, user.Disabled)
+}
+
+func TestEtcdAuthAPIKeyIds(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	keys := newFakeKeys()
+	keys.Set(context.Background(), "/deployd/auth/users/admin", `{"id": "admin", "roles": ["administrator"]}`, nil)
+	node := &EtcdAuth{}
+	assert.Nil(t, node.start(keys, DefaultEtcdAuthPrefix))
+	defer node.Close()
+
+	// Ids from the Authorization header never reach other keys
+	_, err := node.GetAPIKey("../users/admin")
+	assert.Equal(t, auth.ErrAPIKeyNotFound, err)
+	_, err = node.UpdateAPIKey("../users/admin", func(*auth.APIKey) error { return nil })
+	assert.Equal(t, auth.ErrAPIKeyNotFound, err)
+
+	created, err := node.CreateAPIKey(auth.APIKey{Id: "0b6c0e8e-4d6f-4a4e-9d3c-2f1a6b7c8d9e", Owner: "admin"})
+	assert.Nil(t, err)
+	key, err := node.GetAPIKey(created.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "admin", key.Owner)
+}
@@ -0,0 +1,429 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const DefaultOIDCGroupsClaim = "groups"
+const DefaultOIDCUsernameClaim = "preferred_username"
+const DefaultJWKSRefresh = time.Hour
+
+// A token naming a key we don't know makes us fetch the keys again,
+// but not more often than this
+var JWKSMinRefresh = time.Minute
+
+var JWKSFetchTimeout = time.Second * 10
+
+var ErrUnknownSigningKey = errors.New("Token is signed by an unknown key")
+
+// Accepts bearer tokens issued by an OIDC provider. They are verified
+// against the provider's JWKS, read from jwks-url or jwks-file, which
+// is cached and read again every jwks-refresh and whenever a token
+// names an unknown key. Groups in the groups-claim are mapped to roles
+// by group-roles. Password logins are not supported.
+type OIDCAuth struct {
+	issuer        string
+	audiences     []string
+	jwksURL       string
+	jwksFile      string
+	refresh       time.Duration
+	groupsClaim   string
+	usernameClaim string
+	groupRoles    map[string][]string
+	client        *http.Client
+	mutex         *sync.Mutex
+	keys          map[string]jwk
+	fetchedAt     time.Time
+}
+
+// A verification key of the JWKS
+type jwk struct {
+	key interface{}
+	alg string
+}
+
+func init() {
+	auth.RegisterBackend("oidc", func(config map[string]interface{}) (auth.AuthenticationBackend, error) {
+		oidcAuth := &OIDCAuth{}
+		if err := oidcAuth.Init(config); err != nil {
+			return nil, err
+		}
+		return oidcAuth, nil
+	})
+}
+
+func (o *OIDCAuth) Init(config map[string]interface{}) error {
+	o.issuer = auth.ConfigString(config, "oidc-issuer", "")
+	o.jwksURL = auth.ConfigString(config, "jwks-url", "")
+	o.jwksFile = auth.ConfigString(config, "jwks-file", "")
+	o.groupsClaim = auth.ConfigString(config, "groups-claim", DefaultOIDCGroupsClaim)
+	o.usernameClaim = auth.ConfigString(config, "username-claim", DefaultOIDCUsernameClaim)
+	o.refresh = DefaultJWKSRefresh
+	o.client = &http.Client{Timeout: JWKSFetchTimeout}
+	o.mutex = &sync.Mutex{}
+	o.keys = make(map[string]jwk)
+
+	if o.issuer == "" {
+		return errors.New("The oidc backend needs an oidc-issuer")
+	}
+	if (o.jwksURL == "") == (o.jwksFile == "") {
+		return errors.New("The oidc backend needs either a jwks-url or a jwks-file")
+	}
+	switch audience := config["audience"].(type) {
+	case string:
+		o.audiences = []string{audience}
+	case []interface{}:
+		for _, value := range audience {
+			if value, ok := value.(string); ok && value != "" {
+				o.audiences = append(o.audiences, value)
+			}
+		}
+	}
+	if len(o.audiences) == 0 || o.audiences[0] == "" {
+		return errors.New("The oidc backend needs an audience")
+	}
+	if refresh := auth.ConfigString(config, "jwks-refresh", ""); refresh != "" {
+		var err error
+		if o.refresh, err = time.ParseDuration(refresh); err != nil {
+			return fmt.Errorf("Invalid jwks-refresh %s: %v", refresh, err)
+		}
+	}
+	if groupRoles, ok := config["group-roles"]; ok {
+		data, err := json.Marshal(groupRoles)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &o.groupRoles); err != nil {
+			return fmt.Errorf("Invalid group-roles: %v", err)
+		}
+	}
+
+	// An unreachable provider shouldn't keep deployd from starting,
+	// the keys are fetched again on the first token
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err := o.loadKeys(); err != nil {
+		if o.jwksFile != "" {
+			return err
+		}
+		log.Warning.Printf("Failed to fetch the JWKS of %s: %v", o.issuer, err)
+	}
+	return nil
+}
+
+func (o *OIDCAuth) Authenticate(authParams map[string]string) (auth.User, error) {
+	return auth.User{}, auth.ErrInvalidCredentials
+}
+
+// Users only exist at the provider
+func (o *OIDCAuth) GetUser(id string) (auth.User, error) {
+	return auth.User{}, auth.ErrUserNotFound
+}
+
+// Verify a token of the provider: its signature, issuer, audience and
+// expiry
+func (o *OIDCAuth) VerifyToken(tokenString string) (auth.Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := o.key(kid)
+		if err != nil {
+			return nil, err
+		}
+		// The key decides how the token is verified, never the token
+		if !key.allows(token.Method.Alg()) {
+			return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+		}
+		return key.key, nil
+	})
+	if err != nil {
+		log.Trace.Printf("Rejected OIDC token: %v", err)
+		return auth.Identity{}, auth.ErrInvalidToken
+	}
+	if _, ok := claims["exp"]; !ok || !claims.VerifyIssuer(o.issuer, true) || !o.audienceAllowed(claims["aud"]) {
+		log.Trace.Printf("Rejected OIDC token with issuer %v and audience %v", claims["iss"], claims["aud"])
+		return auth.Identity{}, auth.ErrInvalidToken
+	}
+
+	identity := auth.Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.TokenId, _ = claims["jti"].(string)
+	if identity.Name, _ = claims[o.usernameClaim].(string); identity.Name == "" {
+		identity.Name, _ = claims["email"].(string)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		expires := time.Unix(int64(exp), 0).UTC()
+		identity.ExpiresAt = &expires
+	}
+	identity.Roles = o.roles(claims[o.groupsClaim])
+	if identity.Subject == "" {
+		return auth.Identity{}, auth.ErrInvalidToken
+	}
+	return identity, nil
+}
+
+// The aud claim is a string or a list, one of its values has to be
+// one of ours
+func (o *OIDCAuth) audienceAllowed(claim interface{}) bool {
+	var audiences []string
+	switch claim := claim.(type) {
+	case string:
+		audiences = []string{claim}
+	case []interface{}:
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				audiences = append(audiences, value)
+			}
+		}
+	}
+	for _, audience := range audiences {
+		for _, allowed := range o.audiences {
+			if audience == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The roles the groups of a token map to, groups claims are a list or
+// a single string
+func (o *OIDCAuth) roles(claim interface{}) []string {
+	var groups []string
+	switch claim := claim.(type) {
+	case string:
+		groups = []string{claim}
+	case []interface{}:
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				groups = append(groups, value)
+			}
+		}
+	}
+	roles := []string{}
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, role := range o.groupRoles[group] {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// The key with the id, the JWKS is read again when it is stale or
+// doesn't have the key
+func (o *OIDCAuth) key(kid string) (jwk, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	since := time.Since(o.fetchedAt)
+	key, ok := o.find(kid)
+	if (!ok && since >= JWKSMinRefresh) || since >= o.refresh {
+		if err := o.loadKeys(); err != nil {
+			log.Error.Printf("Failed to read the JWKS of %s: %v", o.issuer, err)
+		}
+		key, ok = o.find(kid)
+	}
+	if !ok {
+		return jwk{}, ErrUnknownSigningKey
+	}
+	return key, nil
+}
+
+// Tokens without a key id can only be verified when there is one key
+func (o *OIDCAuth) find(kid string) (jwk, bool) {
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, true
+		}
+	}
+	key, ok := o.keys[kid]
+	return key, ok
+}
+
+// Replace the cached keys with the current JWKS, the old keys are kept
+// when it can't be read
+func (o *OIDCAuth) loadKeys() error {
+	// Failed reads count too, so a provider that is down isn't asked
+	// on every request
+	o.fetchedAt = time.Now()
+	data, err := o.readJWKS()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	o.keys = keys
+	log.Trace.Printf("Read %d keys of %s", len(keys), o.issuer)
+	return nil
+}
+
+func (o *OIDCAuth) readJWKS() ([]byte, error) {
+	if o.jwksFile != "" {
+		return ioutil.ReadFile(o.jwksFile)
+	}
+	resp, err := o.client.Get(o.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", o.jwksURL, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// The signing keys of a JWKS by key id, keys of other types or uses
+// are skipped
+func parseJWKS(data []byte) (map[string]jwk, error) {
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("Invalid JWKS: %v", err)
+	}
+	keys := make(map[string]jwk)
+	for _, value := range set.Keys {
+		kid, _ := value["kid"].(string)
+		if use, _ := value["use"].(string); use != "" && use != "sig" {
+			continue
+		}
+		key, err := parseJWK(value)
+		if err != nil {
+			log.Warning.Printf("Skipping JWKS key %s: %v", kid, err)
+			continue
+		}
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("Invalid JWKS: no usable signing keys")
+	}
+	return keys, nil
+}
+
+func parseJWK(value map[string]interface{}) (jwk, error) {
+	alg, _ := value["alg"].(string)
+	field := func(name string) ([]byte, error) {
+		encoded, _ := value[name].(string)
+		if encoded == "" {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	}
+	kty, _ := value["kty"].(string)
+	switch kty {
+	case "RSA":
+		n, err := field("n")
+		if err != nil {
+			return jwk{}, err
+		}
+		e, err := field("e")
+		if err != nil {
+			return jwk{}, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return jwk{}, errors.New("invalid exponent")
+		}
+		return jwk{key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, alg: alg}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch crv, _ := value["crv"].(string); crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return jwk{}, fmt.Errorf("unsupported curve %s", crv)
+		}
+		x, err := field("x")
+		if err != nil {
+			return jwk{}, err
+		}
+		y, err := field("y")
+		if err != nil {
+			return jwk{}, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return jwk{}, errors.New("point is not on the curve")
+		}
+		return jwk{key: key, alg: alg}, nil
+	case "OKP":
+		if crv, _ := value["crv"].(string); crv != "Ed25519" {
+			return jwk{}, fmt.Errorf("unsupported curve %s", crv)
+		}
+		x, err := field("x")
+		if err != nil {
+			return jwk{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return jwk{}, errors.New("invalid Ed25519 key")
+		}
+		return jwk{key: ed25519.PublicKey(x), alg: alg}, nil
+	}
+	return jwk{}, fmt.Errorf("unsupported key type %s", kty)
+}
+
+// Whether a token signed with alg may be verified with the key, the
+// key's own alg is used when the JWKS names one
+func (k jwk) allows(alg string) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	switch k.key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" || alg == "RS384" || alg == "RS512" || alg == "PS256" || alg == "PS384" || alg == "PS512"
+	case *ecdsa.PublicKey:
+		return alg == "ES256" || alg == "ES384" || alg == "ES512"
+	case ed25519.PublicKey:
+		return alg == auth.SigningMethodEdDSA.Alg()
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func signOIDC(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return signed
+}
+
+func TestOIDCAuthIssuer(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	defer func(delay time.Duration) { JWKSMinRefresh = delay }(JWKSMinRefresh)
+	JWKSMinRefresh = 0
+
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	var mutex sync.Mutex
+	served := []interface{}{rsaJWK("first", first)}
+	fetches := 0
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": served})
+	}))
+	defer issuer.Close()
+
+	a, err := auth.AuthFromConfig(map[string]interface{}{
+		"type":        "oidc",
+		"secret":      "0123456789abcdef0123456789abcdef",
+		"oidc-issuer": issuer.URL,
+		"jwks-url":    issuer.URL + "/keys",
+		"audience":    []interface{}{"deployd"},
+		"group-roles": map[string]interface{}{
+			"ops":    []interface{}{"operator"},
+			"admins": []interface{}{"administrator", "operator"},
+		},
+	})
+	assert.Nil(t, err)
+	claims := func(changes map[string]interface{}) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":                issuer.URL,
+			"sub":                "00u1",
+			"aud":                []interface{}{"other", "deployd"},
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"jti":                "oidc-1",
+			"preferred_username": "alice",
+			"groups":             []interface{}{"admins", "ops", "staff"},
+		}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	identity, err := a.ParseToken(signOIDC(t, jwt.SigningMethodRS256, "first", first, claims(nil)))
+	assert.Nil(t, err)
+	assert.Equal(t, "00u1", identity.Subject)
+	assert.Equal(t, "alice", identity.Name)
+	assert.Equal(t, []string{"administrator", "operator"}, identity.Roles)
+	// Verified keys are cached
+	assert.Equal(t, 1, fetches)
+
+	for name, token := range map[string]string{
+		"audience": signOIDC(t, jwt.SigningMethodRS256, "first", first, claims(map[string]interface{}{"aud": "other"})),
+		"issuer":   signOIDC(t, jwt.SigningMethodRS256, "first", first, claims(map[string]interface{}{"iss": "https://evil.example.org"})),
+		"expired":  signOIDC(t, jwt.SigningMethodRS256, "first", first, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})),
+		"key":      signOIDC(t, jwt.SigningMethodRS256, "first", second, claims(nil)),
+		"hmac":     signOIDC(t, jwt.SigningMethodHS256, "first", []byte("0123456789abcdef0123456789abcdef"), claims(nil)),
+	} {
+		_, err := a.ParseToken(token)
+		assert.Equal(t, auth.ErrInvalidToken, err, name)
+	}
+
+	// The provider rotates its keys, an unknown key id reads them again
+	mutex.Lock()
+	served = []interface{}{rsaJWK("second", second)}
+	mutex.Unlock()
+	identity, err = a.ParseToken(signOIDC(t, jwt.SigningMethodRS256, "second", second, claims(map[string]interface{}{"groups": "ops"})))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"operator"}, identity.Roles)
+	_, err = a.ParseToken(signOIDC(t, jwt.SigningMethodRS256, "first", first, claims(nil)))
+	assert.Equal(t, auth.ErrInvalidToken, err)
+
+	// Provider tokens can be revoked like our own
+	assert.Nil(t, a.Logout(identity, ""))
+	_, err = a.ParseToken(signOIDC(t, jwt.SigningMethodRS256, "second", second, claims(nil)))
+	assert.Equal(t, auth.ErrInvalidToken, err)
+}
+
+func TestOIDCAuthFile(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-oidc")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []interface{}{
+		map[string]interface{}{"kty": "EC", "crv": "P-256", "kid": "ec",
+			"x": base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			"y": base64.RawURLEncoding.EncodeToString(key.Y.Bytes())},
+		map[string]interface{}{"kty": "RSA", "kid": "encryption", "use": "enc"},
+	}})
+	assert.Nil(t, err)
+	file := filepath.Join(dir, "jwks.json")
+	assert.Nil(t, ioutil.WriteFile(file, jwks, 0600))
+
+	o := &OIDCAuth{}
+	assert.NotNil(t, o.Init(map[string]interface{}{"oidc-issuer": "https://sso.example.org", "jwks-file": file}))
+	assert.NotNil(t, o.Init(map[string]interface{}{"oidc-issuer": "https://sso.example.org", "audience": "deployd", "jwks-file": filepath.Join(dir, "missing.json")}))
+	assert.Nil(t, o.Init(map[string]interface{}{"oidc-issuer": "https://sso.example.org", "audience": "deployd", "jwks-file": file, "groups-claim": "roles"}))
+
+	identity, err := o.VerifyToken(signOIDC(t, jwt.SigningMethodES256, "ec", key, jwt.MapClaims{
+		"iss":   "https://sso.example.org",
+		"sub":   "svc-build",
+		"aud":   "deployd",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"email": "build@example.org",
+		"roles": []interface{}{"unmapped"},
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, "svc-build", identity.Subject)
+	assert.Equal(t, "build@example.org", identity.Name)
+	assert.Equal(t, []string{}, identity.Roles)
+
+	// exp is required
+	_, err = o.VerifyToken(signOIDC(t, jwt.SigningMethodES256, "ec", key, jwt.MapClaims{"iss": "https://sso.example.org", "sub": "svc-build", "aud": "deployd"}))
+	assert.Equal(t, auth.ErrInvalidToken, err)
+}
@@ -24,6 +24,8 @@ package cluster
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"sort"
 	"strconv"
 	"strings"
@@ -50,6 +52,16 @@ type EtcdBackend struct {
 	nodeListeners   map[string]chan *cluster.Machine
 	Status          chan string
 	Signal          chan int
+	health          etcdHealth
+	revocations     etcdRevocations
+}
+
+// Last known state of the backend, reported by the health checks
+type etcdHealth struct {
+	mutex           sync.Mutex
+	status          string
+	keepAliveActive bool
+	lastKeepAlive   time.Time
 }
 
 type EtcdBackendConfig struct {
@@ -61,6 +73,9 @@ type EtcdBackendConfig struct {
 	FailoverUnit        time.Duration
 	Prefix              string `json:"node-prefix"`
 	RecoveryParticipant bool   `json:"recovery-participant"`
+	// Shared by every machine, not scoped to the node prefix
+	PackagePrefix    string `json:"package-prefix"`
+	RevocationPrefix string `json:"revocation-prefix"`
 }
 
 func (e *EtcdBackend) Init(clstr *cluster.Cluster, m *cluster.Machine) {
@@ -91,6 +106,7 @@ func (e *EtcdBackend) Init(clstr *cluster.Cluster, m *cluster.Machine) {
 	// of the application? What happens if the etcd
 	// instance we are connecting dies?
 	e.kapi = client.NewKeysAPI(e.etcdClient)
+	e.watchRevocations()
 
 	// Is quorum necessary to ensure a correct count?
 	options := client.GetOptions{Quorum: true}
@@ -127,7 +143,7 @@ func (e *EtcdBackend) Init(clstr *cluster.Cluster, m *cluster.Machine) {
 	e.loadMachines()
 	e.keepAlive(e.backendConfig.MachinePrefix+"/status/"+e.machine.Id, e.machineConfig)
 	e.monitor()
-	e.Status <- "Started"
+	e.setStatus("Started")
 }
 
 func (e *EtcdBackend) GetValue(key string) map[string]interface{} {
@@ -216,7 +232,9 @@ func (e *EtcdBackend) loadMachines() {
 // Should this key expire another node should catch it in the monitor
 // and start the recovery process
 func (e *EtcdBackend) keepAlive(key string, value string) {
+	e.setKeepAlive(true, false)
 	go func() {
+		defer e.setKeepAlive(false, false)
 		retries := 10
 		options := client.SetOptions{TTL: (time.Second * time.Duration(e.backendConfig.TTL)), PrevExist: client.PrevExist}
 		for {
@@ -231,16 +249,19 @@ func (e *EtcdBackend) keepAlive(key string, value string) {
 				case sig := <-e.Signal:
 					e.Signal <- sig
 					log.Trace.Printf("Recieved shutdown: aborting keepalive")
-					e.Status <- "Not Recovering"
+					e.setStatus("Not Recovering")
 					return
 				case <-time.After(2 * time.Second):
 				}
 				retries -= 1
 				if retries == 0 {
+					log.Error.Printf("Giving up on keepalive for %s", key)
+					e.setStatus("Keepalive Failed")
 					return
 				}
 			} else {
 				retries = 10
+				e.setKeepAlive(true, true)
 				// Give ourselves atleast 15 seconds (in properly configured)
 				// environments to reset the ttl before it expires
 				var duration time.Duration
@@ -253,10 +274,13 @@ func (e *EtcdBackend) keepAlive(key string, value string) {
 				select {
 				case sig := <-e.Signal:
 					e.Signal <- sig
-					options = client.SetOptions{TTL: (time.Second * 1), PrevExist: client.PrevExist}
-					e.kapi.Set(context.Background(), key, value, &options)
+					// A machine leaving on purpose has already removed its key
+					if !e.machine.Leaving {
+						options = client.SetOptions{TTL: (time.Second * 1), PrevExist: client.PrevExist}
+						e.kapi.Set(context.Background(), key, value, &options)
+					}
 					log.Trace.Printf("Recieved shutdown: aborting keepalive")
-					e.Status <- "Not Recovering"
+					e.setStatus("Not Recovering")
 					return
 				case <-time.After(duration * time.Second):
 				}
@@ -265,6 +289,55 @@ func (e *EtcdBackend) keepAlive(key string, value string) {
 	}()
 }
 
+// Record the status for the health checks before publishing it, a
+// status nobody reads is dropped once the channel is full
+func (e *EtcdBackend) setStatus(status string) {
+	e.health.mutex.Lock()
+	e.health.status = status
+	e.health.mutex.Unlock()
+	select {
+	case e.Status <- status:
+	default:
+	}
+}
+
+func (e *EtcdBackend) setKeepAlive(active bool, renewed bool) {
+	e.health.mutex.Lock()
+	defer e.health.mutex.Unlock()
+	e.health.keepAliveActive = active
+	if renewed {
+		e.health.lastKeepAlive = time.Now()
+	}
+}
+
+// Check that etcd can be reached and still holds our machine key
+func (e *EtcdBackend) Ping() error {
+	if e.kapi == nil {
+		return errors.New("etcd client is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := e.kapi.Get(ctx, e.backendConfig.MachinePrefix+"/status/"+e.machine.Id, nil)
+	return err
+}
+
+// Reports whether the keepalive loop is still running, and an error
+// when our machine key hasn't been renewed within its ttl
+func (e *EtcdBackend) KeepAliveHealth() (bool, string, error) {
+	e.health.mutex.Lock()
+	defer e.health.mutex.Unlock()
+	if e.health.lastKeepAlive.IsZero() {
+		return e.health.keepAliveActive, e.health.status, errors.New("machine key has not been set")
+	}
+	if age := time.Since(e.health.lastKeepAlive); age > time.Duration(e.backendConfig.TTL)*time.Second {
+		return e.health.keepAliveActive, e.health.status, fmt.Errorf("machine key last renewed %v ago", age)
+	}
+	if !e.health.keepAliveActive {
+		return false, e.health.status, errors.New("keepalive has stopped")
+	}
+	return true, e.health.status, nil
+}
+
 // Callback for storing a deployment information to etcd
 func (e *EtcdBackend) DeploymentComplete(d *deployment.Deployment) {
 	go func() {
@@ -336,7 +409,7 @@ func (e *EtcdBackend) monitor() {
 			if err != nil {
 				handleEtcdError(err, "watch")
 				log.Trace.Printf("Recieved shutdown: aborting monitor")
-				e.Status <- "Not Recovering"
+				e.setStatus("Not Recovering")
 				return
 			} else {
 				//log.Trace.Printf("Watch completed %v", resp)
@@ -351,6 +424,8 @@ func (e *EtcdBackend) monitor() {
 					// we want to cancel the recovery wait period
 					go e.handleRecovery(resp.Node)
 					go e.handleNewNode(resp.Node)
+				case "delete":
+					go e.handleLeave(resp.PrevNode)
 				}
 			}
 		}
@@ -380,7 +455,7 @@ func (e *EtcdBackend) Watch(key string, callback func(string)) {
 			if err != nil {
 				handleEtcdError(err, "watch")
 				log.Trace.Printf("Recieved shutdown: aborting monitor")
-				e.Status <- "Not Recovering"
+				e.setStatus("Not Recovering")
 				return
 			} else {
 				log.Trace.Printf("Watch completed %v", resp)
@@ -392,6 +467,73 @@ func (e *EtcdBackend) Watch(key string, callback func(string)) {
 	}()
 }
 
+// Leave the cluster on purpose. The machine key is first rewritten
+// with the machine marked as leaving so peers don't treat its removal
+// as a failure, then removed and the background jobs are stopped.
+func (e *EtcdBackend) Deregister() {
+	if e.kapi == nil {
+		return
+	}
+	key := e.backendConfig.MachinePrefix + "/status/" + e.machine.Id
+	e.machine.Leaving = true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setOptions := client.SetOptions{TTL: (time.Second * time.Duration(e.backendConfig.TTL)), PrevExist: client.PrevExist}
+	if _, err := e.kapi.Set(ctx, key, e.machine.Serialize(), &setOptions); err != nil {
+		handleEtcdError(err, "machine")
+	}
+	if _, err := e.kapi.Delete(ctx, key, nil); err != nil {
+		handleEtcdError(err, "machine")
+	} else {
+		log.Info.Printf("Left the cluster as %s", e.machine.Id)
+	}
+	e.Signal <- 1
+}
+
+// Package definitions are only shared when a package prefix is configured
+func (e *EtcdBackend) SharesPackages() bool {
+	return e.backendConfig.PackagePrefix != ""
+}
+
+func (e *EtcdBackend) PackageDefinitions() map[string]string {
+	return e.getTree(e.backendConfig.PackagePrefix + "/definitions")
+}
+
+func (e *EtcdBackend) PackageTemplates() map[string]string {
+	return e.getTree(e.backendConfig.PackagePrefix + "/templates")
+}
+
+func (e *EtcdBackend) WatchPackages(callback func()) {
+	e.Watch(e.backendConfig.PackagePrefix, func(string) {
+		callback()
+	})
+}
+
+// Every value below key, keyed by the path relative to key
+func (e *EtcdBackend) getTree(key string) map[string]string {
+	values := make(map[string]string)
+	options := client.GetOptions{Recursive: true, Quorum: true}
+	result, err := e.kapi.Get(context.Background(), key, &options)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			handleEtcdError(err, key)
+		}
+		return values
+	}
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if !node.Dir {
+			values[strings.TrimPrefix(node.Key, key+"/")] = node.Value
+			return
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(result.Node)
+	return values
+}
+
 // Updates the channel blocking for recovery
 func (e *EtcdBackend) handleRecovery(node *client.Node) {
 	m := cluster.DeserializeMachine(node.Value)
@@ -401,9 +543,29 @@ func (e *EtcdBackend) handleRecovery(node *client.Node) {
 	}
 }
 
+// A machine removed its own key while shutting down
+func (e *EtcdBackend) handleLeave(node *client.Node) {
+	if node == nil {
+		return
+	}
+	m := cluster.DeserializeMachine(node.Value)
+	if m == nil || m.Id == e.machine.Id {
+		return
+	}
+	log.Info.Printf("Machine %s left the cluster", m.Id)
+	e.cluster.RemoveMachine(m)
+}
+
 func (e *EtcdBackend) handleFailure(node *client.Node) {
-	e.Status <- "Waiting to recover"
 	m := cluster.DeserializeMachine(node.Value)
+	if m != nil && m.Leaving {
+		// The machine's key expired before it could remove it, but it
+		// shut down on purpose so there is nothing to recover
+		log.Info.Printf("Machine %s left the cluster", m.Id)
+		e.cluster.RemoveMachine(m)
+		return
+	}
+	e.setStatus("Waiting to recover")
 	if m.Id == e.machine.Id {
 		log.Error.Printf("Our key expired but we are still alive! %s", m.Id)
 		return
@@ -423,13 +585,13 @@ func (e *EtcdBackend) handleFailure(node *client.Node) {
 	case <-listener:
 		// The machine appears to have recovered, which is great news
 		// for us because we don't have to do any work
-		e.Status <- "Not Recovering"
+		e.setStatus("Not Recovering")
 		delete(e.nodeListeners, m.Id)
 		return
 	case sig := <-e.Signal:
 		e.Signal <- sig
 		log.Trace.Printf("Recieved shutdown: aborting recovery")
-		e.Status <- "Not Recovering"
+		e.setStatus("Not Recovering")
 		return
 	case <-time.After(e.backendConfig.FailoverUnit * time.Duration(e.backendConfig.FailoverTimeout)):
 		// The machine has expired, so we will start the recovery
@@ -455,7 +617,7 @@ func (e *EtcdBackend) AttemptRecovery(m *cluster.Machine) {
 	// where the node goes down and immediately comes back up
 	// but our blocking channel hasn't been setup yet so
 	// we miss the notification
-	e.Status <- "Attempting Recovery"
+	e.setStatus("Attempting Recovery")
 	log.Info.Printf("Starting recovery for node: %s", m.Id)
 	options := client.GetOptions{Quorum: true}
 	_, err := e.kapi.Get(context.Background(), e.backendConfig.MachinePrefix+"/status/"+m.Id, &options)
@@ -473,10 +635,10 @@ func (e *EtcdBackend) AttemptRecovery(m *cluster.Machine) {
 		// TODO remove the machine from our list
 		log.Info.Printf("Could not obtain recovery lock for %s", m.Id)
 		delete(e.nodeListeners, m.Id)
-		e.Status <- "Not Recovering"
+		e.setStatus("Not Recovering")
 		return
 	}
-	e.Status <- "Recovering"
+	e.setStatus("Recovering")
 	log.Info.Printf("Performing recovery of %s", m.Id)
 
 	// TODO what happens if we get the lock and then crash or get shutdown before recovery has completed?
@@ -510,6 +672,10 @@ func (e *EtcdBackend) AttemptRecovery(m *cluster.Machine) {
 		cache := make(map[string]*cluster.Machine)
 		i := 0
 		for {
+			if i >= len(nodes.Nodes) {
+				log.Warning.Printf("No machine available to recover deployment %s of %s", deployment.Id, deployment.PackageId)
+				break
+			}
 			node := nodes.Nodes[i]
 			i += 1
 			log.Info.Printf("Node: %s = %s ", node.Key, node.Value)
@@ -527,6 +693,10 @@ func (e *EtcdBackend) AttemptRecovery(m *cluster.Machine) {
 				}
 				cache[machineName] = machine
 			}
+			if !machine.Admits(deployment) {
+				log.Trace.Printf("Machine %s does not admit the tags of deployment %s", machine.Id, deployment.Id)
+				continue
+			}
 			if ok := machine.TryDeploy(deployment); ok {
 				log.Trace.Printf("Deployed: %s to machine %s", deployment.Id, machine.Id)
 				curDeployments, _ := strconv.Atoi(node.Value)
@@ -534,7 +704,7 @@ func (e *EtcdBackend) AttemptRecovery(m *cluster.Machine) {
 				node.Value = strconv.Itoa(curDeployments)
 				x := i
 				ii := i - 1
-				for {
+				for x < len(nodes.Nodes) {
 					nextNode := nodes.Nodes[x]
 					nextDeployments, _ := strconv.Atoi(nextNode.Value)
 					if nextDeployments >= curDeployments {
@@ -553,7 +723,7 @@ func (e *EtcdBackend) AttemptRecovery(m *cluster.Machine) {
 		}
 
 	}
-	e.Status <- "Recovered"
+	e.setStatus("Recovered")
 
 }
 
@@ -575,7 +745,7 @@ func (e *EtcdBackend) handleNewNode(node *client.Node) {
 }
 
 func (e *EtcdBackend) parseConfig(cluster *cluster.Cluster, prefix string) {
-	cfg := EtcdBackendConfig{}
+	cfg := EtcdBackendConfig{RevocationPrefix: DefaultRevocationPrefix}
 	backendConfig := cluster.ClusterConfig["backend-config"].(map[string]interface{})
 	for key, val := range backendConfig {
 		switch key {
@@ -594,6 +764,10 @@ func (e *EtcdBackend) parseConfig(cluster *cluster.Cluster, prefix string) {
 			cfg.MachinePrefix = val.(string) + "/" + prefix
 		case "deployment-prefix":
 			cfg.DeploymentPrefix = val.(string) + "/" + prefix
+		case "package-prefix":
+			cfg.PackagePrefix = strings.TrimSuffix(val.(string), "/")
+		case "revocation-prefix":
+			cfg.RevocationPrefix = strings.TrimSuffix(val.(string), "/")
 		case "failover-timeout":
 			timespan := val.(string)
 			unit := timespan[len(timespan)-1:]
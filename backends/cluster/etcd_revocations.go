@@ -0,0 +1,191 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const DefaultRevocationPrefix = "/deployd/revoked"
+
+// Revocations are kept a little longer than the tokens they name so
+// clock differences between nodes can't bring a token back
+const revocationSkew = time.Minute
+
+var RevocationRewatchDelay = time.Second * 5
+
+var ErrNotConnected = errors.New("Not connected to etcd")
+
+// Token ids revoked on any node, stored as <revocation-prefix>/<id>
+// with a TTL and copied locally by a watch
+type etcdRevocations struct {
+	mutex   sync.RWMutex
+	revoked map[string]time.Time
+}
+
+type revocation struct {
+	TokenId   string    `json:"tokenId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Stop accepting a token on every node, the key is only created if
+// no other node has revoked the token first
+func (e *EtcdBackend) Revoke(tokenId string, expires time.Time) error {
+	if e.kapi == nil {
+		return ErrNotConnected
+	}
+	data, err := json.Marshal(revocation{TokenId: tokenId, ExpiresAt: expires.UTC()})
+	if err != nil {
+		return err
+	}
+	ttl := expires.Sub(time.Now()) + revocationSkew
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	key := e.backendConfig.RevocationPrefix + "/" + tokenId
+	_, err = e.kapi.Set(ctx, key, string(data), &client.SetOptions{TTL: ttl, PrevExist: client.PrevNoExist})
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+		e.revocations.add(tokenId, expires)
+		return auth.ErrAlreadyRevoked
+	} else if err != nil {
+		handleEtcdError(err, key)
+		return err
+	}
+	e.revocations.add(tokenId, expires)
+	return nil
+}
+
+func (e *EtcdBackend) Revoked(tokenId string) bool {
+	e.revocations.mutex.RLock()
+	defer e.revocations.mutex.RUnlock()
+	_, ok := e.revocations.revoked[tokenId]
+	return ok
+}
+
+func (r *etcdRevocations) add(tokenId string, expires time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for id, until := range r.revoked {
+		if until.Add(revocationSkew).Before(now) {
+			delete(r.revoked, id)
+		}
+	}
+	if r.revoked == nil {
+		r.revoked = make(map[string]time.Time)
+	}
+	r.revoked[tokenId] = expires
+}
+
+func (r *etcdRevocations) apply(node *client.Node) {
+	if node == nil || node.Dir || node.Value == "" {
+		return
+	}
+	var value revocation
+	if err := json.Unmarshal([]byte(node.Value), &value); err != nil {
+		log.Error.Printf("Failed to parse revocation %s: %v", node.Key, err)
+		return
+	}
+	if value.TokenId == "" {
+		value.TokenId = node.Key[strings.LastIndex(node.Key, "/")+1:]
+	}
+	r.add(value.TokenId, value.ExpiresAt)
+}
+
+// Read every revocation and follow new ones, a watch that fails is
+// restarted from a fresh read
+func (e *EtcdBackend) watchRevocations() {
+	if e.kapi == nil {
+		return
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	go func() {
+		sig := <-e.Signal
+		e.Signal <- sig
+		cancelFunc()
+	}()
+	index, err := e.loadRevocations(ctx)
+	if err != nil {
+		log.Error.Printf("Failed to read revoked tokens: %v", err)
+	}
+	go func() {
+		for {
+			watcher := e.kapi.Watcher(e.backendConfig.RevocationPrefix, &client.WatcherOptions{AfterIndex: index, Recursive: true})
+			for {
+				resp, err := watcher.Next(ctx)
+				if err != nil {
+					break
+				}
+				index = resp.Index
+				if resp.Action == "set" || resp.Action == "create" || resp.Action == "update" {
+					e.revocations.apply(resp.Node)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(RevocationRewatchDelay):
+			}
+			log.Warning.Printf("Watching %s failed, reading revoked tokens again", e.backendConfig.RevocationPrefix)
+			if reloaded, err := e.loadRevocations(ctx); err != nil {
+				log.Error.Printf("Failed to read revoked tokens: %v", err)
+			} else {
+				index = reloaded
+			}
+		}
+	}()
+}
+
+// Copy the stored revocations, returns the etcd index they were read at
+func (e *EtcdBackend) loadRevocations(ctx context.Context) (uint64, error) {
+	result, err := e.kapi.Get(ctx, e.backendConfig.RevocationPrefix, &client.GetOptions{Recursive: true, Quorum: true})
+	if client.IsKeyNotFound(err) {
+		if cerr, ok := err.(client.Error); ok {
+			return cerr.Index, nil
+		}
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if !node.Dir {
+			e.revocations.apply(node)
+			return
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(result.Node)
+	return result.Index, nil
+}
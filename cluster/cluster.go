@@ -76,7 +76,12 @@ func (c *Cluster) AddMachine(machine *Machine) {
 }
 
 func (c *Cluster) RemoveMachine(machine *Machine) {
-
+	for i, m := range c.Machines {
+		if m.Id == machine.Id {
+			c.Machines = append(c.Machines[:i], c.Machines[i+1:]...)
+			return
+		}
+	}
 }
 
 func (c *Cluster) GetMachine(id string) *Machine {
@@ -23,19 +23,39 @@
 package cluster
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"github.com/cchamplin/deployd/deployment"
 	"github.com/cchamplin/deployd/log"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+var ForwardTimeout = 30 * time.Second
+
+// Supplies the Authorization header for forwarded deployments when
+// the API requires authentication
+var ForwardAuthorization func() string
+
+// Supplies the TLS configuration for forwarding to machines that
+// serve their API over TLS
+var ForwardTLSConfig func() *tls.Config
+
 type Machine struct {
-	Id       string   `json:"id"`
-	Endpoint string   `json:"endpoint"`
-	Tags     []string `json:"tags"`
+	Id            string   `json:"id"`
+	Endpoint      string   `json:"endpoint"`
+	Tags          []string `json:"tags"`
+	AllowUntagged bool     `json:"allowUntagged"`
+	// Whether the machine serves its API over TLS
+	Secure bool `json:"secure,omitempty"`
+	// Set when the machine shuts down on purpose, its deployments
+	// don't need to be recovered
+	Leaving bool `json:"leaving,omitempty"`
 }
 
 type Machines []*Machine
@@ -55,8 +75,49 @@ func DeserializeMachine(s string) *Machine {
 	return &result
 }
 
-func (m *Machine) TryDeploy(d deployment.Deployment) bool {
+// Check whether the machine's allowed tags admit the package
+// a deployment was made from
+func (m *Machine) Admits(d deployment.Deployment) bool {
+	return deployment.TagsAllowed(m.Tags, m.AllowUntagged, d.Tags)
+}
 
+// Forward a deployment to the machine, the machine refuses it
+// unless its copy of the package matches the deployment's
+func (m *Machine) TryDeploy(d deployment.Deployment) bool {
+	data, err := json.Marshal(d)
+	if err != nil {
+		log.Error.Printf("Failed to serialize deployment %s: %v", d.Id, err)
+		return false
+	}
+	client := http.Client{Timeout: ForwardTimeout}
+	scheme := "http://"
+	if m.Secure {
+		scheme = "https://"
+		if ForwardTLSConfig != nil {
+			transport := &http.Transport{TLSClientConfig: ForwardTLSConfig()}
+			defer transport.CloseIdleConnections()
+			client.Transport = transport
+		}
+	}
+	req, err := http.NewRequest("POST", scheme+m.Endpoint+"/deployments/forward", bytes.NewReader(data))
+	if err != nil {
+		log.Error.Printf("Failed to forward deployment %s to %s: %v", d.Id, m.Id, err)
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ForwardAuthorization != nil {
+		req.Header.Set("Authorization", ForwardAuthorization())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warning.Printf("Failed to forward deployment %s to %s: %v", d.Id, m.Id, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		log.Warning.Printf("Machine %s refused deployment %s: %s", m.Id, d.Id, resp.Status)
+		return false
+	}
 	return true
 }
 
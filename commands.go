@@ -0,0 +1,120 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	GoTemplate "text/template"
+
+	"github.com/cchamplin/deployd/deployment"
+)
+
+// Template functions are only needed to validate imported templates
+// from the command line, the real ones are provided by the cluster backend
+var commandFuncMap = GoTemplate.FuncMap{
+	"getv":  func(string) map[string]interface{} { return nil },
+	"getvs": func(string) map[string]interface{} { return nil },
+	"gets":  func(string) string { return "" },
+}
+
+// Handle "deployd package ..." sub commands, returns the exit code
+func packageCommand(configDirectory string, args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: deployd [-config dir] package export <id> [file.tar.gz|-]")
+		fmt.Fprintln(os.Stderr, "       deployd [-config dir] package import <file.tar.gz|-> [id]")
+		return 2
+	}
+	if len(args) < 2 {
+		return usage()
+	}
+
+	switch args[0] {
+	case "export":
+		id := args[1]
+		dest := id + ".tar.gz"
+		if len(args) > 2 {
+			dest = args[2]
+		}
+		def, err := findPackageDef(configDirectory, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export %s: %v\n", id, err)
+			return 1
+		}
+
+		var out io.Writer = os.Stdout
+		if dest != "-" {
+			f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not export %s: %v\n", id, err)
+				return 1
+			}
+			defer f.Close()
+			out = f
+		}
+		if err := deployment.WriteBundle(configDirectory, def, out); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export %s: %v\n", id, err)
+			if dest != "-" {
+				os.Remove(dest)
+			}
+			return 1
+		}
+		if dest != "-" {
+			fmt.Fprintf(os.Stderr, "Exported %s to %s\n", id, dest)
+		}
+		return 0
+	case "import":
+		var in io.Reader = os.Stdin
+		if args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not import %s: %v\n", args[1], err)
+				return 1
+			}
+			defer f.Close()
+			in = f
+		}
+		id := ""
+		if len(args) > 2 {
+			id = args[2]
+		}
+		def, err := deployment.ImportBundle(configDirectory, in, id, commandFuncMap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not import %s: %v\n", args[1], err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Imported %s, restart deployd to load it\n", def.Id)
+		return 0
+	}
+	return usage()
+}
+
+func findPackageDef(configDirectory string, id string) (deployment.PackageDef, error) {
+	for _, def := range deployment.ReadPackageDefs(configDirectory) {
+		if def.Id == id {
+			return def, nil
+		}
+	}
+	return deployment.PackageDef{}, deployment.ErrPackageNotFound
+}
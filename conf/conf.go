@@ -25,7 +25,6 @@ package conf
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/cchamplin/deployd/auth"
 	"github.com/cchamplin/deployd/backends/conf"
 	"github.com/cchamplin/deployd/log"
 	"strings"
@@ -37,8 +36,28 @@ type ServerConfiguration struct {
 	AllowedTags   []string               `json:"allowed-tags"`
 	AllowUntagged bool                   `json:"allow-untagged"`
 	Journal       map[string]interface{} `json:"journal"`
-	Auth          map[string]interface{} `json:"journal"`
-	Backend       ConfigurationBackend
+	// Requests must carry a token issued by POST /auth when this
+	// section is configured
+	Auth map[string]interface{} `json:"auth"`
+	// Mutating requests and logins are recorded when this section is
+	// configured
+	Audit map[string]interface{} `json:"audit"`
+	// The API is served over TLS when a certificate is configured
+	TLSCert       string `json:"tls-cert"`
+	TLSKey        string `json:"tls-key"`
+	TLSMinVersion string `json:"tls-min-version"`
+	// Client certificates are verified against client-ca when one is
+	// configured and only demanded when client-cert-required is set
+	ClientCA           string `json:"client-ca"`
+	ClientCertRequired bool   `json:"client-cert-required"`
+	// How long to wait for running deployments when shutting down,
+	// e.g. 90s
+	ShutdownTimeout string `json:"shutdown-timeout"`
+	// Hosts deployments may post their completion callback to, e.g.
+	// *.example.com, and the secret callbacks are signed with
+	CallbackHosts  []string `json:"callback-hosts"`
+	CallbackSecret string   `json:"callback-secret"`
+	Backend        ConfigurationBackend
 }
 
 type ConfigurationBackend interface {
@@ -0,0 +1,304 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/satori/go.uuid"
+)
+
+var ErrEmptyBatch = errors.New("Batch has no deployments")
+var ErrBatchNotFound = errors.New("No such batch exist")
+
+const (
+	BATCH_WORKING         = "WORKING"
+	BATCH_COMPLETE        = "COMPLETE"
+	BATCH_ROLLING_BACK    = "ROLLING_BACK"
+	BATCH_ROLLED_BACK     = "ROLLED_BACK"
+	BATCH_ROLLBACK_FAILED = "ROLLBACK_FAILED"
+)
+
+type BatchMember struct {
+	PackageId string            `json:"packageId"`
+	Template  string            `json:"template,omitempty"`
+	Variables map[string]string `json:"variables"`
+}
+
+type BatchRequest struct {
+	Deployments []BatchMember `json:"deployments"`
+	Watch       bool          `json:"watch"`
+	RequestedBy string        `json:"-"`
+}
+
+// A set of deployments that are run in order as one unit, if one
+// fails the members that completed before it are undeployed again
+type Batch struct {
+	Id            string        `json:"id"`
+	Status        string        `json:"status"`
+	StatusMessage string        `json:"statusMessage"`
+	DeploymentIds []string      `json:"deploymentIds"`
+	Deployments   []*Deployment `json:"deployments,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	FinishedAt    *time.Time    `json:"finishedAt,omitempty"`
+	RequestedBy   string        `json:"requestedBy,omitempty"`
+}
+
+// Returned when a member of a batch request can't be deployed
+type BatchMemberError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchMemberError) Error() string {
+	return fmt.Sprintf("Batch deployment %d: %v", e.Index, e.Err)
+}
+
+// Validate every member of the batch and start running it in the
+// background, nothing is deployed when any member is invalid
+func (r *Repository) DeployBatch(req BatchRequest) (*Batch, error) {
+	if len(req.Deployments) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	packages := make([]Package, len(req.Deployments))
+	for i, member := range req.Deployments {
+		pkg, err := r.FindPackage(member.PackageId)
+		if err != nil {
+			return nil, &BatchMemberError{Index: i, Err: err}
+		}
+		if member.Template != "" && !pkg.HasTemplate(member.Template) {
+			return nil, &BatchMemberError{Index: i, Err: ErrTemplateNotFound}
+		}
+		packages[i] = pkg
+	}
+
+	now := time.Now().UTC()
+	batch := &Batch{
+		Id:            uuid.NewV4().String(),
+		Status:        BATCH_WORKING,
+		StatusMessage: "Deploying",
+		CreatedAt:     now,
+		RequestedBy:   req.RequestedBy,
+	}
+	members := make([]*Deployment, len(req.Deployments))
+	for i, member := range req.Deployments {
+		u1 := uuid.NewV4().String()
+		variables := make(map[string]string, len(member.Variables)+3)
+		for key, value := range member.Variables {
+			variables[key] = value
+		}
+		variables["__package"] = packages[i].Name
+		variables["__packageId"] = packages[i].Id
+		variables["__deploymentId"] = u1
+		members[i] = &Deployment{
+			Id:            u1,
+			PackageId:     packages[i].Id,
+			PackageHash:   packages[i].Hash,
+			Tags:          packages[i].Tags,
+			Status:        "NOT STARTED",
+			StatusMessage: "Not Started",
+			Variables:     variables,
+			Watch:         req.Watch,
+			Template:      member.Template,
+			CreatedAt:     now,
+			RequestedBy:   req.RequestedBy,
+			BatchId:       batch.Id,
+			BatchIndex:    i,
+		}
+		batch.DeploymentIds = append(batch.DeploymentIds, u1)
+	}
+	log.Info.Printf("Deploying batch %s of %d packages for %s", batch.Id, len(members), req.RequestedBy)
+
+	r.mutex.Lock()
+	if r.batches == nil {
+		r.batches = make(map[string]*Batch)
+	}
+	r.batches[batch.Id] = batch
+	for _, d := range members {
+		r.deployments[d.Id] = d
+	}
+	r.mutex.Unlock()
+	for _, d := range members {
+		r.JournalDeployment(d)
+	}
+
+	r.run(members[0], func() { r.runBatch(batch, members, packages) })
+	return r.copyBatch(batch, members), nil
+}
+
+// Deploy the members one after the other, on the first failure the
+// rest are cancelled and the completed ones undeployed in reverse
+func (r *Repository) runBatch(batch *Batch, members []*Deployment, packages []Package) {
+	failedAt := -1
+	for i, d := range members {
+		if d.Template == "" {
+			d.Deploy(&packages[i], r)
+		} else {
+			d.DeployTemplate(&packages[i], r, d.Template)
+		}
+		if d.Status != STATUS_COMPLETE {
+			failedAt = i
+			break
+		}
+	}
+
+	if failedAt < 0 {
+		r.finishBatch(batch, BATCH_COMPLETE, "Batch Deployed")
+		return
+	}
+
+	log.Warning.Printf("Batch %s failed on %s, rolling back", batch.Id, members[failedAt].Id)
+	r.updateBatch(batch, BATCH_ROLLING_BACK, fmt.Sprintf("Deployment %s failed, rolling back", members[failedAt].Id))
+	for _, d := range members[failedAt+1:] {
+		d.Status = STATUS_CANCELLED
+		d.StatusMessage = "Cancelled after an earlier batch deployment failed"
+		r.JournalDeployment(d)
+	}
+	rolledBack := true
+	for i := failedAt - 1; i >= 0; i-- {
+		d := members[i]
+		// The deployment may have been undeployed through the API
+		// while the batch was running
+		if status, ok := r.claimUndeploy(d); !ok {
+			if status != STATUS_UNDEPLOYED {
+				log.Error.Printf("Batch %s could not undeploy %s, it is %s", batch.Id, d.Id, status)
+				rolledBack = false
+			}
+			continue
+		}
+		if ok := d.Undeploy(&packages[i]); !ok {
+			log.Error.Printf("Batch %s could not undeploy %s", batch.Id, d.Id)
+			rolledBack = false
+		}
+		r.JournalDeployment(d)
+	}
+	if rolledBack {
+		r.finishBatch(batch, BATCH_ROLLED_BACK, fmt.Sprintf("Deployment %s failed, batch rolled back", members[failedAt].Id))
+	} else {
+		r.finishBatch(batch, BATCH_ROLLBACK_FAILED, fmt.Sprintf("Deployment %s failed, not every deployment could be undeployed", members[failedAt].Id))
+	}
+}
+
+func (r *Repository) updateBatch(batch *Batch, status string, message string) {
+	r.mutex.Lock()
+	batch.Status = status
+	batch.StatusMessage = message
+	r.mutex.Unlock()
+}
+
+func (r *Repository) finishBatch(batch *Batch, status string, message string) {
+	now := time.Now().UTC()
+	r.mutex.Lock()
+	batch.Status = status
+	batch.StatusMessage = message
+	batch.FinishedAt = &now
+	r.mutex.Unlock()
+	log.Info.Printf("Batch %s finished: %s", batch.Id, status)
+}
+
+// Look up a batch along with its member deployments
+func (r *Repository) FindBatch(id string) (*Batch, error) {
+	r.mutex.Lock()
+	batch, found := r.batches[id]
+	if !found {
+		r.mutex.Unlock()
+		return nil, ErrBatchNotFound
+	}
+	members := make([]*Deployment, 0, len(batch.DeploymentIds))
+	for _, deploymentId := range batch.DeploymentIds {
+		if d, ok := r.deployments[deploymentId]; ok {
+			members = append(members, d)
+		}
+	}
+	r.mutex.Unlock()
+	return r.copyBatch(batch, members), nil
+}
+
+func (r *Repository) copyBatch(batch *Batch, members []*Deployment) *Batch {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c := *batch
+	c.DeploymentIds = append([]string(nil), batch.DeploymentIds...)
+	c.Deployments = members
+	return &c
+}
+
+// Rebuild the batches from their journaled members. Batches that were
+// interrupted by a restart are not resumed, their unfinished members
+// are failed and the batch is left for an operator to clean up.
+func (r *Repository) restoreBatches() {
+	grouped := make(map[string][]*Deployment)
+	for _, d := range r.deployments {
+		if d.BatchId != "" {
+			grouped[d.BatchId] = append(grouped[d.BatchId], d)
+		}
+	}
+	r.batches = make(map[string]*Batch, len(grouped))
+	for id, members := range grouped {
+		sort.Sort(byBatchIndex(members))
+		batch := &Batch{Id: id, CreatedAt: members[0].CreatedAt, RequestedBy: members[0].RequestedBy}
+		complete, interrupted := 0, false
+		for _, d := range members {
+			batch.DeploymentIds = append(batch.DeploymentIds, d.Id)
+			switch d.Status {
+			case STATUS_COMPLETE:
+				complete++
+			case STATUS_FAILED, STATUS_CANCELLED, STATUS_UNDEPLOYED:
+			default:
+				d.Status = STATUS_FAILED
+				d.StatusMessage = "Interrupted by a restart"
+				d.finished()
+				r.JournalDeployment(d)
+				interrupted = true
+			}
+			if d.FinishedAt != nil && (batch.FinishedAt == nil || d.FinishedAt.After(*batch.FinishedAt)) {
+				batch.FinishedAt = d.FinishedAt
+			}
+		}
+		switch {
+		case complete == len(members):
+			batch.Status = BATCH_COMPLETE
+			batch.StatusMessage = "Batch Deployed"
+		case complete == 0:
+			batch.Status = BATCH_ROLLED_BACK
+			batch.StatusMessage = "Batch rolled back"
+		default:
+			batch.Status = BATCH_ROLLBACK_FAILED
+			batch.StatusMessage = "Batch did not finish, completed deployments were not undeployed"
+		}
+		if interrupted {
+			log.Warning.Printf("Batch %s was interrupted: %s", id, batch.Status)
+		}
+		r.batches[id] = batch
+	}
+}
+
+type byBatchIndex []*Deployment
+
+func (s byBatchIndex) Len() int           { return len(s) }
+func (s byBatchIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byBatchIndex) Less(i, j int) bool { return s[i].BatchIndex < s[j].BatchIndex }
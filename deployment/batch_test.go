@@ -0,0 +1,85 @@
+package deployment
+
+import (
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreBatches(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	r := &Repository{mutex: &sync.Mutex{}, deployments: make(Deployments)}
+	for _, d := range []Deployment{
+		{Id: "a1", BatchId: "a", BatchIndex: 1, Status: STATUS_COMPLETE},
+		{Id: "a0", BatchId: "a", BatchIndex: 0, Status: STATUS_COMPLETE},
+		{Id: "b0", BatchId: "b", BatchIndex: 0, Status: STATUS_UNDEPLOYED},
+		{Id: "b1", BatchId: "b", BatchIndex: 1, Status: STATUS_FAILED},
+		{Id: "b2", BatchId: "b", BatchIndex: 2, Status: STATUS_CANCELLED},
+		{Id: "c0", BatchId: "c", BatchIndex: 0, Status: STATUS_COMPLETE},
+		{Id: "c1", BatchId: "c", BatchIndex: 1, Status: STATUS_WORKING},
+		{Id: "solo", Status: STATUS_COMPLETE},
+	} {
+		d := d
+		r.deployments[d.Id] = &d
+	}
+	r.restoreBatches()
+
+	assert.Len(t, r.batches, 3)
+	batch, err := r.FindBatch("a")
+	assert.Nil(t, err)
+	assert.Equal(t, BATCH_COMPLETE, batch.Status)
+	assert.Equal(t, []string{"a0", "a1"}, batch.DeploymentIds)
+	assert.Equal(t, []string{"a0", "a1"}, deploymentIds(batch.Deployments))
+
+	batch, _ = r.FindBatch("b")
+	assert.Equal(t, BATCH_ROLLED_BACK, batch.Status)
+
+	batch, _ = r.FindBatch("c")
+	assert.Equal(t, BATCH_ROLLBACK_FAILED, batch.Status)
+	assert.Equal(t, STATUS_FAILED, r.deployments["c1"].Status)
+
+	_, err = r.FindBatch("solo")
+	assert.Equal(t, ErrBatchNotFound, err)
+}
+
+func TestDeployBatchValidatesMembers(t *testing.T) {
+	r := &Repository{mutex: &sync.Mutex{}, packageMutex: &sync.RWMutex{}, deployments: make(Deployments), allowUntagged: true}
+	r.packages = Packages{{Id: "php", Name: "php"}}
+
+	_, err := r.DeployBatch(BatchRequest{})
+	assert.Equal(t, ErrEmptyBatch, err)
+
+	_, err = r.DeployBatch(BatchRequest{Deployments: []BatchMember{{PackageId: "php"}, {PackageId: "nginx"}}})
+	assert.Equal(t, &BatchMemberError{Index: 1, Err: ErrPackageNotFound}, err)
+
+	_, err = r.DeployBatch(BatchRequest{Deployments: []BatchMember{{PackageId: "php", Template: "php.ini"}}})
+	assert.Equal(t, &BatchMemberError{Index: 0, Err: ErrTemplateNotFound}, err)
+	assert.Empty(t, r.deployments)
+}
+
+func TestUndeployClaimedOnce(t *testing.T) {
+	r := &Repository{mutex: &sync.Mutex{}, packageMutex: &sync.RWMutex{}, deployments: make(Deployments), allowUntagged: true}
+	r.packages = Packages{{Id: "php", Name: "php"}}
+	r.deployments["a"] = &Deployment{Id: "a", PackageId: "php", Status: STATUS_COMPLETE}
+
+	var wg sync.WaitGroup
+	var claimed int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := r.undeployable("a"); err == nil {
+				atomic.AddInt32(&claimed, 1)
+			} else {
+				assert.Equal(t, ErrDeploymentRunning, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), claimed)
+	assert.Equal(t, STATUS_UNDEPLOYING, r.deployments["a"].Status)
+}
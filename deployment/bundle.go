@@ -0,0 +1,460 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cchamplin/deployd/atomicfile"
+	"github.com/cchamplin/deployd/log"
+
+	GoTemplate "text/template"
+)
+
+// A bundle is a .tar.gz holding a single flattened package
+// definition, the template files it uses and a manifest with
+// the sha256 checksum of every other file in the archive
+const (
+	BundleManifestFile   = "manifest.json"
+	BundleDefinitionFile = "package.json"
+	BundleTemplateDir    = "tpl/"
+	// Bundles are read into memory before anything is installed
+	MaxBundleSize = 32 << 20
+	// Limit on the decompressed contents, a small archive must not
+	// be able to expand into an unbounded amount of memory
+	MaxBundleContentSize = 128 << 20
+)
+
+var ErrPackageExists = errors.New("A package with this id already exists")
+var ErrInvalidBundle = errors.New("Invalid package bundle")
+var ErrInvalidPackageId = errors.New("Package id must not be empty or contain path separators")
+
+// Package ids name files under conf.d, an id must never be able
+// to point anywhere else
+func ValidatePackageId(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+		return ErrInvalidPackageId
+	}
+	return nil
+}
+
+type BundleManifest struct {
+	Id      string            `json:"id"`
+	Name    string            `json:"name"`
+	Version string            `json:"version"`
+	Created int64             `json:"created"`
+	Files   map[string]string `json:"files"`
+}
+
+type Bundle struct {
+	Manifest BundleManifest
+	Package  PackageDef
+	files    map[string][]byte
+}
+
+// Find the definition a package was loaded from, packages that
+// extend another package are returned already flattened
+func (r *Repository) FindPackageDef(id string) (PackageDef, error) {
+	r.packageMutex.RLock()
+	defer r.packageMutex.RUnlock()
+	for _, def := range r.packageDefs {
+		if def.Id == id {
+			return def, nil
+		}
+	}
+	return PackageDef{}, ErrPackageNotFound
+}
+
+func (r *Repository) ExportBundle(id string, w io.Writer) error {
+	def, err := r.FindPackageDef(id)
+	if err != nil {
+		return err
+	}
+	return WriteBundle(r.configDirectory, def, w)
+}
+
+// Install a bundle into the config directory and load the package
+// it contains. If id is set the package is installed under that id
+// instead of the one it was exported with.
+func (r *Repository) ImportBundle(rd io.Reader, id string) (Package, error) {
+	bundle, err := ReadBundle(rd)
+	if err != nil {
+		return Package{}, err
+	}
+	return r.InstallBundle(bundle, id)
+}
+
+// Install a bundle that was already read, see ImportBundle
+func (r *Repository) InstallBundle(bundle *Bundle, id string) (Package, error) {
+	r.packageMutex.Lock()
+	defer r.packageMutex.Unlock()
+	if err := bundle.prepare(id, r.packageDefs, r.funcMap); err != nil {
+		return Package{}, err
+	}
+
+	// Compile from the bundled template bodies so a package that
+	// doesn't load never reaches the config directory
+	def := bundle.Package
+	def.templateBodies = bundle.templateBodies()
+	packages := r.compilePackages(PackageDefs{def}, r.funcMap)
+	if len(packages) == 0 {
+		return Package{}, &PackageDefError{Reason: "the package did not load, see the logs"}
+	}
+
+	if err := bundle.Install(r.configDirectory); err != nil {
+		return Package{}, err
+	}
+	bundle.Package.source = filepath.Join(r.configDirectory, "conf.d", bundle.Package.Id+".json")
+	r.packageDefs = append(r.packageDefs, bundle.Package)
+	r.packages = append(r.packages, packages[0])
+	log.Info.Printf("Imported package %s from bundle", bundle.Package.Id)
+	return packages[0], nil
+}
+
+// Install a bundle into a config directory without a running
+// repository, the package is picked up the next time deployd starts
+func ImportBundle(configDirectory string, rd io.Reader, id string, funcMap GoTemplate.FuncMap) (PackageDef, error) {
+	bundle, err := ReadBundle(rd)
+	if err != nil {
+		return PackageDef{}, err
+	}
+	if err := bundle.prepare(id, ReadPackageDefs(configDirectory), funcMap); err != nil {
+		return PackageDef{}, err
+	}
+	if err := bundle.Install(configDirectory); err != nil {
+		return PackageDef{}, err
+	}
+	return bundle.Package, nil
+}
+
+// Rename the bundled package if requested and check it can be
+// installed next to the existing definitions
+func (b *Bundle) prepare(id string, existing PackageDefs, funcMap GoTemplate.FuncMap) error {
+	if id != "" {
+		b.Package.Id = id
+	}
+	if err := ValidatePackageId(b.Package.Id); err != nil {
+		return err
+	}
+	for _, def := range existing {
+		if def.Id == b.Package.Id {
+			return ErrPackageExists
+		}
+	}
+	// Template processing panics on invalid templates, catch
+	// them before anything is compiled or written
+	return b.validateTemplates(funcMap)
+}
+
+// Tags of the bundled package, as the package will carry them once
+// it is installed
+func (b *Bundle) Tags() []string {
+	return mergeTags(b.Package.Tag, b.Package.Tags)
+}
+
+func (b *Bundle) templateBodies() map[string]string {
+	bodies := make(map[string]string)
+	for name, data := range b.files {
+		if strings.HasPrefix(name, BundleTemplateDir) {
+			bodies[strings.TrimPrefix(name, BundleTemplateDir)] = string(data)
+		}
+	}
+	return bodies
+}
+
+func WriteBundle(configDirectory string, def PackageDef, w io.Writer) error {
+	def.Extends = ""
+	files := make(map[string][]byte)
+
+	data, err := json.MarshalIndent(PackageDefs{def}, "", "  ")
+	if err != nil {
+		return err
+	}
+	files[BundleDefinitionFile] = data
+
+	for _, tmpl := range def.Templates {
+		name := tmpl.Src + ".tpl"
+		data, err := ioutil.ReadFile(filepath.Join(configDirectory, "tpl", name))
+		if err != nil {
+			return fmt.Errorf("Could not read template %s: %v", name, err)
+		}
+		files[BundleTemplateDir+name] = data
+	}
+
+	manifest := BundleManifest{Id: def.Id, Name: def.Name, Version: def.Version, Created: time.Now().Unix(), Files: make(map[string]string)}
+	names := make([]string, 0, len(files))
+	for name, data := range files {
+		manifest.Files[name] = checksum(data)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeTarFile(tw, BundleManifestFile, manifestData); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := writeTarFile(tw, name, files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Read a bundle and verify it against its manifest, every file
+// must be listed with a matching checksum
+func ReadBundle(rd io.Reader) (*Bundle, error) {
+	gz, err := gzip.NewReader(io.LimitReader(rd, MaxBundleSize))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidBundle, err)
+	}
+	defer gz.Close()
+
+	bundle := &Bundle{files: make(map[string][]byte)}
+	var manifestData []byte
+	var size int64
+	tr := tar.NewReader(&bundleLimitReader{r: gz, n: MaxBundleContentSize})
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", ErrInvalidBundle, err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		size += header.Size
+		if header.Size < 0 || size > MaxBundleContentSize {
+			return nil, fmt.Errorf("%v: contents exceed %d bytes", ErrInvalidBundle, MaxBundleContentSize)
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, fmt.Errorf("%v: %v", ErrInvalidBundle, err)
+		}
+		if header.Name == BundleManifestFile {
+			manifestData = buf.Bytes()
+			continue
+		}
+		if !validBundlePath(header.Name) {
+			return nil, fmt.Errorf("%v: unexpected file %s", ErrInvalidBundle, header.Name)
+		}
+		bundle.files[header.Name] = buf.Bytes()
+	}
+
+	if manifestData == nil {
+		return nil, fmt.Errorf("%v: missing %s", ErrInvalidBundle, BundleManifestFile)
+	}
+	if err := json.Unmarshal(manifestData, &bundle.Manifest); err != nil {
+		return nil, fmt.Errorf("%v: %s: %v", ErrInvalidBundle, BundleManifestFile, err)
+	}
+	for name, sum := range bundle.Manifest.Files {
+		data, ok := bundle.files[name]
+		if !ok {
+			return nil, fmt.Errorf("%v: missing file %s", ErrInvalidBundle, name)
+		}
+		if checksum(data) != sum {
+			return nil, fmt.Errorf("%v: checksum mismatch for %s", ErrInvalidBundle, name)
+		}
+	}
+	for name := range bundle.files {
+		if _, ok := bundle.Manifest.Files[name]; !ok {
+			return nil, fmt.Errorf("%v: file %s is not in the manifest", ErrInvalidBundle, name)
+		}
+	}
+
+	defs, err := parsePackageDefs(BundleDefinitionFile, bundle.files[BundleDefinitionFile])
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s: %v", ErrInvalidBundle, BundleDefinitionFile, err)
+	}
+	if len(defs) != 1 || defs[0].Id != bundle.Manifest.Id || defs[0].Extends != "" {
+		return nil, fmt.Errorf("%v: %s must contain package %s only", ErrInvalidBundle, BundleDefinitionFile, bundle.Manifest.Id)
+	}
+	bundle.Package = defs[0]
+	for _, tmpl := range bundle.Package.Templates {
+		if _, ok := bundle.files[BundleTemplateDir+tmpl.Src+".tpl"]; !ok {
+			return nil, fmt.Errorf("%v: missing template %s", ErrInvalidBundle, tmpl.Src)
+		}
+	}
+	return bundle, nil
+}
+
+// Fails reads once more than n bytes were read, unlike
+// io.LimitReader which would silently truncate the archive
+type bundleLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *bundleLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errors.New("bundle contents are too large")
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// Only the definition and files under tpl/ may be installed, nothing
+// is allowed to escape the config directory
+func validBundlePath(name string) bool {
+	if name == BundleDefinitionFile {
+		return true
+	}
+	clean := path.Clean(name)
+	return clean == name && strings.HasPrefix(name, BundleTemplateDir) && strings.HasSuffix(name, ".tpl") && !strings.Contains(name, "..")
+}
+
+// Write the bundle's definition into conf.d/<id>.json and its templates
+// into tpl/. Existing templates are only reused if their contents are
+// identical, nothing is written if any file would be overwritten.
+func (b *Bundle) Install(configDirectory string) error {
+	if err := ValidatePackageId(b.Package.Id); err != nil {
+		return err
+	}
+	defFile := filepath.Join(configDirectory, "conf.d", b.Package.Id+".json")
+	if _, err := os.Stat(defFile); err == nil {
+		return ErrPackageExists
+	}
+
+	templates := make(map[string][]byte)
+	for name, data := range b.files {
+		if !strings.HasPrefix(name, BundleTemplateDir) {
+			continue
+		}
+		dest := filepath.Join(configDirectory, filepath.FromSlash(name))
+		existing, err := ioutil.ReadFile(dest)
+		if err == nil {
+			if !bytes.Equal(existing, data) {
+				return fmt.Errorf("Template %s already exists with different contents", name)
+			}
+			continue
+		}
+		templates[dest] = data
+	}
+
+	for dest, data := range templates {
+		if err := atomicfile.Write(dest, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(PackageDefs{b.Package}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(defFile, data, 0644)
+}
+
+func (b *Bundle) validateTemplates(funcMap GoTemplate.FuncMap) error {
+	parse := func(name string, value string) error {
+		if _, err := GoTemplate.New(name).Funcs(funcMap).Parse(value); err != nil {
+			return fmt.Errorf("%v: %v", ErrInvalidBundle, err)
+		}
+		return nil
+	}
+	var fragments func(defs ...interface{}) error
+	fragments = func(defs ...interface{}) error {
+		for _, def := range defs {
+			switch val := def.(type) {
+			case string:
+				if err := parse(val, val); err != nil {
+					return err
+				}
+			case map[string]interface{}:
+				for _, cmd := range val {
+					if cmd, ok := cmd.(string); ok {
+						if err := parse(cmd, cmd); err != nil {
+							return err
+						}
+					}
+				}
+			case []interface{}:
+				for _, item := range val {
+					if err := fragments(item); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := fragments(b.Package.TemplatesBefore, b.Package.TemplatesAfter, b.Package.TemplatesUndeploy); err != nil {
+		return err
+	}
+	for _, tmpl := range b.Package.Templates {
+		name := BundleTemplateDir + tmpl.Src + ".tpl"
+		if err := parse(name, string(b.files[name])); err != nil {
+			return err
+		}
+		if err := parse(tmpl.Src+"_dest", tmpl.Dest); err != nil {
+			return err
+		}
+		if err := fragments(tmpl.Before, tmpl.After, tmpl.Watch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,189 @@
+package deployment
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, os.Stderr)
+	var def PackageDef
+	for _, d := range ReadPackageDefs("../tests") {
+		if d.Id == "test_strict" {
+			def = d
+		}
+	}
+	assert.Equal(t, def.Id, "test_strict", "")
+
+	var bundle bytes.Buffer
+	assert.Nil(t, WriteBundle("../tests", def, &bundle))
+
+	dir, err := ioutil.TempDir("", "deployd-bundle")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data := bundle.Bytes()
+	imported, err := ImportBundle(dir, bytes.NewReader(data), "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, imported.Id, "test_strict", "")
+	assert.Equal(t, *imported.Strict, true, "")
+
+	original, _ := ioutil.ReadFile("../tests/tpl/php.service.tpl")
+	installed, err := ioutil.ReadFile(filepath.Join(dir, "tpl", "php.service.tpl"))
+	assert.Nil(t, err)
+	assert.Equal(t, installed, original, "")
+
+	defs := ReadPackageDefs(dir)
+	assert.Equal(t, len(defs), 1, "")
+	assert.Equal(t, len(defs[0].Templates), 3, "")
+
+	// Same id again collides, a new id shares the identical templates
+	_, err = ImportBundle(dir, bytes.NewReader(data), "", nil)
+	assert.Equal(t, err, ErrPackageExists, "")
+	imported, err = ImportBundle(dir, bytes.NewReader(data), "test_strict_copy", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(ReadPackageDefs(dir)), 2, "")
+}
+
+func TestBundleChecksum(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, os.Stderr)
+	var bundle bytes.Buffer
+	assert.Nil(t, WriteBundle("../tests", ReadPackageDefs("../tests")[0], &bundle))
+
+	// Rewrite the bundle with one template modified
+	gr, err := gzip.NewReader(&bundle)
+	assert.Nil(t, err)
+	tr := tar.NewReader(gr)
+	var tampered bytes.Buffer
+	gw := gzip.NewWriter(&tampered)
+	tw := tar.NewWriter(gw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if filepath.Ext(header.Name) == ".tpl" {
+			data = append(data, []byte("rm -rf /")...)
+		}
+		assert.Nil(t, writeTarFile(tw, header.Name, data))
+	}
+	tw.Close()
+	gw.Close()
+
+	_, err = ReadBundle(&tampered)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestBundleRejectsTraversingIds(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, os.Stderr)
+	var def PackageDef
+	for _, d := range ReadPackageDefs("../tests") {
+		if d.Id == "test_strict" {
+			def = d
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "deployd-bundle")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The id given on import tries to escape conf.d
+	var bundle bytes.Buffer
+	assert.Nil(t, WriteBundle("../tests", def, &bundle))
+	_, err = ImportBundle(dir, bytes.NewReader(bundle.Bytes()), "../../etc/cron.d/x", nil)
+	assert.Equal(t, err, ErrInvalidPackageId, "")
+
+	// So does the id inside the bundled definition
+	def.Id = "..\\..\\x"
+	bundle.Reset()
+	assert.Nil(t, WriteBundle("../tests", def, &bundle))
+	_, err = ImportBundle(dir, bytes.NewReader(bundle.Bytes()), "", nil)
+	assert.Equal(t, err, ErrInvalidPackageId, "")
+
+	def.Id = "../x"
+	bundle.Reset()
+	assert.Nil(t, WriteBundle("../tests", def, &bundle))
+	_, err = ImportBundle(dir, bytes.NewReader(bundle.Bytes()), "", nil)
+	assert.Equal(t, err, ErrInvalidPackageId, "")
+
+	// Nothing was written anywhere
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, len(entries), 0, "")
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "x.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBundleContentLimit(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, os.Stderr)
+
+	// Only the header is written, the size alone has to be rejected
+	// before anything is read into memory
+	var bundle bytes.Buffer
+	gw := gzip.NewWriter(&bundle)
+	tw := tar.NewWriter(gw)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: BundleTemplateDir + "bomb.tpl", Mode: 0644, Size: MaxBundleContentSize + 1}))
+	tw.Flush()
+	gw.Close()
+
+	_, err := ReadBundle(&bundle)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ErrInvalidBundle.Error())
+	assert.Contains(t, err.Error(), "contents exceed")
+
+	// Reads past the limit fail even if the headers understate them
+	lr := &bundleLimitReader{r: bytes.NewReader(make([]byte, 16)), n: 8}
+	_, err = ioutil.ReadAll(lr)
+	assert.NotNil(t, err)
+}
+
+func TestImportBundleThatDoesNotCompile(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-bundle")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	r := &Repository{packageMutex: &sync.RWMutex{}, editMutex: &sync.Mutex{}, configDirectory: dir, allowUntagged: true}
+	r.LoadPackages(nil)
+
+	var def PackageDef
+	for _, d := range ReadPackageDefs("../tests") {
+		if d.Id == "test_strict" {
+			def = d
+		}
+	}
+	good := def
+	// Templates parse but the fragment can't be loaded
+	def.TemplatesBefore = []interface{}{42}
+	var bundle bytes.Buffer
+	assert.Nil(t, WriteBundle("../tests", def, &bundle))
+
+	_, err = r.ImportBundle(&bundle, "")
+	assert.IsType(t, &PackageDefError{}, err)
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, len(entries), 0, "")
+	_, err = r.FindPackageDef("test_strict")
+	assert.Equal(t, err, ErrPackageNotFound, "")
+
+	// The id is still free for a definition that loads
+	bundle.Reset()
+	assert.Nil(t, WriteBundle("../tests", good, &bundle))
+	pkg, err := r.ImportBundle(&bundle, "")
+	assert.Nil(t, err)
+	assert.Equal(t, pkg.Id, "test_strict", "")
+	found, err := r.FindPackage("test_strict")
+	assert.Nil(t, err)
+	assert.Equal(t, found.Hash, pkg.Hash, "")
+	_, err = os.Stat(filepath.Join(dir, "conf.d", "test_strict.json"))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,244 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+)
+
+const (
+	CallbackSignatureHeader = "X-Deployd-Signature"
+	CallbackTimestampHeader = "X-Deployd-Timestamp"
+)
+
+var ErrCallbackNotAllowed = errors.New("Callback host is not allowed")
+var ErrInvalidCallback = errors.New("Callback url must be an absolute http or https url")
+
+// Delivery gives up after this many attempts, waiting twice as long
+// after every failure
+var (
+	CallbackAttempts   = 6
+	CallbackBackoff    = time.Second
+	CallbackMaxBackoff = time.Minute
+	CallbackTimeout    = 10 * time.Second
+)
+
+// One attempt at delivering a deployment's completion callback
+type CallbackAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Posts finished deployments to their callback url, requests are
+// signed with an HMAC of the timestamp and body when a secret is set
+type CallbackSender struct {
+	hosts    []string
+	secret   []byte
+	client   *http.Client
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewCallbackSender(hosts []string, secret string) *CallbackSender {
+	if len(hosts) > 0 && secret == "" {
+		log.Warning.Printf("Callback hosts are configured without a callback secret, callbacks will not be signed")
+	}
+	client := &http.Client{
+		Timeout: CallbackTimeout,
+		// Only the callback url itself was checked against the allowed
+		// hosts, a redirect must not send the deployment anywhere else
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &CallbackSender{hosts: hosts, secret: []byte(secret), client: client, stop: make(chan struct{})}
+}
+
+// Abort deliveries in flight and give up on their remaining attempts
+func (c *CallbackSender) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+func (c *CallbackSender) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Check a callback url against the allowed hosts, patterns are
+// matched against the host name like tags are, e.g. *.example.com
+func (c *CallbackSender) Validate(callbackUrl string) error {
+	u, err := url.Parse(callbackUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidCallback
+	}
+	if c == nil {
+		return ErrCallbackNotAllowed
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range c.hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return nil
+		}
+	}
+	return ErrCallbackNotAllowed
+}
+
+func (c *CallbackSender) Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver the deployment to its callback url, retrying with backoff
+// until it's accepted, the attempts run out or the sender is stopped.
+// Every attempt is recorded on the deployment.
+func (c *CallbackSender) deliver(d *Deployment, record func(CallbackAttempt)) {
+	body, err := json.Marshal(d)
+	if err != nil {
+		log.Error.Printf("Failed to encode deployment %s for its callback: %v", d.Id, err)
+		return
+	}
+
+	backoff := CallbackBackoff
+	for attempt := 1; attempt <= CallbackAttempts; attempt++ {
+		result, retry := c.post(d.CallbackUrl, body)
+		record(result)
+		if !retry {
+			return
+		}
+		if attempt < CallbackAttempts {
+			log.Info.Printf("Callback for deployment %s failed, retrying in %v", d.Id, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-c.stop:
+				log.Warning.Printf("Shutting down, giving up on the callback for deployment %s", d.Id)
+				return
+			}
+			if backoff *= 2; backoff > CallbackMaxBackoff {
+				backoff = CallbackMaxBackoff
+			}
+		}
+	}
+	log.Warning.Printf("Giving up on the callback for deployment %s after %d attempts", d.Id, CallbackAttempts)
+}
+
+// Returns the attempt and whether it's worth trying again
+func (c *CallbackSender) post(callbackUrl string, body []byte) (CallbackAttempt, bool) {
+	attempt := CallbackAttempt{At: time.Now().UTC()}
+	req, err := http.NewRequest("POST", callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+	timestamp := strconv.FormatInt(attempt.At.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	if len(c.secret) > 0 {
+		req.Header.Set(CallbackSignatureHeader, c.Sign(timestamp, body))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, true
+	}
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return attempt, false
+	}
+	attempt.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	// Other client errors won't go away by trying again
+	return attempt, resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// Start delivering the callback of a finished deployment
+func (r *Repository) sendCallback(d *Deployment) {
+	if d.CallbackUrl == "" || r.callbacks == nil {
+		return
+	}
+	if r.callbacks.stopped() {
+		log.Warning.Printf("Shutting down, the callback for deployment %s will not be sent", d.Id)
+		return
+	}
+	// Callbacks are tracked apart from deployments so retries don't hold
+	// up the drain, the body is encoded from a copy taken under the lock
+	r.mutex.Lock()
+	snapshot := *d
+	r.mutex.Unlock()
+	r.callbacksRunning.Add(1)
+	go func() {
+		defer r.callbacksRunning.Done()
+		r.callbacks.deliver(&snapshot, func(attempt CallbackAttempt) {
+			r.mutex.Lock()
+			d.CallbackAttempts = append(d.CallbackAttempts, attempt)
+			r.mutex.Unlock()
+		})
+		r.JournalDeployment(d)
+	}()
+}
+
+// Reject callback urls that are malformed or not on an allowed host
+func (r *Repository) ValidateCallback(callbackUrl string) error {
+	if callbackUrl == "" {
+		return nil
+	}
+	return r.callbacks.Validate(callbackUrl)
+}
+
+func (r *Repository) ConfigureCallbacks(hosts []string, secret string) {
+	r.callbacks = NewCallbackSender(hosts, secret)
+}
@@ -0,0 +1,128 @@
+package deployment
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbackValidate(t *testing.T) {
+	sender := NewCallbackSender([]string{"hooks.example.com", "*.ci.example.com"}, "secret")
+
+	assert.Nil(t, sender.Validate("https://hooks.example.com/deployd"))
+	assert.Nil(t, sender.Validate("http://build.ci.example.com:8080/done"))
+	assert.Equal(t, ErrCallbackNotAllowed, sender.Validate("https://example.com/"))
+	assert.Equal(t, ErrCallbackNotAllowed, sender.Validate("https://hooks.example.com.evil.org/"))
+	assert.Equal(t, ErrInvalidCallback, sender.Validate("file:///etc/passwd"))
+	assert.Equal(t, ErrInvalidCallback, sender.Validate("/relative"))
+
+	var disabled *CallbackSender
+	assert.Equal(t, ErrCallbackNotAllowed, disabled.Validate("https://hooks.example.com/"))
+}
+
+func TestCallbackDeliver(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	CallbackBackoff = time.Millisecond
+	defer func() { CallbackBackoff = time.Second }()
+
+	sender := NewCallbackSender([]string{"127.0.0.1"}, "secret")
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, sender.Sign(r.Header.Get(CallbackTimestampHeader), body), r.Header.Get(CallbackSignatureHeader))
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	d := &Deployment{Id: "a", Status: STATUS_COMPLETE, CallbackUrl: server.URL + "/hook"}
+	assert.Nil(t, sender.Validate(d.CallbackUrl))
+	var attempts []CallbackAttempt
+	sender.deliver(d, func(attempt CallbackAttempt) {
+		attempts = append(attempts, attempt)
+	})
+
+	assert.Len(t, attempts, 3)
+	assert.Equal(t, http.StatusServiceUnavailable, attempts[0].StatusCode)
+	assert.NotEmpty(t, attempts[0].Error)
+	assert.Equal(t, http.StatusNoContent, attempts[2].StatusCode)
+	assert.Empty(t, attempts[2].Error)
+}
+
+func TestCallbackDeliverPermanentFailure(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	sender := NewCallbackSender([]string{"127.0.0.1"}, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(CallbackSignatureHeader))
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	var attempts []CallbackAttempt
+	sender.deliver(&Deployment{Id: "a", CallbackUrl: server.URL}, func(attempt CallbackAttempt) {
+		attempts = append(attempts, attempt)
+	})
+	assert.Len(t, attempts, 1)
+	assert.Equal(t, http.StatusGone, attempts[0].StatusCode)
+}
+
+func TestCallbackDoesNotFollowRedirects(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	sender := NewCallbackSender([]string{"127.0.0.1"}, "secret")
+	var leaked int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&leaked, 1)
+	}))
+	defer internal.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+"/admin", http.StatusFound)
+	}))
+	defer server.Close()
+
+	var attempts []CallbackAttempt
+	sender.deliver(&Deployment{Id: "a", CallbackUrl: server.URL}, func(attempt CallbackAttempt) {
+		attempts = append(attempts, attempt)
+	})
+	assert.Len(t, attempts, 1)
+	assert.Equal(t, http.StatusFound, attempts[0].StatusCode)
+	assert.NotEmpty(t, attempts[0].Error)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&leaked))
+}
+
+func TestShutdownStopsCallbackRetries(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	CallbackBackoff = time.Minute
+	defer func() { CallbackBackoff = time.Second }()
+
+	attempted := make(chan struct{}, CallbackAttempts)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempted <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	r := &Repository{mutex: &sync.Mutex{}, running: &sync.WaitGroup{}, callbacksRunning: &sync.WaitGroup{}, journalWrites: &sync.WaitGroup{}}
+	r.ConfigureCallbacks([]string{"127.0.0.1"}, "secret")
+	d := &Deployment{Id: "a", Status: STATUS_COMPLETE, CallbackUrl: server.URL}
+	r.sendCallback(d)
+	<-attempted
+
+	start := time.Now()
+	assert.True(t, r.Shutdown(time.Minute))
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.Len(t, d.CallbackAttempts, 1)
+
+	// Nothing is sent once we are shutting down
+	r.sendCallback(&Deployment{Id: "b", Status: STATUS_COMPLETE, CallbackUrl: server.URL})
+	assert.Len(t, attempted, 0)
+}
@@ -0,0 +1,136 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// File extensions that package definitions can be loaded from
+var PackageDefExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// TOML documents can't have a top level array, so packages
+// are declared as an array of tables: [[package]]
+type tomlPackageDefs struct {
+	Packages PackageDefs `toml:"package"`
+}
+
+// Parse package definitions based on the extension of the file
+// they were read from. Errors carry the line of the definition
+// that failed where the decoder is able to provide one.
+func parsePackageDefs(file string, data []byte) (PackageDefs, error) {
+	var defs PackageDefs
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &defs); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		var tDefs tomlPackageDefs
+		if _, err := toml.Decode(string(data), &tDefs); err != nil {
+			return nil, err
+		}
+		defs = tDefs.Packages
+	default:
+		if err := json.Unmarshal(data, &defs); err != nil {
+			return nil, jsonErrorPosition(data, err)
+		}
+	}
+
+	// YAML decodes nested maps with interface{} keys, the polymorphic
+	// fragment and watch fields expect the same shapes JSON produces
+	for idx := range defs {
+		defs[idx].TemplatesBefore = normalizeDefList(defs[idx].TemplatesBefore)
+		defs[idx].TemplatesAfter = normalizeDefList(defs[idx].TemplatesAfter)
+		defs[idx].PrependBefore = normalizeDefList(defs[idx].PrependBefore)
+		defs[idx].AppendBefore = normalizeDefList(defs[idx].AppendBefore)
+		defs[idx].PrependAfter = normalizeDefList(defs[idx].PrependAfter)
+		defs[idx].AppendAfter = normalizeDefList(defs[idx].AppendAfter)
+		defs[idx].TemplatesUndeploy = normalizeDefList(defs[idx].TemplatesUndeploy)
+		for tidx := range defs[idx].Templates {
+			defs[idx].Templates[tidx].Before = normalizeDef(defs[idx].Templates[tidx].Before)
+			defs[idx].Templates[tidx].After = normalizeDef(defs[idx].Templates[tidx].After)
+			defs[idx].Templates[tidx].Watch = normalizeDef(defs[idx].Templates[tidx].Watch)
+		}
+	}
+	return defs, nil
+}
+
+func normalizeDefList(defs []interface{}) []interface{} {
+	for idx, def := range defs {
+		defs[idx] = normalizeDef(def)
+	}
+	return defs
+}
+
+func normalizeDef(def interface{}) interface{} {
+	switch val := def.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			result[fmt.Sprintf("%v", key)] = normalizeDef(item)
+		}
+		return result
+	case map[string]interface{}:
+		for key, item := range val {
+			val[key] = normalizeDef(item)
+		}
+		return val
+	case []map[string]interface{}:
+		result := make([]interface{}, len(val))
+		for idx, item := range val {
+			result[idx] = normalizeDef(item)
+		}
+		return result
+	case []interface{}:
+		return normalizeDefList(val)
+	}
+	return def
+}
+
+// encoding/json only reports a byte offset, translate it into
+// a line and column so it matches the YAML and TOML errors
+func jsonErrorPosition(data []byte, err error) error {
+	var offset int64
+	switch jerr := err.(type) {
+	case *json.SyntaxError:
+		offset = jerr.Offset
+	case *json.UnmarshalTypeError:
+		offset = jerr.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndex(data[:offset], []byte("\n"))
+	return fmt.Errorf("line %d, column %d: %v", line, column, err)
+}
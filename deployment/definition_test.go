@@ -0,0 +1,52 @@
+package deployment
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePackageDefs(t *testing.T) {
+	for _, file := range []string{"../tests/conf.d/complete_package.yaml", "../tests/conf.d/complete_package.toml"} {
+		data, err := ioutil.ReadFile(file)
+		assert.Nil(t, err, file)
+		defs, err := parsePackageDefs(file, data)
+		assert.Nil(t, err, file)
+		assert.Equal(t, len(defs), 1, file)
+
+		def := defs[0]
+		assert.Equal(t, def.Tags, []string{"web"}, file)
+		assert.Equal(t, len(def.TemplatesBefore), 2, file)
+		assert.Equal(t, def.TemplatesBefore[0], "mkdir -p /tmp/deployd", file)
+		fragment, ok := def.TemplatesBefore[1].(map[string]interface{})
+		assert.True(t, ok, file)
+		assert.Equal(t, fragment["check"], "test ! -d /tmp/deployd/{{.service_id}}", file)
+
+		assert.Equal(t, len(def.Templates), 2, file)
+		assert.Equal(t, def.Templates[0].After, "echo \"Command Complete\"", file)
+		after, ok := def.Templates[1].After.([]interface{})
+		assert.True(t, ok, file)
+		assert.Equal(t, len(after), 2, file)
+		_, ok = after[1].(map[string]interface{})
+		assert.True(t, ok, file)
+		watch, ok := def.Templates[1].Watch.([]interface{})
+		assert.True(t, ok, file)
+		assert.Equal(t, len(watch), 1, file)
+	}
+}
+
+func TestParsePackageDefsErrorLine(t *testing.T) {
+	_, err := parsePackageDefs("broken.json", []byte("[\n  {\n    \"id\": \"x\",\n  }\n]"))
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "line 4"), err.Error())
+
+	_, err = parsePackageDefs("broken.yaml", []byte("- id: x\n  templates: nope\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+
+	_, err = parsePackageDefs("broken.toml", []byte("[[package]]\nid = \"x\"\nstrict = maybe\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 3")
+}
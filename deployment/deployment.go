@@ -30,6 +30,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/cchamplin/deployd/log"
 	//"strings"
@@ -39,12 +40,27 @@ import (
 type Deployment struct {
 	Id            string            `json:"id"`
 	PackageId     string            `json:"packageId"`
+	PackageHash   string            `json:"packageHash,omitempty"`
+	Tags          []string          `json:"tags"`
 	StatusMessage string            `json:"statusMessage"`
 	Status        string            `json:"status"`
 	Variables     map[string]string `json:"replacements"`
 	Watch         bool              `json:"watch"`
 	Template      string            `json:"template"`
 	EstComplete   int64             `json:"estComplete"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	StartedAt     *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time        `json:"finishedAt,omitempty"`
+	// Set when the deployment re-runs an earlier one
+	RedeployOf  string `json:"redeployOf,omitempty"`
+	RequestedBy string `json:"requestedBy,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	// Posted the deployment once it is COMPLETE or FAILED
+	CallbackUrl      string            `json:"callbackUrl,omitempty"`
+	CallbackAttempts []CallbackAttempt `json:"callbackAttempts,omitempty"`
+	// Set on the members of a batch
+	BatchId    string `json:"batchId,omitempty"`
+	BatchIndex int    `json:"batchIndex,omitempty"`
 }
 
 const (
@@ -53,6 +69,9 @@ const (
 	STATUS_REPLICATING = "REPLICATING"
 	STATUS_COMPLETE    = "COMPLETE"
 	STATUS_FAILED      = "FAILED"
+	STATUS_UNDEPLOYING = "UNDEPLOYING"
+	STATUS_UNDEPLOYED  = "UNDEPLOYED"
+	STATUS_CANCELLED   = "CANCELLED"
 )
 
 type DeploymentNotifier interface {
@@ -67,47 +86,39 @@ func (d *Deployment) Deploy(p *Package, notifier DeploymentNotifier) {
 	log.Info.Printf("Deploying %s", p.Name)
 	metric := p.metrics.StartMeasure()
 	defer p.metrics.StopMeasure(metric)
+	d.started()
 	d.StatusMessage = "Running initialization commands"
 	d.Status = STATUS_WORKING
 	d.EstComplete = 0
 	if ok := d.handleExecutionFragments(p.TemplatesBefore, p); !ok {
-		if notifier != nil {
-			notifier.DeploymentFailed(d)
-		}
+		d.failed(notifier)
 		return
 	}
 
 	if ok := d.handleTemplates(p, notifier); !ok {
-		if notifier != nil {
-			notifier.DeploymentFailed(d)
-		}
+		d.failed(notifier)
 		return
 	}
 
 	d.StatusMessage = "Running finalization commands"
 	if ok := d.handleExecutionFragments(p.TemplatesAfter, p); !ok {
-		if notifier != nil {
-			notifier.DeploymentFailed(d)
-		}
+		d.failed(notifier)
 		return
 	}
 
 	d.StatusMessage = "Package Deployed"
 	d.Status = STATUS_COMPLETE
-	if notifier != nil {
-		notifier.DeploymentComplete(d)
-	}
+	d.completed(notifier)
 }
 
 func (d *Deployment) DeployTemplate(p *Package, notifier DeploymentNotifier, templateName string) {
 	log.Info.Printf("Deploying %s:%s", p.Name, templateName)
+	d.started()
 
 	for i := 0; i < len(p.Templates); i++ {
 		if p.Templates[i].Src == templateName {
 			if ok := d.handleTemplate(p.Templates[i], p, notifier); !ok {
-				if notifier != nil {
-					notifier.DeploymentFailed(d)
-				}
+				d.failed(notifier)
 				return
 			}
 			break
@@ -116,6 +127,29 @@ func (d *Deployment) DeployTemplate(p *Package, notifier DeploymentNotifier, tem
 
 	d.StatusMessage = "Package Template Deployed"
 	d.Status = STATUS_COMPLETE
+	d.completed(notifier)
+}
+
+func (d *Deployment) started() {
+	now := time.Now().UTC()
+	d.StartedAt = &now
+	d.FinishedAt = nil
+}
+
+func (d *Deployment) finished() {
+	now := time.Now().UTC()
+	d.FinishedAt = &now
+}
+
+func (d *Deployment) failed(notifier DeploymentNotifier) {
+	d.finished()
+	if notifier != nil {
+		notifier.DeploymentFailed(d)
+	}
+}
+
+func (d *Deployment) completed(notifier DeploymentNotifier) {
+	d.finished()
 	if notifier != nil {
 		notifier.DeploymentComplete(d)
 	}
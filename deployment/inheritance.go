@@ -0,0 +1,168 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Resolve package definitions that extend another package into
+// complete definitions. This happens once when packages are loaded,
+// children are flattened so nothing downstream needs to know about
+// inheritance. Packages with a missing parent or an inheritance
+// cycle are dropped and reported in the returned errors.
+func resolvePackageDefs(defs PackageDefs) (PackageDefs, []error) {
+	var errs []error
+	byId := make(map[string]*PackageDef, len(defs))
+	for idx := range defs {
+		if _, exists := byId[defs[idx].Id]; exists {
+			// TODO figure out how to handle duplicate package ids
+			continue
+		}
+		byId[defs[idx].Id] = &defs[idx]
+	}
+
+	resolved := make(map[string]*PackageDef, len(defs))
+	failed := make(map[string]error)
+	var resolve func(id string, chain []string) (*PackageDef, error)
+	resolve = func(id string, chain []string) (*PackageDef, error) {
+		if def, ok := resolved[id]; ok {
+			return def, nil
+		}
+		if err, ok := failed[id]; ok {
+			return nil, err
+		}
+		for idx, seen := range chain {
+			if seen == id {
+				return nil, fmt.Errorf("package %s has an inheritance cycle: %s", chain[0], strings.Join(append(chain[idx:], id), " -> "))
+			}
+		}
+		def := byId[id]
+		if def.Extends == "" {
+			resolved[id] = def
+			return def, nil
+		}
+
+		chain = append(chain, id)
+		parentDef, ok := byId[def.Extends]
+		if !ok {
+			err := fmt.Errorf("package %s extends unknown package %s (%s)", id, def.Extends, def.source)
+			failed[id] = err
+			return nil, err
+		}
+		parent, err := resolve(parentDef.Id, chain)
+		if err != nil {
+			if len(chain) == 1 {
+				err = fmt.Errorf("package %s can't extend %s: %v", id, def.Extends, err)
+			}
+			failed[id] = err
+			return nil, err
+		}
+		child := extendPackageDef(parent, def)
+		resolved[id] = &child
+		return &child, nil
+	}
+
+	var result PackageDefs
+	for idx := range defs {
+		if byId[defs[idx].Id] != &defs[idx] {
+			// Duplicates are passed through untouched
+			result = append(result, defs[idx])
+			continue
+		}
+		def, err := resolve(defs[idx].Id, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result = append(result, *def)
+	}
+	return result, errs
+}
+
+// Build a child definition on top of an already resolved parent.
+// Metadata set on the child replaces the parent's, templates with
+// the same src replace the parent's template in place and new
+// templates are added after the inherited ones.
+func extendPackageDef(parent *PackageDef, child *PackageDef) PackageDef {
+	result := *child
+
+	if result.Name == "" {
+		result.Name = parent.Name
+	}
+	if result.Version == "" {
+		result.Version = parent.Version
+	}
+	if result.Strict == nil {
+		result.Strict = parent.Strict
+	}
+	if result.Tag == "" && len(result.Tags) == 0 {
+		result.Tag = parent.Tag
+		result.Tags = parent.Tags
+	}
+
+	result.Templates = make([]TemplateDef, 0, len(parent.Templates)+len(child.Templates))
+	overrides := make(map[string]TemplateDef, len(child.Templates))
+	for _, tmpl := range child.Templates {
+		overrides[tmpl.Src] = tmpl
+	}
+	for _, tmpl := range parent.Templates {
+		if override, ok := overrides[tmpl.Src]; ok {
+			tmpl = override
+			delete(overrides, tmpl.Src)
+		}
+		result.Templates = append(result.Templates, tmpl)
+	}
+	for _, tmpl := range child.Templates {
+		if _, ok := overrides[tmpl.Src]; ok {
+			result.Templates = append(result.Templates, tmpl)
+		}
+	}
+
+	// A child's own template_before/template_after/template_undeploy
+	// replace the parent's
+	if result.TemplatesBefore == nil {
+		result.TemplatesBefore = parent.TemplatesBefore
+	}
+	if result.TemplatesAfter == nil {
+		result.TemplatesAfter = parent.TemplatesAfter
+	}
+	if result.TemplatesUndeploy == nil {
+		result.TemplatesUndeploy = parent.TemplatesUndeploy
+	}
+	result.TemplatesBefore = joinFragmentDefs(child.PrependBefore, result.TemplatesBefore, child.AppendBefore)
+	result.TemplatesAfter = joinFragmentDefs(child.PrependAfter, result.TemplatesAfter, child.AppendAfter)
+	result.PrependBefore = nil
+	result.AppendBefore = nil
+	result.PrependAfter = nil
+	result.AppendAfter = nil
+	return result
+}
+
+func joinFragmentDefs(prepend []interface{}, defs []interface{}, appended []interface{}) []interface{} {
+	result := make([]interface{}, 0, len(prepend)+len(defs)+len(appended))
+	result = append(result, prepend...)
+	result = append(result, defs...)
+	return append(result, appended...)
+}
@@ -0,0 +1,80 @@
+package deployment
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvePackageDefs(t *testing.T) {
+	strict := true
+	defs := PackageDefs{
+		{
+			Id:              "php-dev",
+			Name:            "PHP-dev",
+			Version:         "0.1",
+			Strict:          &strict,
+			Tags:            []string{"web"},
+			TemplatesBefore: []interface{}{"mkdir -p /tmp/deployd"},
+			TemplatesAfter:  []interface{}{"echo done"},
+			Templates: []TemplateDef{
+				{Src: "activator.socket", Dest: "/tmp/a.socket"},
+				{Src: "php.service", Dest: "/tmp/php.service"},
+			},
+		},
+		{
+			Id:            "php-prod",
+			Name:          "PHP-prod",
+			Extends:       "php-staging",
+			PrependBefore: []interface{}{"echo prod"},
+			Templates: []TemplateDef{
+				{Src: "php.service", Dest: "/etc/php.service"},
+				{Src: "cron", Dest: "/etc/cron.d/php"},
+			},
+		},
+		{
+			Id:           "php-staging",
+			Extends:      "php-dev",
+			AppendAfter:  []interface{}{map[string]interface{}{"cmd": "echo staged"}},
+			PrependAfter: []interface{}{"echo staging"},
+		},
+	}
+	resolved, errs := resolvePackageDefs(defs)
+	assert.Equal(t, len(errs), 0, "")
+	assert.Equal(t, len(resolved), 3, "")
+
+	prod := resolved[1]
+	assert.Equal(t, prod.Id, "php-prod", "")
+	assert.Equal(t, prod.Name, "PHP-prod", "")
+	assert.Equal(t, prod.Version, "0.1", "")
+	assert.Equal(t, *prod.Strict, true, "")
+	assert.Equal(t, prod.Tags, []string{"web"}, "")
+	assert.Equal(t, len(prod.Templates), 3, "")
+	assert.Equal(t, prod.Templates[0].Dest, "/tmp/a.socket", "")
+	assert.Equal(t, prod.Templates[1].Dest, "/etc/php.service", "")
+	assert.Equal(t, prod.Templates[2].Src, "cron", "")
+	assert.Equal(t, prod.TemplatesBefore, []interface{}{"echo prod", "mkdir -p /tmp/deployd"}, "")
+	assert.Equal(t, len(prod.TemplatesAfter), 3, "")
+	assert.Equal(t, prod.TemplatesAfter[0], "echo staging", "")
+	assert.Equal(t, prod.TemplatesAfter[1], "echo done", "")
+
+	// The parent is left untouched
+	assert.Equal(t, len(resolved[0].Templates), 2, "")
+	assert.Equal(t, resolved[0].Templates[1].Dest, "/tmp/php.service", "")
+}
+
+func TestResolvePackageDefsErrors(t *testing.T) {
+	defs := PackageDefs{
+		{Id: "a", Extends: "b"},
+		{Id: "b", Extends: "a"},
+		{Id: "c", Extends: "missing"},
+		{Id: "d"},
+	}
+	resolved, errs := resolvePackageDefs(defs)
+	assert.Equal(t, len(resolved), 1, "")
+	assert.Equal(t, resolved[0].Id, "d", "")
+	assert.Equal(t, len(errs), 3, "")
+	assert.True(t, strings.Contains(errs[0].Error(), "a -> b -> a"), errs[0].Error())
+	assert.True(t, strings.Contains(errs[2].Error(), "unknown package missing"), errs[2].Error())
+}
@@ -23,9 +23,10 @@
 package deployment
 
 import (
-	"os"
+	"io/ioutil"
 	"path/filepath"
 	GoTemplate "text/template"
+	"time"
 
 	"github.com/cchamplin/deployd/log"
 	"github.com/cchamplin/deployd/metrics"
@@ -35,25 +36,42 @@ import (
 type GoTemplateList map[string]*GoTemplate.Template
 
 type PackageDef struct {
-	Id              string        `json:"id"`
-	Tag             string        `json:"tag"`
-	Name            string        `json:"name"`
-	Version         string        `json:"version"`
-	Strict          bool          `json:"strict"`
-	Templates       []TemplateDef `json:"templates"`
-	TemplatesBefore []interface{} `json:"template_before"`
-	TemplatesAfter  []interface{} `json:"template_after"`
+	Id              string        `json:"id" yaml:"id" toml:"id"`
+	Tag             string        `json:"tag" yaml:"tag" toml:"tag"`
+	Tags            []string      `json:"tags" yaml:"tags" toml:"tags"`
+	Name            string        `json:"name" yaml:"name" toml:"name"`
+	Version         string        `json:"version" yaml:"version" toml:"version"`
+	Strict          *bool         `json:"strict" yaml:"strict" toml:"strict"`
+	Extends         string        `json:"extends,omitempty" yaml:"extends" toml:"extends"`
+	Templates       []TemplateDef `json:"templates" yaml:"templates" toml:"templates"`
+	TemplatesBefore []interface{} `json:"template_before" yaml:"template_before" toml:"template_before"`
+	TemplatesAfter  []interface{} `json:"template_after" yaml:"template_after" toml:"template_after"`
+	// Only used by packages that extend another package, fragments
+	// are added around the inherited template_before/template_after
+	PrependBefore []interface{} `json:"template_before_prepend,omitempty" yaml:"template_before_prepend" toml:"template_before_prepend"`
+	AppendBefore  []interface{} `json:"template_before_append,omitempty" yaml:"template_before_append" toml:"template_before_append"`
+	PrependAfter  []interface{} `json:"template_after_prepend,omitempty" yaml:"template_after_prepend" toml:"template_after_prepend"`
+	AppendAfter   []interface{} `json:"template_after_append,omitempty" yaml:"template_after_append" toml:"template_after_append"`
+	// Shell commands run when a deployment of the package is undone
+	TemplatesUndeploy []interface{} `json:"template_undeploy,omitempty" yaml:"template_undeploy" toml:"template_undeploy"`
+	source            string
+	// Template bodies for packages loaded from a PackageSource
+	templateBodies map[string]string
 }
 
 type Package struct {
 	Id                 string             `json:"id"`
 	Tag                string             `json:"tag"`
+	Tags               []string           `json:"tags"`
 	Name               string             `json:"name"`
 	Version            string             `json:"version"`
 	Strict             bool               `json:"strict"`
+	Extends            string             `json:"extends,omitempty"`
+	Hash               string             `json:"hash"`
 	Templates          []*Template        `json:"templates"`
 	TemplatesBefore    ExecutionFragments `json:"template_before"`
 	TemplatesAfter     ExecutionFragments `json:"template_after"`
+	TemplatesUndeploy  ExecutionFragments `json:"template_undeploy,omitempty"`
 	ProcessedTemplates GoTemplateList
 	metrics            *metrics.Metrics
 }
@@ -62,7 +80,7 @@ type Packages []Package
 type PackageDefs []PackageDef
 
 // Callback from REST handler
-func (p *Package) DeployPackage(r *Repository, replacements map[string]string, watch bool) *Deployment {
+func (p *Package) DeployPackage(r *Repository, replacements map[string]string, watch bool, callbackUrl string) *Deployment {
 
 	// Every deployment gets a new UUID
 	u1 := uuid.NewV4().String()
@@ -72,7 +90,7 @@ func (p *Package) DeployPackage(r *Repository, replacements map[string]string, w
 	replacements["__packageId"] = p.Id
 	replacements["__deploymentId"] = u1
 
-	deployment := Deployment{Id: u1, PackageId: p.Id, Status: "NOT STARTED", StatusMessage: "Not Started", Variables: replacements, Watch: watch}
+	deployment := Deployment{Id: u1, PackageId: p.Id, PackageHash: p.Hash, Tags: p.Tags, Status: "NOT STARTED", StatusMessage: "Not Started", Variables: replacements, Watch: watch, CreatedAt: time.Now().UTC(), CallbackUrl: callbackUrl}
 
 	// This should possibly be moved to somewhere else
 	r.AddDeployment(&deployment)
@@ -81,7 +99,7 @@ func (p *Package) DeployPackage(r *Repository, replacements map[string]string, w
 	log.Trace.Printf("Starting deployment %s of %s", u1, p.Name)
 
 	// Start go routine for this deployment
-	go deployment.Deploy(p, r)
+	r.run(&deployment, func() { deployment.Deploy(p, r) })
 	return &deployment
 }
 
@@ -102,10 +120,19 @@ func (p *Package) ReDeployPackage(r *Repository, d *Deployment) *Deployment {
 	log.Trace.Printf("Starting re-deployment %s of %s", d.Id, p.Name)
 
 	// Start go routine for this deployment
-	go d.Deploy(p, r)
+	r.run(d, func() { d.Deploy(p, r) })
 	return d
 }
 
+func (p *Package) HasTemplate(name string) bool {
+	for _, tmpl := range p.Templates {
+		if tmpl.Src == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Deploy a single template file from a Package
 // TODO Should this require an existing deployment id?
 // Probably yes.
@@ -113,7 +140,7 @@ func (p *Package) ReDeployPackage(r *Repository, d *Deployment) *Deployment {
 // without deploying a whole package worthwhile and not too
 // dangerous? We may be breaking assumptions that Package
 // creators have about the state of a deployment
-func (p *Package) DeployPackageTemplate(r *Repository, templateName string, replacements map[string]string, watch bool) *Deployment {
+func (p *Package) DeployPackageTemplate(r *Repository, templateName string, replacements map[string]string, watch bool, callbackUrl string) *Deployment {
 
 	// Every deployment gets a new UUID
 	u1 := uuid.NewV4().String()
@@ -123,7 +150,7 @@ func (p *Package) DeployPackageTemplate(r *Repository, templateName string, repl
 	replacements["__packageId"] = p.Id
 	replacements["__deploymentId"] = u1
 
-	deployment := Deployment{Id: u1, PackageId: p.Id, Status: "NOT STARTED", StatusMessage: "Not Started", Variables: replacements, Watch: watch, Template: templateName}
+	deployment := Deployment{Id: u1, PackageId: p.Id, PackageHash: p.Hash, Tags: p.Tags, Status: "NOT STARTED", StatusMessage: "Not Started", Variables: replacements, Watch: watch, Template: templateName, CreatedAt: time.Now().UTC(), CallbackUrl: callbackUrl}
 
 	// This should possibly be moved to somewhere else
 	// TODO should individual template deployements
@@ -136,7 +163,7 @@ func (p *Package) DeployPackageTemplate(r *Repository, templateName string, repl
 	log.Trace.Printf("Starting deployment %s of %s:%s", u1, p.Name, templateName)
 
 	// Start go routine for this deployment
-	go deployment.DeployTemplate(p, r, templateName)
+	r.run(&deployment, func() { deployment.DeployTemplate(p, r, templateName) })
 	return &deployment
 }
 
@@ -157,7 +184,7 @@ func (p *Package) ReDeployPackageTemplate(r *Repository, d *Deployment) *Deploym
 	log.Trace.Printf("Starting re-deployment %s of %s:%s", d.Id, p.Name, d.Template)
 
 	// Start go routine for this deployment
-	go d.DeployTemplate(p, r, d.Template)
+	r.run(d, func() { d.DeployTemplate(p, r, d.Template) })
 	return d
 }
 
@@ -169,24 +196,26 @@ func (pkg *Package) processTemplate(name string, value string, funcMap GoTemplat
 	pkg.ProcessedTemplates[name] = tmpl
 }
 
-func (pkg *Package) processTemplateFile(configDirectory string, name string, value string, funcMap GoTemplate.FuncMap) error {
-	var tmpl *GoTemplate.Template
-
+// Returns the contents of the template file so they can be
+// included in the package hash
+func (pkg *Package) processTemplateFile(configDirectory string, name string, value string, funcMap GoTemplate.FuncMap) (string, error) {
 	// Template files can be absolute or live locally under the
 	// configuration directory in /tpl
-	if filepath.IsAbs(value) {
-		if _, err := os.Stat(value); err != nil {
-			return err
-		}
-		tmpl = GoTemplate.Must(GoTemplate.New(name).Funcs(funcMap).ParseFiles(value))
-	} else {
+	if !filepath.IsAbs(value) {
 		value = configDirectory + "/tpl/" + value
-		if _, err := os.Stat(value); err != nil {
-			return err
-		}
-		tmpl = GoTemplate.Must(GoTemplate.New(name).Funcs(funcMap).ParseFiles(value))
 	}
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), pkg.processTemplateBody(name, string(data), funcMap)
+}
 
+func (pkg *Package) processTemplateBody(name string, value string, funcMap GoTemplate.FuncMap) error {
+	tmpl, err := GoTemplate.New(name).Funcs(funcMap).Parse(value)
+	if err != nil {
+		return err
+	}
 	// See above
 	tmpl.Option("missingkey=error")
 	pkg.ProcessedTemplates[name] = tmpl
@@ -0,0 +1,186 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+)
+
+// Implemented by cluster backends that can share package definitions
+// between machines so they don't drift apart
+type PackageSource interface {
+	SharesPackages() bool
+	// Package definition documents keyed by name, the extension of
+	// the name selects the format the same way it does for conf.d
+	PackageDefinitions() map[string]string
+	// Template bodies keyed by file name, e.g. php.service.tpl
+	PackageTemplates() map[string]string
+	WatchPackages(callback func())
+}
+
+var ErrPackageMismatch = errors.New("Package definition does not match the deployment")
+
+// Changes to shared definitions usually come in bursts, wait for
+// them to settle before reloading
+var PackageReloadDelay = 2 * time.Second
+
+// Local definitions combined with the ones shared through the
+// package source, shared definitions replace local ones with
+// the same id
+func (r *Repository) readAllPackageDefs() PackageDefs {
+	local := readLocalPackageDefs(r.configDirectory)
+	if r.packageSource == nil {
+		return r.resolveDefs(local)
+	}
+
+	shared := readSourcePackageDefs(r.packageSource)
+	sharedIds := make(map[string]bool, len(shared))
+	for _, def := range shared {
+		sharedIds[def.Id] = true
+	}
+	tDefs := shared
+	for _, def := range local {
+		if sharedIds[def.Id] {
+			log.Info.Printf("Package %s from %s is replaced by the shared definition", def.Id, def.source)
+			continue
+		}
+		tDefs = append(tDefs, def)
+	}
+	return r.resolveDefs(tDefs)
+}
+
+func (r *Repository) resolveDefs(tDefs PackageDefs) PackageDefs {
+	tDefs, errs := resolvePackageDefs(tDefs)
+	for _, err := range errs {
+		log.Warning.Printf("Package could not be loaded: %v", err)
+	}
+	return tDefs
+}
+
+func readSourcePackageDefs(source PackageSource) PackageDefs {
+	var tDefs PackageDefs
+	templates := source.PackageTemplates()
+	for key, value := range source.PackageDefinitions() {
+		data := bytes.TrimSpace([]byte(value))
+		// Allow a single package per key without wrapping it in a list
+		if path.Ext(key) == "" || path.Ext(key) == ".json" {
+			if len(data) > 0 && data[0] == '{' {
+				data = append(append([]byte("["), data...), ']')
+			}
+		}
+		defs, err := parsePackageDefs(key, data)
+		if err != nil {
+			log.Warning.Printf("Failed to parse shared package definition %s: %v", key, err)
+			continue
+		}
+		for idx := range defs {
+			defs[idx].source = "backend:" + key
+			defs[idx].templateBodies = templates
+		}
+		tDefs = append(tDefs, defs...)
+	}
+	log.Trace.Printf("Read %d shared package definitions", len(tDefs))
+	return tDefs
+}
+
+// Reload every package definition, packages that are already
+// running a deployment keep the copy they started with
+func (r *Repository) ReloadPackages() {
+	tDefs := r.readAllPackageDefs()
+	packages := r.compilePackages(tDefs, r.funcMap)
+	r.packageMutex.Lock()
+	r.packageDefs = tDefs
+	r.packages = packages
+	r.packageMutex.Unlock()
+	log.Info.Printf("Reloaded %d packages", len(packages))
+}
+
+func (r *Repository) scheduleReload() {
+	r.packageMutex.Lock()
+	defer r.packageMutex.Unlock()
+	if r.reloadTimer != nil {
+		r.reloadTimer.Stop()
+	}
+	r.reloadTimer = time.AfterFunc(PackageReloadDelay, r.ReloadPackages)
+}
+
+// Run a deployment forwarded from another machine, which happens
+// during recovery. The deployment is refused unless our copy of the
+// package is identical to the one it was originally deployed from.
+func (r *Repository) AcceptDeployment(d *Deployment) error {
+	pkg, err := r.FindPackage(d.PackageId)
+	if err != nil {
+		return err
+	}
+	// Every deployment records the hash of its package, one without
+	// a hash can't be verified
+	if d.PackageHash == "" {
+		log.Warning.Printf("Refusing deployment %s of %s: it has no package hash", d.Id, d.PackageId)
+		return ErrPackageMismatch
+	}
+	if d.PackageHash != pkg.Hash {
+		log.Warning.Printf("Refusing deployment %s of %s: package hash %s does not match %s", d.Id, d.PackageId, d.PackageHash, pkg.Hash)
+		return ErrPackageMismatch
+	}
+	if _, err := r.FindDeployment(d.Id); err == nil {
+		log.Info.Printf("Deployment %s was already forwarded to us", d.Id)
+		return nil
+	}
+
+	r.JournalDeployment(d)
+	if d.Template == "" {
+		pkg.ReDeployPackage(r, d)
+	} else {
+		pkg.ReDeployPackageTemplate(r, d)
+	}
+	return nil
+}
+
+// Hash of the resolved definition and every template body it uses,
+// machines with the same hash will deploy the package identically
+func packageHash(def PackageDef, bodies map[string]string) string {
+	hash := sha256.New()
+	data, _ := json.Marshal(def)
+	hash.Write(data)
+	names := make([]string, 0, len(bodies))
+	for name := range bodies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hash.Write([]byte{0})
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+		hash.Write([]byte(bodies[name]))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,68 @@
+package deployment
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPackageSource struct {
+	definitions map[string]string
+	templates   map[string]string
+}
+
+func (s testPackageSource) SharesPackages() bool                  { return true }
+func (s testPackageSource) PackageDefinitions() map[string]string { return s.definitions }
+func (s testPackageSource) PackageTemplates() map[string]string   { return s.templates }
+func (s testPackageSource) WatchPackages(callback func())         {}
+
+func TestReadSourcePackageDefs(t *testing.T) {
+	source := testPackageSource{
+		definitions: map[string]string{
+			"php":        `{"id": "php", "name": "PHP", "templates": [{"src": "php.service", "dest": "/tmp/php.service"}]}`,
+			"nginx.yaml": "- id: nginx\n  name: Nginx\n  tags: [web]\n",
+			"broken":     `{"id": `,
+		},
+		templates: map[string]string{"php.service.tpl": "[Service]"},
+	}
+
+	defs := readSourcePackageDefs(source)
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Id < defs[j].Id })
+	assert.Len(t, defs, 2)
+	assert.Equal(t, "nginx", defs[0].Id)
+	assert.Equal(t, []string{"web"}, defs[0].Tags)
+	assert.Equal(t, "php", defs[1].Id)
+	assert.Equal(t, "backend:php", defs[1].source)
+	assert.Equal(t, "[Service]", defs[1].templateBodies["php.service.tpl"])
+}
+
+func TestPackageHash(t *testing.T) {
+	def := PackageDef{Id: "php", Name: "PHP", Templates: []TemplateDef{{Src: "php.service", Dest: "/tmp/php.service"}}}
+	bodies := map[string]string{"php.service.tpl": "[Service]", "a.tpl": "a"}
+
+	hash := packageHash(def, bodies)
+	assert.Equal(t, hash, packageHash(def, map[string]string{"a.tpl": "a", "php.service.tpl": "[Service]"}))
+	assert.NotEqual(t, hash, packageHash(def, map[string]string{"php.service.tpl": "[Service]\n", "a.tpl": "a"}))
+
+	def.Name = "PHP 7"
+	assert.NotEqual(t, hash, packageHash(def, bodies))
+}
+
+func TestAcceptDeploymentVerifiesHash(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-accept")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "packages.json"), []byte(`[{"id": "php"}]`), 0644))
+	r := &Repository{packageMutex: &sync.RWMutex{}, configDirectory: dir, allowUntagged: true}
+	r.LoadPackages(nil)
+
+	assert.Equal(t, ErrPackageMismatch, r.AcceptDeployment(&Deployment{Id: "a", PackageId: "php"}))
+	assert.Equal(t, ErrPackageMismatch, r.AcceptDeployment(&Deployment{Id: "a", PackageId: "php", PackageHash: "stale"}))
+}
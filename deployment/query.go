@@ -0,0 +1,197 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 1000
+)
+
+var ErrInvalidSort = errors.New("Unknown sort field")
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Criteria for listing deployments, zero values match everything
+type DeploymentQuery struct {
+	Status    []string
+	PackageId string
+	Template  string
+	Variables map[string]string
+	// Bounds on CreatedAt, Until is exclusive
+	Since time.Time
+	Until time.Time
+	// Field to sort by, prefixed with - for descending order
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// Position of the last deployment on a page, the next page
+// starts after it
+type deploymentCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	Id   string `json:"i"`
+}
+
+// Sortable fields, times are formatted so they compare as strings
+var deploymentSortKeys = map[string]func(d *Deployment) string{
+	"createdAt":  func(d *Deployment) string { return sortableTime(&d.CreatedAt) },
+	"startedAt":  func(d *Deployment) string { return sortableTime(d.StartedAt) },
+	"finishedAt": func(d *Deployment) string { return sortableTime(d.FinishedAt) },
+	"status":     func(d *Deployment) string { return d.Status },
+	"packageId":  func(d *Deployment) string { return d.PackageId },
+	"id":         func(d *Deployment) string { return d.Id },
+}
+
+func sortableTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+func (q DeploymentQuery) matches(d *Deployment) bool {
+	if len(q.Status) > 0 {
+		found := false
+		for _, status := range q.Status {
+			if strings.EqualFold(status, d.Status) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.PackageId != "" && q.PackageId != d.PackageId {
+		return false
+	}
+	if q.Template != "" && q.Template != d.Template {
+		return false
+	}
+	for name, value := range q.Variables {
+		if actual, ok := d.Variables[name]; !ok || actual != value {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && d.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !d.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Returns a page of deployments matching the query and the cursor
+// for the next page, which is empty on the last page
+func (r *Repository) QueryDeployments(q DeploymentQuery) ([]*Deployment, string, error) {
+	sortField := q.Sort
+	if sortField == "" {
+		sortField = "createdAt"
+	}
+	descending := strings.HasPrefix(sortField, "-")
+	sortKey, ok := deploymentSortKeys[strings.TrimPrefix(sortField, "-")]
+	if !ok {
+		return nil, "", ErrInvalidSort
+	}
+
+	var after *deploymentCursor
+	if q.Cursor != "" {
+		cursor, err := decodeCursor(q.Cursor)
+		if err != nil || cursor.Sort != sortField {
+			return nil, "", ErrInvalidCursor
+		}
+		after = &cursor
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	} else if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	r.mutex.Lock()
+	var results []*Deployment
+	for _, d := range r.deployments {
+		if q.matches(d) {
+			results = append(results, d)
+		}
+	}
+	r.mutex.Unlock()
+
+	// The id breaks ties so the order is stable between requests
+	less := func(ka string, ida string, kb string, idb string) bool {
+		if ka != kb {
+			return (ka < kb) != descending
+		}
+		return (ida < idb) != descending
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return less(sortKey(results[i]), results[i].Id, sortKey(results[j]), results[j].Id)
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(results), func(i int) bool {
+			return less(after.Key, after.Id, sortKey(results[i]), results[i].Id)
+		})
+	}
+	results = results[start:]
+
+	next := ""
+	if len(results) > limit {
+		results = results[:limit]
+		last := results[limit-1]
+		next = encodeCursor(deploymentCursor{Sort: sortField, Key: sortKey(last), Id: last.Id})
+	}
+	if results == nil {
+		results = []*Deployment{}
+	}
+	return results, next, nil
+}
+
+func encodeCursor(c deploymentCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (deploymentCursor, error) {
+	var c deploymentCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
@@ -0,0 +1,80 @@
+package deployment
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func queryRepository() *Repository {
+	base := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := &Repository{mutex: &sync.Mutex{}, deployments: make(Deployments)}
+	for i, d := range []Deployment{
+		{Id: "a", PackageId: "php", Status: STATUS_COMPLETE, Variables: map[string]string{"host": "web1"}},
+		{Id: "b", PackageId: "php", Status: STATUS_FAILED, Variables: map[string]string{"host": "web2"}},
+		{Id: "c", PackageId: "nginx", Status: STATUS_COMPLETE, Template: "nginx.conf"},
+		{Id: "d", PackageId: "php", Status: STATUS_COMPLETE, Variables: map[string]string{"host": "web1"}},
+	} {
+		d := d
+		d.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		r.deployments[d.Id] = &d
+	}
+	return r
+}
+
+func deploymentIds(deployments []*Deployment) []string {
+	ids := []string{}
+	for _, d := range deployments {
+		ids = append(ids, d.Id)
+	}
+	return ids
+}
+
+func TestQueryDeploymentsFilters(t *testing.T) {
+	r := queryRepository()
+
+	results, _, err := r.QueryDeployments(DeploymentQuery{PackageId: "php", Status: []string{"complete"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "d"}, deploymentIds(results))
+
+	results, _, _ = r.QueryDeployments(DeploymentQuery{Variables: map[string]string{"host": "web1"}, Sort: "-createdAt"})
+	assert.Equal(t, []string{"d", "a"}, deploymentIds(results))
+
+	results, _, _ = r.QueryDeployments(DeploymentQuery{Template: "nginx.conf"})
+	assert.Equal(t, []string{"c"}, deploymentIds(results))
+
+	since := time.Date(2016, 5, 1, 13, 0, 0, 0, time.UTC)
+	results, _, _ = r.QueryDeployments(DeploymentQuery{Since: since, Until: since.Add(2 * time.Hour)})
+	assert.Equal(t, []string{"b", "c"}, deploymentIds(results))
+
+	results, _, _ = r.QueryDeployments(DeploymentQuery{Status: []string{STATUS_WORKING}})
+	assert.NotNil(t, results)
+	assert.Empty(t, results)
+
+	_, _, err = r.QueryDeployments(DeploymentQuery{Sort: "name"})
+	assert.Equal(t, ErrInvalidSort, err)
+}
+
+func TestQueryDeploymentsPagination(t *testing.T) {
+	r := queryRepository()
+
+	var ids []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		results, next, err := r.QueryDeployments(DeploymentQuery{Sort: "packageId", Limit: 3, Cursor: cursor})
+		assert.Nil(t, err)
+		ids = append(ids, deploymentIds(results)...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"c", "a", "b", "d"}, ids)
+
+	_, _, err := r.QueryDeployments(DeploymentQuery{Sort: "status", Cursor: cursor})
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, _, err = r.QueryDeployments(DeploymentQuery{Cursor: "not a cursor"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/satori/go.uuid"
+)
+
+var ErrTemplateNotFound = errors.New("No such template exist in package")
+
+type RedeployOptions struct {
+	// Replace individual variables of the original deployment
+	Variables map[string]string `json:"variables"`
+	// Only deploy this template instead of what the original deployed
+	Template string `json:"template"`
+	Watch    *bool  `json:"watch"`
+	// Replaces the original deployment's callback url
+	CallbackUrl string `json:"callback_url"`
+	RequestedBy string `json:"-"`
+	Reason      string `json:"reason"`
+}
+
+// Run an existing deployment again as a new deployment using its
+// stored variables, the new deployment records which one it re-runs
+func (r *Repository) Redeploy(id string, opts RedeployOptions) (*Deployment, error) {
+	original, err := r.FindDeployment(id)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := r.FindPackage(original.PackageId)
+	if err != nil {
+		return nil, err
+	}
+
+	template := original.Template
+	if opts.Template != "" {
+		template = opts.Template
+	}
+	if template != "" && !pkg.HasTemplate(template) {
+		return nil, ErrTemplateNotFound
+	}
+
+	u1 := uuid.NewV4().String()
+	variables := make(map[string]string, len(original.Variables)+len(opts.Variables))
+	for key, value := range original.Variables {
+		variables[key] = value
+	}
+	for key, value := range opts.Variables {
+		variables[key] = value
+	}
+	variables["__package"] = pkg.Name
+	variables["__packageId"] = pkg.Id
+	variables["__deploymentId"] = u1
+
+	watch := original.Watch
+	if opts.Watch != nil {
+		watch = *opts.Watch
+	}
+	callbackUrl := original.CallbackUrl
+	if opts.CallbackUrl != "" {
+		if err := r.ValidateCallback(opts.CallbackUrl); err != nil {
+			return nil, err
+		}
+		callbackUrl = opts.CallbackUrl
+	}
+
+	d := &Deployment{
+		Id:            u1,
+		PackageId:     pkg.Id,
+		PackageHash:   pkg.Hash,
+		Tags:          pkg.Tags,
+		Status:        "NOT STARTED",
+		StatusMessage: "Not Started",
+		Variables:     variables,
+		Watch:         watch,
+		Template:      template,
+		CreatedAt:     time.Now().UTC(),
+		RedeployOf:    original.Id,
+		RequestedBy:   opts.RequestedBy,
+		Reason:        opts.Reason,
+		CallbackUrl:   callbackUrl,
+	}
+	log.Info.Printf("Redeploying %s as %s for %s: %s", original.Id, d.Id, opts.RequestedBy, opts.Reason)
+
+	// Unlike ad-hoc template deployments a redeploy is always tracked
+	// so it can be followed up on
+	r.AddDeployment(d)
+	r.JournalDeployment(d)
+	if template == "" {
+		r.run(d, func() { d.Deploy(&pkg, r) })
+	} else {
+		r.run(d, func() { d.DeployTemplate(&pkg, r, template) })
+	}
+	return d, nil
+}
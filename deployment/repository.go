@@ -23,7 +23,6 @@
 package deployment
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -32,6 +31,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cchamplin/deployd/log"
 	"github.com/cchamplin/deployd/metrics"
@@ -46,8 +47,28 @@ type Repository struct {
 	mutex              *sync.Mutex
 	configDirectory    string
 	journalBackend     log.Journal
+	allowUntagged      bool
+	allowedTags        []string
+	packageDefs        PackageDefs
+	packageMutex       *sync.RWMutex
+	packageSource      PackageSource
+	reloadTimer        *time.Timer
+	funcMap            GoTemplate.FuncMap
+	replayed           int32
+	draining           int32
+	running            *sync.WaitGroup
+	callbacksRunning   *sync.WaitGroup
+	journalWrites      *sync.WaitGroup
+	callbacks          *CallbackSender
+	batches            map[string]*Batch
+	// Serializes package edits made through the API
+	editMutex *sync.Mutex
 }
 
+var ErrPackageNotFound = errors.New("No such package exist")
+var ErrPackageNotAllowed = errors.New("Package tags are not allowed on this machine")
+var ErrDeploymentNotFound = errors.New("No such deployment exist")
+
 // Give us some seed data
 // The notifier is used for the storage backend, I'm not happy with this
 // design, it'll need to be refactored
@@ -55,32 +76,134 @@ func (r *Repository) Init(configDir string, allowUntagged bool, tags []string, j
 	log.Trace.Printf("Initializing")
 	r.deploymentNotifier = notifier
 	r.mutex = &sync.Mutex{}
+	r.packageMutex = &sync.RWMutex{}
+	r.editMutex = &sync.Mutex{}
+	r.running = &sync.WaitGroup{}
+	r.callbacksRunning = &sync.WaitGroup{}
+	r.journalWrites = &sync.WaitGroup{}
 	r.configDirectory = configDir
 	r.journalBackend = journalBackend
+	r.allowUntagged = allowUntagged
+	r.allowedTags = tags
+	for _, pattern := range validTagPatterns(tags) {
+		log.Warning.Printf("Allowed tag pattern %s is invalid and will never match", pattern)
+	}
+	// The cluster backend may share package definitions between machines
+	if source, ok := notifier.(PackageSource); ok && source.SharesPackages() {
+		r.packageSource = source
+	}
 	// Load the package definitions from the config directory
 	r.LoadPackages(funcMap)
+	if r.packageSource != nil {
+		r.packageSource.WatchPackages(r.scheduleReload)
+	}
 
 	r.deployments = make(map[string]*Deployment)
+	r.batches = make(map[string]*Batch)
 
 	if r.journalBackend != nil {
 		r.LoadJournaledDeployments()
 	}
+	atomic.StoreInt32(&r.replayed, 1)
+}
+
+// Whether journaled deployments have been read back in
+func (r *Repository) Replayed() bool {
+	return atomic.LoadInt32(&r.replayed) == 1
+}
+
+func (r *Repository) PackageCount() int {
+	r.packageMutex.RLock()
+	defer r.packageMutex.RUnlock()
+	return len(r.packages)
+}
+
+// Start a deployment in the background unless we are shutting down,
+// deployments that don't start are picked up from the journal
+func (r *Repository) run(d *Deployment, deploy func()) {
+	if atomic.LoadInt32(&r.draining) == 1 {
+		log.Warning.Printf("Shutting down, deployment %s of %s will not be started", d.Id, d.PackageId)
+		return
+	}
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		deploy()
+	}()
+}
+
+// Wait up to timeout for running deployments to finish, stop callback
+// deliveries, then make sure every journal entry has reached the disk.
+// Returns false when deployments were still running after the timeout.
+func (r *Repository) Shutdown(timeout time.Duration) bool {
+	atomic.StoreInt32(&r.draining, 1)
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	drained := true
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warning.Printf("Deployments still running after %v", timeout)
+		drained = false
+	}
 
+	// Callbacks still retrying would keep us past the deadline, their
+	// attempts so far are journaled when they return
+	if r.callbacks != nil {
+		r.callbacks.Stop()
+		r.callbacksRunning.Wait()
+	}
+	r.journalWrites.Wait()
+	if r.journalBackend != nil {
+		if err := r.journalBackend.Sync(); err != nil {
+			log.Error.Printf("Failed to sync journal: %v", err)
+		}
+	}
+	return drained
+}
+
+// Check the journal can be written to, nil when journaling is disabled
+func (r *Repository) JournalWritable() error {
+	if r.journalBackend == nil {
+		return nil
+	}
+	return r.journalBackend.Writable()
 }
 
 func (r Repository) DeploymentComplete(d *Deployment) {
 	r.JournalDeployment(d)
-	r.deploymentNotifier.DeploymentComplete(d)
+	if r.deploymentNotifier != nil {
+		r.deploymentNotifier.DeploymentComplete(d)
+	}
+	r.sendCallback(d)
 }
 func (r Repository) DeploymentFailed(d *Deployment) {
 	r.JournalDeployment(d)
+	r.sendCallback(d)
 }
 func (r Repository) Watch(key string, callback func(string)) {
 	r.deploymentNotifier.Watch(key, callback)
 }
 
+// Packages this machine is allowed to run, packages whose tags
+// are not admitted are hidden from the listing
 func (r *Repository) Packages() Packages {
-	return r.packages
+	r.packageMutex.RLock()
+	defer r.packageMutex.RUnlock()
+	var allowed Packages
+	for _, p := range r.packages {
+		if r.PackageAllowed(&p) {
+			allowed = append(allowed, p)
+		}
+	}
+	return allowed
+}
+
+func (r *Repository) PackageAllowed(p *Package) bool {
+	return TagsAllowed(r.allowedTags, r.allowUntagged, p.Tags)
 }
 
 func (r *Repository) Deployments() Deployments {
@@ -88,13 +211,18 @@ func (r *Repository) Deployments() Deployments {
 }
 
 func (r *Repository) FindPackage(id string) (Package, error) {
+	r.packageMutex.RLock()
+	defer r.packageMutex.RUnlock()
 	for _, p := range r.packages {
 		if p.Id == id {
+			if !r.PackageAllowed(&p) {
+				return Package{}, ErrPackageNotAllowed
+			}
 			return p, nil
 		}
 	}
 
-	return Package{}, errors.New("No such package exist")
+	return Package{}, ErrPackageNotFound
 }
 
 func (r *Repository) FindDeployment(id string) (*Deployment, error) {
@@ -106,7 +234,7 @@ func (r *Repository) FindDeployment(id string) (*Deployment, error) {
 	if found {
 		return item, nil
 	}
-	return nil, errors.New("No such deployment exist")
+	return nil, ErrDeploymentNotFound
 }
 
 func (r *Repository) AddDeployment(d *Deployment) {
@@ -120,7 +248,9 @@ func (r *Repository) AddDeployment(d *Deployment) {
 func (r *Repository) JournalDeployment(d *Deployment) {
 	if r.journalBackend != nil {
 
+		r.journalWrites.Add(1)
 		go func() {
+			defer r.journalWrites.Done()
 			// TODO decide how to act when a journal write fails
 			ok := r.journalBackend.WriteEntry(d)
 			if !ok {
@@ -134,7 +264,6 @@ func (r *Repository) JournalDeployment(d *Deployment) {
 
 func (r *Repository) LoadJournaledDeployments() {
 	r.mutex.Lock()
-	defer r.mutex.Unlock()
 	entries := r.journalBackend.ReadEntries(func() interface{} {
 		return &Deployment{}
 	})
@@ -175,17 +304,33 @@ func (r *Repository) LoadJournaledDeployments() {
 		}
 	}
 	log.Info.Printf("Read %d journaled deployments", len(r.deployments))
-	redeploys := 0
+	// Batch members are never redeployed on their own
+	r.restoreBatches()
+	pending := make([]*Deployment, 0)
 	for _, d := range r.deployments {
-		if d.Status != "COMPLETE" {
-			redeploys += 1
-			if d.Template == "" {
-				pkg, _ := r.FindPackage(d.PackageId)
-				pkg.ReDeployPackage(r, d)
-			} else {
-				pkg, _ := r.FindPackage(d.PackageId)
-				pkg.ReDeployPackageTemplate(r, d)
-			}
+		switch d.Status {
+		case STATUS_COMPLETE, STATUS_UNDEPLOYED, STATUS_CANCELLED:
+			continue
+		}
+		if d.BatchId == "" {
+			pending = append(pending, d)
+		}
+	}
+	// Redeploying adds the deployment again which takes the lock
+	r.mutex.Unlock()
+
+	redeploys := 0
+	for _, d := range pending {
+		pkg, err := r.FindPackage(d.PackageId)
+		if err != nil {
+			log.Warning.Printf("Could not redeploy journaled deployment %s of %s: %v", d.Id, d.PackageId, err)
+			continue
+		}
+		redeploys += 1
+		if d.Template == "" {
+			pkg.ReDeployPackage(r, d)
+		} else {
+			pkg.ReDeployPackageTemplate(r, d)
 		}
 	}
 	if redeploys > 0 {
@@ -194,57 +339,95 @@ func (r *Repository) LoadJournaledDeployments() {
 }
 
 func (r *Repository) LoadPackages(funcMap GoTemplate.FuncMap) {
-	log.Trace.Printf("Loading packages from %s ", filepath.Clean(r.configDirectory+"/packages.json"))
-	ok := r.loadPackagesFromFile(filepath.Clean(r.configDirectory+"/packages.json"), funcMap)
+	r.funcMap = funcMap
+	r.packageDefs = r.readAllPackageDefs()
+	packages := r.compilePackages(r.packageDefs, funcMap)
+	// TODO figure out how to handle duplicate package ids
+	r.packageMutex.Lock()
+	r.packages = packages
+	r.packageMutex.Unlock()
+
+	if r.packages == nil || len(r.packages) <= 0 {
+		log.Warning.Printf("No package definitions were found")
+	} else {
+		log.Info.Printf("%d packages have been loaded", len(r.packages))
+	}
+}
+
+// Read and resolve the package definitions in a config directory
+// without processing any of their templates
+func ReadPackageDefs(configDirectory string) PackageDefs {
+	tDefs, errs := resolvePackageDefs(readLocalPackageDefs(configDirectory))
+	for _, err := range errs {
+		log.Warning.Printf("Package could not be loaded: %v", err)
+	}
+	return tDefs
+}
+
+func readLocalPackageDefs(configDirectory string) PackageDefs {
+	// Definitions from every file are collected before any package
+	// is processed so packages can extend ones defined elsewhere
+	var tDefs PackageDefs
+	log.Trace.Printf("Loading packages from %s ", filepath.Clean(configDirectory+"/packages.json"))
+	defs, ok := readPackagesFromFile(filepath.Clean(configDirectory + "/packages.json"))
 	if !ok {
 		log.Warning.Printf("Could not load packages from packages.json")
 	}
+	tDefs = append(tDefs, defs...)
 
-	_, err := os.Stat(filepath.Clean(r.configDirectory + "/conf.d/"))
+	_, err := os.Stat(filepath.Clean(configDirectory + "/conf.d/"))
 	if err == nil {
-		log.Trace.Printf("Loading packages from %s ", filepath.Clean(r.configDirectory+"/conf.d"))
-		files, _ := filepath.Glob(filepath.Clean(r.configDirectory + "/conf.d/*.json"))
-		for _, f := range files {
-			ok := r.loadPackagesFromFile(f, funcMap)
-			if !ok {
-				log.Info.Printf("Could not load packages from file: %s", f)
+		log.Trace.Printf("Loading packages from %s ", filepath.Clean(configDirectory+"/conf.d"))
+		for _, ext := range PackageDefExtensions {
+			files, _ := filepath.Glob(filepath.Clean(configDirectory + "/conf.d/*" + ext))
+			for _, f := range files {
+				defs, ok := readPackagesFromFile(f)
+				if !ok {
+					log.Info.Printf("Could not load packages from file: %s", f)
+				}
+				tDefs = append(tDefs, defs...)
 			}
 		}
 	}
 
-	if r.packages == nil || len(r.packages) <= 0 {
-		log.Warning.Printf("No package definitions were found")
-	} else {
-		log.Info.Printf("%d packages have been loaded", len(r.packages))
-	}
+	return tDefs
 }
 
-// TODO l2method
-func (r *Repository) loadPackagesFromFile(file string, funcMap GoTemplate.FuncMap) bool {
+func readPackagesFromFile(file string) (PackageDefs, bool) {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		log.Warning.Printf("Failed to read file %s: %v", file, err)
-		return false
+		return nil, false
 	}
 
 	// Deserialize the data
-	var tDefs PackageDefs
-	err = json.Unmarshal([]byte(data), &tDefs)
+	tDefs, err := parsePackageDefs(file, data)
 	if err != nil {
-		log.Warning.Printf("Failed to parse json file %s: %v", file, err)
-		return false
+		log.Warning.Printf("Failed to parse package file %s: %v", file, err)
+		return nil, false
+	}
+	for idx := range tDefs {
+		tDefs[idx].source = file
 	}
-
 	log.Trace.Printf("Parsed %d packages from file %s", len(tDefs), file)
+	return tDefs, true
+}
+
+// TODO l2method
+func (r *Repository) compilePackages(tDefs PackageDefs, funcMap GoTemplate.FuncMap) Packages {
 	var tPkgs Packages
 	tPkgs = make([]Package, len(tDefs))
 	for idx, _ := range tDefs {
 		tPkgs[idx] = Package{}
+		file := tDefs[idx].source
+		bodies := make(map[string]string)
 		tPkgs[idx].Id = tDefs[idx].Id
 		tPkgs[idx].Tag = tDefs[idx].Tag
+		tPkgs[idx].Tags = mergeTags(tDefs[idx].Tag, tDefs[idx].Tags)
 		tPkgs[idx].Name = tDefs[idx].Name
 		tPkgs[idx].Version = tDefs[idx].Version
-		tPkgs[idx].Strict = tDefs[idx].Strict
+		tPkgs[idx].Strict = tDefs[idx].Strict != nil && *tDefs[idx].Strict
+		tPkgs[idx].Extends = tDefs[idx].Extends
 		// TODO How to persist metrics data between restarts?
 		tPkgs[idx].metrics = metrics.NewMetrics()
 
@@ -323,11 +506,21 @@ func (r *Repository) loadPackagesFromFile(file string, funcMap GoTemplate.FuncMa
 					tPkgs[idx].processTemplate(twatch, twatch, funcMap)
 				}
 			}
-			err := tPkgs[idx].processTemplateFile(r.configDirectory, tmpDef.Src+".tpl", tmpDef.Src+".tpl", funcMap)
-			if err != nil {
-				// TODO this isn't enough, we need to remove the package from the list
-				log.Warning.Printf("Template file could not be processed: %s in package %s", tmpDef.Src, tPkgs[idx].Id)
-				goto nextPackage
+			// Packages shared through the cluster backend carry their
+			// template bodies, everything else is read from /tpl
+			if body, ok := tDefs[idx].templateBodies[tmpDef.Src+".tpl"]; ok {
+				if err := tPkgs[idx].processTemplateBody(tmpDef.Src+".tpl", body, funcMap); err != nil {
+					log.Warning.Printf("Template could not be processed: %s in package %s: %v", tmpDef.Src, tPkgs[idx].Id, err)
+					goto nextPackage
+				}
+				bodies[tmpDef.Src+".tpl"] = body
+			} else {
+				body, err := tPkgs[idx].processTemplateFile(r.configDirectory, tmpDef.Src+".tpl", tmpDef.Src+".tpl", funcMap)
+				if err != nil {
+					log.Warning.Printf("Template file could not be processed: %s in package %s: %v", tmpDef.Src, tPkgs[idx].Id, err)
+					goto nextPackage
+				}
+				bodies[tmpDef.Src+".tpl"] = body
 			}
 
 			// TODO L2Method
@@ -401,12 +594,29 @@ func (r *Repository) loadPackagesFromFile(file string, funcMap GoTemplate.FuncMa
 			}
 			tPkgs[idx].TemplatesAfter[fidx] = fragment
 		}
+
+		// Shell commands to be executed when a deployment is undone
+		tPkgs[idx].TemplatesUndeploy = make([]*ExecutionFragment, len(tDefs[idx].TemplatesUndeploy))
+		for fidx, fragmentDef := range tDefs[idx].TemplatesUndeploy {
+			fragment, ok := r.loadFragment(tPkgs[idx], len(tDefs[idx].TemplatesUndeploy), fidx+1, fragmentDef, funcMap)
+			if !ok {
+				log.Warning.Printf("Invalid fragment definition %s", file)
+				goto nextPackage
+			}
+			tPkgs[idx].TemplatesUndeploy[fidx] = fragment
+		}
+		tPkgs[idx].Hash = packageHash(tDefs[idx], bodies)
 	nextPackage:
 	}
-	// Compose the package list
-	// TODO figure out how to handle duplicate package ids
-	r.packages = append(r.packages, tPkgs...)
-	return true
+
+	// Packages that failed to process never get a hash
+	var result Packages
+	for _, p := range tPkgs {
+		if p.Hash != "" {
+			result = append(result, p)
+		}
+	}
+	return result
 }
 
 func (r *Repository) loadFragment(pkg Package, count int, fidx int, fragmentDef interface{}, funcMap GoTemplate.FuncMap) (*ExecutionFragment, bool) {
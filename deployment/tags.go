@@ -0,0 +1,73 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"path"
+)
+
+// Check whether a set of package tags is admitted by the
+// allowed tag patterns of a machine. Patterns use glob syntax
+// (web-*, *), a tagged package is admitted when any one of its
+// tags matches any one of the patterns. Untagged packages are
+// only admitted when allowUntagged is set.
+func TagsAllowed(allowedTags []string, allowUntagged bool, tags []string) bool {
+	if len(tags) == 0 {
+		return allowUntagged
+	}
+	for _, pattern := range allowedTags {
+		for _, tag := range tags {
+			if matched, err := path.Match(pattern, tag); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check that every allowed tag pattern is a valid glob, patterns that
+// fail here would otherwise silently never match
+func validTagPatterns(allowedTags []string) []string {
+	var invalid []string
+	for _, pattern := range allowedTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			invalid = append(invalid, pattern)
+		}
+	}
+	return invalid
+}
+
+// Merge the legacy single tag field with the tag list, dropping
+// empty and duplicate entries
+func mergeTags(tag string, tags []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, t := range append([]string{tag}, tags...) {
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		result = append(result, t)
+	}
+	return result
+}
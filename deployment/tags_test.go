@@ -0,0 +1,24 @@
+package deployment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagsAllowed(t *testing.T) {
+	assert.Equal(t, TagsAllowed([]string{"*"}, false, []string{"web"}), true, "")
+	assert.Equal(t, TagsAllowed([]string{"*"}, false, nil), false, "")
+	assert.Equal(t, TagsAllowed(nil, true, nil), true, "")
+	assert.Equal(t, TagsAllowed(nil, true, []string{"web"}), false, "")
+	assert.Equal(t, TagsAllowed([]string{"php-*"}, false, []string{"php-dev"}), true, "")
+	assert.Equal(t, TagsAllowed([]string{"php-*"}, false, []string{"db", "php-prod"}), true, "")
+	assert.Equal(t, TagsAllowed([]string{"php-*", "web"}, false, []string{"db"}), false, "")
+	assert.Equal(t, TagsAllowed([]string{"[bad"}, false, []string{"bad"}), false, "")
+}
+
+func TestMergeTags(t *testing.T) {
+	assert.Equal(t, mergeTags("web", []string{"php", "web"}), []string{"web", "php"}, "")
+	assert.Equal(t, mergeTags("", nil), []string(nil), "")
+	assert.Equal(t, validTagPatterns([]string{"*", "[bad"}), []string{"[bad"}, "")
+}
@@ -29,16 +29,16 @@ import (
 )
 
 type TemplateDef struct {
-	Src         string      `json:"src"`
-	Dest        string      `json:"dest"`
-	Description string      `json:"description"`
-	Before      interface{} `json:"before"`
-	After       interface{} `json:"after"`
-	Contents    string      `json:"contents"`
-	Watch       interface{} `json:"watch"`
-	Owner       string      `json:"owner"`
-	Group       string      `json:"group"`
-	Mode        string      `json:"mode"`
+	Src         string      `json:"src" yaml:"src" toml:"src"`
+	Dest        string      `json:"dest" yaml:"dest" toml:"dest"`
+	Description string      `json:"description" yaml:"description" toml:"description"`
+	Before      interface{} `json:"before" yaml:"before" toml:"before"`
+	After       interface{} `json:"after" yaml:"after" toml:"after"`
+	Contents    string      `json:"contents" yaml:"contents" toml:"contents"`
+	Watch       interface{} `json:"watch" yaml:"watch" toml:"watch"`
+	Owner       string      `json:"owner" yaml:"owner" toml:"owner"`
+	Group       string      `json:"group" yaml:"group" toml:"group"`
+	Mode        string      `json:"mode" yaml:"mode" toml:"mode"`
 }
 
 type Template struct {
@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cchamplin/deployd/log"
+)
+
+var ErrDeploymentRunning = errors.New("Deployment is still running")
+
+// Undo a deployment, the package's undeploy commands are run and
+// then the files its templates wrote are removed
+func (d *Deployment) Undeploy(p *Package) bool {
+	log.Info.Printf("Undeploying %s of %s", d.Id, p.Name)
+	d.Status = STATUS_UNDEPLOYING
+	d.StatusMessage = "Running undeploy commands"
+	d.EstComplete = 0
+	if ok := d.handleExecutionFragments(p.TemplatesUndeploy, p); !ok {
+		d.finished()
+		return false
+	}
+
+	d.StatusMessage = "Removing template files"
+	for _, tmpl := range p.Templates {
+		if d.Template != "" && d.Template != tmpl.Src {
+			continue
+		}
+		dest, ok := d.handleTemplateFile(tmpl.Src+"_dest", p, nil, "")
+		if !ok {
+			d.finished()
+			return false
+		}
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			log.Info.Printf("Undeploy of %s could not remove %s: %v", d.Id, dest, err)
+			d.StatusMessage = fmt.Sprintf("Undeploy of %s failed: %v", d.Id, err)
+			d.Status = STATUS_FAILED
+			d.finished()
+			return false
+		}
+	}
+
+	d.Status = STATUS_UNDEPLOYED
+	d.StatusMessage = "Package Undeployed"
+	d.finished()
+	return true
+}
+
+// Undo a finished deployment in the background
+func (r *Repository) Undeploy(id string) (*Deployment, error) {
+	d, pkg, err := r.undeployable(id)
+	if err != nil {
+		return nil, err
+	}
+	r.run(d, func() {
+		d.Undeploy(&pkg)
+		r.JournalDeployment(d)
+	})
+	return d, nil
+}
+
+func (r *Repository) undeployable(id string) (*Deployment, Package, error) {
+	d, err := r.FindDeployment(id)
+	if err != nil {
+		return nil, Package{}, err
+	}
+	pkg, err := r.FindPackage(d.PackageId)
+	if err != nil {
+		return nil, Package{}, err
+	}
+	if _, ok := r.claimUndeploy(d); !ok {
+		return nil, Package{}, ErrDeploymentRunning
+	}
+	return d, pkg, nil
+}
+
+// Switch a finished deployment to undeploying, the status is checked
+// and set under the lock so only one caller gets to undeploy it.
+// Returns the status the deployment had.
+func (r *Repository) claimUndeploy(d *Deployment) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := d.Status
+	if status != STATUS_COMPLETE && status != STATUS_FAILED {
+		return status, false
+	}
+	d.Status = STATUS_UNDEPLOYING
+	d.StatusMessage = "Waiting to undeploy"
+	return status, true
+}
@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deployment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/cchamplin/deployd/atomicfile"
+	"github.com/cchamplin/deployd/log"
+)
+
+var ErrPackageChanged = errors.New("Package changed since it was read")
+var ErrPackageReadOnly = errors.New("Package definition can't be edited through the API")
+
+// Returned when an updated definition can't be loaded
+type PackageDefError struct {
+	Reason string
+}
+
+func (e *PackageDefError) Error() string {
+	return "Invalid package definition: " + e.Reason
+}
+
+// Replace a package definition in the JSON file it was read from.
+// hash has to be the package's current hash so an edit made from a
+// stale copy doesn't overwrite someone else's.
+func (r *Repository) UpdatePackage(id string, def PackageDef, hash string) (Package, error) {
+	r.editMutex.Lock()
+	defer r.editMutex.Unlock()
+
+	current, err := r.FindPackage(id)
+	if err != nil {
+		return Package{}, err
+	}
+	if current.Hash != hash {
+		return Package{}, ErrPackageChanged
+	}
+
+	source := r.packageDefSource(id)
+	if strings.ToLower(filepath.Ext(source)) != ".json" {
+		return Package{}, ErrPackageReadOnly
+	}
+	original, err := ioutil.ReadFile(source)
+	if err != nil {
+		return Package{}, err
+	}
+	defs, err := parsePackageDefs(source, original)
+	if err != nil {
+		return Package{}, err
+	}
+
+	def.Id = id
+	replaced := false
+	for idx := range defs {
+		if defs[idx].Id == id {
+			defs[idx] = def
+			replaced = true
+		}
+	}
+	if !replaced {
+		return Package{}, ErrPackageReadOnly
+	}
+	if err := r.validatePackageDef(def); err != nil {
+		return Package{}, err
+	}
+
+	data, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return Package{}, err
+	}
+	if err := atomicfile.Write(source, data, 0644); err != nil {
+		return Package{}, err
+	}
+	r.ReloadPackages()
+
+	pkg, err := r.FindPackage(id)
+	if err != nil {
+		// The definition didn't survive loading, put the old one back
+		log.Warning.Printf("Package %s could not be loaded after the update, restoring %s", id, source)
+		if err := atomicfile.Write(source, original, 0644); err != nil {
+			log.Error.Printf("Failed to restore %s: %v", source, err)
+		}
+		r.ReloadPackages()
+		return Package{}, &PackageDefError{Reason: "the package did not load, see the logs"}
+	}
+	log.Info.Printf("Updated package %s in %s", id, source)
+	return pkg, nil
+}
+
+func (r *Repository) packageDefSource(id string) string {
+	r.packageMutex.RLock()
+	defer r.packageMutex.RUnlock()
+	for _, def := range r.packageDefs {
+		if def.Id == id {
+			return def.source
+		}
+	}
+	return ""
+}
+
+// Template processing panics on invalid templates, the definition and
+// the template files it names are parsed before anything is written
+func (r *Repository) validatePackageDef(def PackageDef) error {
+	b := Bundle{Package: def, files: make(map[string][]byte)}
+	for _, tmpl := range def.Templates {
+		name := BundleTemplateDir + tmpl.Src + ".tpl"
+		data, err := ioutil.ReadFile(filepath.Join(r.configDirectory, filepath.FromSlash(name)))
+		if err != nil {
+			return &PackageDefError{Reason: fmt.Sprintf("could not read template %s: %v", name, err)}
+		}
+		b.files[name] = data
+	}
+	if err := b.validateTemplates(r.funcMap); err != nil {
+		return &PackageDefError{Reason: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package deployment
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdatePackage(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-update")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "conf.d"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "tpl"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "tpl", "php.ini.tpl"), []byte("memory={{.memory}}"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "conf.d", "php.json"), []byte(`[{"id": "php", "name": "PHP", "templates": [{"src": "php.ini", "dest": "/tmp/php.ini"}]}]`), 0644))
+
+	r := &Repository{packageMutex: &sync.RWMutex{}, editMutex: &sync.Mutex{}, configDirectory: dir, allowUntagged: true}
+	r.LoadPackages(nil)
+	pkg, err := r.FindPackage("php")
+	assert.Nil(t, err)
+
+	def := PackageDef{Name: "PHP 7", Templates: []TemplateDef{{Src: "php.ini", Dest: "/tmp/php7.ini"}}}
+	updated, err := r.UpdatePackage("php", def, pkg.Hash)
+	assert.Nil(t, err)
+	assert.Equal(t, "PHP 7", updated.Name)
+	assert.NotEqual(t, pkg.Hash, updated.Hash)
+
+	// The hash read before the first update is stale now
+	_, err = r.UpdatePackage("php", PackageDef{Name: "PHP 5"}, pkg.Hash)
+	assert.Equal(t, ErrPackageChanged, err)
+
+	def.Templates[0].Dest = "{{.broken"
+	_, err = r.UpdatePackage("php", def, updated.Hash)
+	assert.IsType(t, &PackageDefError{}, err)
+	current, _ := r.FindPackage("php")
+	assert.Equal(t, updated.Hash, current.Hash)
+}
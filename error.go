@@ -22,7 +22,156 @@
 
 package main
 
-type jsonErr struct {
-	Code int    `json:"code"`
-	Text string `json:"text"`
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/deployment"
+	"github.com/cchamplin/deployd/log"
+)
+
+// Machine readable error codes, returned in the code member of
+// every problem
+const (
+	ERR_INVALID_REQUEST        = "invalid_request"
+	ERR_VALIDATION             = "validation_failed"
+	ERR_NOT_FOUND              = "not_found"
+	ERR_METHOD_NOT_ALLOWED     = "method_not_allowed"
+	ERR_PACKAGE_NOT_FOUND      = "package_not_found"
+	ERR_PACKAGE_NOT_ALLOWED    = "package_not_allowed"
+	ERR_PACKAGE_EXISTS         = "package_exists"
+	ERR_PACKAGE_MISMATCH       = "package_mismatch"
+	ERR_INVALID_BUNDLE         = "invalid_bundle"
+	ERR_TEMPLATE_NOT_FOUND     = "template_not_found"
+	ERR_DEPLOYMENT_NOT_FOUND   = "deployment_not_found"
+	ERR_DEPLOYMENT_RUNNING     = "deployment_running"
+	ERR_BATCH_NOT_FOUND        = "batch_not_found"
+	ERR_PACKAGE_READ_ONLY      = "package_read_only"
+	ERR_PRECONDITION_FAILED    = "precondition_failed"
+	ERR_PRECONDITION_REQUIRED  = "precondition_required"
+	ERR_UNAUTHENTICATED        = "unauthenticated"
+	ERR_INVALID_CREDENTIALS    = "invalid_credentials"
+	ERR_PERMISSION_DENIED      = "permission_denied"
+	ERR_USER_NOT_FOUND         = "user_not_found"
+	ERR_USER_EXISTS            = "user_exists"
+	ERR_USERS_NOT_SUPPORTED    = "users_not_supported"
+	ERR_API_KEY_NOT_FOUND      = "api_key_not_found"
+	ERR_API_KEYS_NOT_SUPPORTED = "api_keys_not_supported"
+	ERR_AUDIT_DISABLED         = "audit_disabled"
+	ERR_AUTH_DISABLED          = "auth_disabled"
+	ERR_INTERNAL               = "internal_error"
+)
+
+// An RFC 7807 problem detail, the request id matches the one in
+// the request log
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestId string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	// The route and flag a 403 was missing, e.g. PackageDeploy:CREATE
+	Permission string `json:"permission,omitempty"`
+}
+
+// A problem with a single request parameter or body field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string, fields ...FieldError) {
+	problem := newProblem(r, status, code, detail)
+	problem.Errors = fields
+	sendProblem(w, problem)
+}
+
+func newProblem(r *http.Request, status int, code string, detail string) Problem {
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestId: log.RequestId(r),
+	}
+}
+
+func sendProblem(w http.ResponseWriter, problem Problem) {
+	status, code, detail := problem.Status, problem.Code, problem.Detail
+	if status >= http.StatusInternalServerError {
+		log.Error.Printf("Request %s failed with %d %s: %s", problem.RequestId, status, code, detail)
+	} else {
+		log.Info.Printf("Request %s failed with %d %s: %s", problem.RequestId, status, code, detail)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		log.Error.Printf("Failed to return %d, encoding error: %v", status, err)
+	}
+}
+
+// Write a JSON response, the body is encoded before the status is
+// sent so an encoding failure can still be reported
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to encode the response: "+err.Error())
+		return
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		log.Error.Printf("Request %s failed writing the response: %v", log.RequestId(r), err)
+	}
+}
+
+// Map errors from the deployment package onto problems, unknown
+// errors are internal
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case deployment.ErrPackageNotFound:
+		writeProblem(w, r, http.StatusNotFound, ERR_PACKAGE_NOT_FOUND, err.Error())
+	case deployment.ErrPackageNotAllowed:
+		writeProblem(w, r, http.StatusForbidden, ERR_PACKAGE_NOT_ALLOWED, err.Error())
+	case deployment.ErrPackageExists:
+		writeProblem(w, r, http.StatusConflict, ERR_PACKAGE_EXISTS, err.Error())
+	case deployment.ErrPackageMismatch:
+		writeProblem(w, r, http.StatusConflict, ERR_PACKAGE_MISMATCH, err.Error())
+	case deployment.ErrDeploymentNotFound:
+		writeProblem(w, r, http.StatusNotFound, ERR_DEPLOYMENT_NOT_FOUND, err.Error())
+	case deployment.ErrTemplateNotFound:
+		writeProblem(w, r, http.StatusNotFound, ERR_TEMPLATE_NOT_FOUND, err.Error())
+	case deployment.ErrDeploymentRunning:
+		writeProblem(w, r, http.StatusConflict, ERR_DEPLOYMENT_RUNNING, err.Error())
+	case deployment.ErrBatchNotFound:
+		writeProblem(w, r, http.StatusNotFound, ERR_BATCH_NOT_FOUND, err.Error())
+	case deployment.ErrPackageReadOnly:
+		writeProblem(w, r, http.StatusConflict, ERR_PACKAGE_READ_ONLY, err.Error())
+	case deployment.ErrPackageChanged:
+		writeProblem(w, r, http.StatusPreconditionFailed, ERR_PRECONDITION_FAILED, err.Error())
+	case auth.ErrUserNotFound:
+		writeProblem(w, r, http.StatusNotFound, ERR_USER_NOT_FOUND, err.Error())
+	case auth.ErrUserExists:
+		writeProblem(w, r, http.StatusConflict, ERR_USER_EXISTS, err.Error())
+	case auth.ErrUserChanged:
+		writeProblem(w, r, http.StatusPreconditionFailed, ERR_PRECONDITION_FAILED, err.Error())
+	case auth.ErrAPIKeyNotFound:
+		writeProblem(w, r, http.StatusNotFound, ERR_API_KEY_NOT_FOUND, err.Error())
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, ERR_INTERNAL, err.Error())
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No route matches "+r.URL.Path)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, r.Method+" is not allowed on "+r.URL.Path)
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	var problem Problem
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	return problem
+}
+
+func TestProblemResponses(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	router := NewRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	problem := decodeProblem(t, w)
+	assert.Equal(t, ERR_NOT_FOUND, problem.Code)
+	assert.Equal(t, http.StatusNotFound, problem.Status)
+	assert.Equal(t, "/missing", problem.Instance)
+	assert.NotEmpty(t, problem.RequestId)
+	assert.Equal(t, w.Header().Get(log.RequestIdHeader), problem.RequestId)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/deployments", nil)
+	r.Header.Set(log.RequestIdHeader, "client-chosen-id")
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "client-chosen-id", decodeProblem(t, w).RequestId)
+}
+
+func TestWriteJSONEncodingFailure(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	w := httptest.NewRecorder()
+	writeJSON(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, make(chan int))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, ERR_INTERNAL, decodeProblem(t, w).Code)
+}
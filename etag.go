@@ -0,0 +1,112 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cchamplin/deployd/log"
+)
+
+// Entity tag of a resource's JSON representation
+func jsonETag(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return quoteETag(hex.EncodeToString(sum[:16])), nil
+}
+
+func quoteETag(tag string) string {
+	return "\"" + tag + "\""
+}
+
+// Whether a header listing entity tags names etag, weak tags are
+// compared by their opaque value as If-None-Match requires
+func etagListed(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Write a resource along with its ETag, a GET whose If-None-Match
+// lists the tag is answered with 304 and no body
+func writeTagged(w http.ResponseWriter, r *http.Request, etag string, value interface{}) {
+	w.Header().Set("ETag", etag)
+	if (r.Method == "GET" || r.Method == "HEAD") && etagListed(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, value)
+}
+
+// Write a resource tagged with the hash of its JSON representation
+func writeJSONTagged(w http.ResponseWriter, r *http.Request, value interface{}) {
+	etag, err := jsonETag(value)
+	if err != nil {
+		log.Error.Printf("Request %s could not tag the response: %v", log.RequestId(r), err)
+		writeJSON(w, r, http.StatusOK, value)
+		return
+	}
+	writeTagged(w, r, etag, value)
+}
+
+// The entity tag a PUT or DELETE was made against. Modifying requests
+// must carry If-Match, without it the request is answered with 428.
+func requireIfMatch(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		writeProblem(w, r, http.StatusPreconditionRequired, ERR_PRECONDITION_REQUIRED, r.Method+" requires an If-Match header with the resource's ETag")
+		return "", false
+	}
+	return ifMatch, true
+}
+
+// Whether an If-Match header names etag, weak tags never match
+func ifMatchListed(ifMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer 412 unless the If-Match tag names the current one
+func checkIfMatch(w http.ResponseWriter, r *http.Request, ifMatch string, etag string) bool {
+	if ifMatchListed(ifMatch, etag) {
+		return true
+	}
+	writeProblem(w, r, http.StatusPreconditionFailed, ERR_PRECONDITION_FAILED, "The resource changed since it was read, fetch it again and retry")
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTagged(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	value := map[string]string{"id": "php"}
+	etag, err := jsonETag(value)
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	writeTagged(w, httptest.NewRequest("GET", "/v1/packages/php", nil), etag, value)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	r := httptest.NewRequest("GET", "/v1/packages/php", nil)
+	r.Header.Set("If-None-Match", `"other", W/`+etag)
+	w = httptest.NewRecorder()
+	writeTagged(w, r, etag, value)
+	assert.Equal(t, 304, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestIfMatch(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	w := httptest.NewRecorder()
+	_, ok := requireIfMatch(w, httptest.NewRequest("PUT", "/v1/packages/php", nil))
+	assert.False(t, ok)
+	assert.Equal(t, 428, w.Code)
+
+	r := httptest.NewRequest("PUT", "/v1/packages/php", nil)
+	w = httptest.NewRecorder()
+	assert.True(t, checkIfMatch(w, r, `"a", "b"`, `"b"`))
+	assert.True(t, checkIfMatch(w, r, `*`, `"b"`))
+	assert.False(t, checkIfMatch(w, r, `W/"b"`, `"b"`))
+	assert.Equal(t, 412, w.Code)
+	assert.Contains(t, w.Body.String(), ERR_PRECONDITION_FAILED)
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	router := NewRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Equal(t, `</v1/openapi.json>; rel="successor-version"`, w.Header().Get("Link"))
+}
@@ -23,11 +23,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/deployment"
 	"github.com/cchamplin/deployd/log"
 	"github.com/gorilla/mux"
 )
@@ -37,184 +44,467 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "OK\n")
 }
 
-// Return listing of packages
+// Return listing of packages, only the ones the request may see
 func Packages(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(repo.Packages()); err != nil {
-		log.Error.Printf("Package index request failed, encoding error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	visible := deployment.Packages{}
+	for _, pkg := range repo.Packages() {
+		if packagePermitted(r, "Packages", pkg.Id, pkg.Tags) {
+			visible = append(visible, pkg)
+		}
 	}
+	writeJSON(w, r, http.StatusOK, visible)
 }
 
-// Return package details for specific package ID
+// Return package details for specific package ID, a PUT replaces
+// the package's definition
 func PackageDetails(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	packageId := vars["packageId"]
 	pkg, err := repo.FindPackage(packageId)
-
-	if err == nil {
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(pkg); err != nil {
-			log.Error.Printf("Failed to encode package %s details: %v", packageId, err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !packageAllowed(w, r, "PackageDetails", pkg.Id, pkg.Tags) {
+		return
+	}
+	if r.Method != "PUT" {
+		writeTagged(w, r, packageETag(pkg), pkg)
 		return
 	}
 
-	// If we didn't find it, 404
-	w.WriteHeader(http.StatusNotFound)
-	if err := json.NewEncoder(w).Encode(jsonErr{Code: http.StatusNotFound, Text: "Not Found"}); err != nil {
-		log.Error.Printf("Failed to return 404, encoding error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	ifMatch, ok := requireIfMatch(w, r)
+	if !ok || !checkIfMatch(w, r, ifMatch, packageETag(pkg)) {
+		return
+	}
+	var def deployment.PackageDef
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&def); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse package definition: "+err.Error())
+		return
+	}
+	if def.Id != "" && def.Id != packageId {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid package definition", FieldError{Field: "id", Message: "does not match the package being updated"})
+		return
 	}
 
+	pkg, err = repo.UpdatePackage(packageId, def, pkg.Hash)
+	if defErr, ok := err.(*deployment.PackageDefError); ok {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, defErr.Error())
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeTagged(w, r, packageETag(pkg), pkg)
 }
 
-// List deployed packages
-func Deployments(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(repo.Deployments()); err != nil {
-		log.Error.Printf("Deployment index request failed, encoding error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	}
+// Packages are tagged with the hash of their definition and templates
+func packageETag(pkg deployment.Package) string {
+	return quoteETag(pkg.Hash)
 }
 
-// Return deployment details for deploymentId
-func DeploymentDetails(w http.ResponseWriter, r *http.Request) {
+// Export a package, its definition and templates as a .tar.gz bundle
+func PackageBundle(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	deploymentId := vars["deploymentId"]
-	deployment, err := repo.FindDeployment(deploymentId)
-	if err == nil {
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(deployment); err != nil {
-			log.Error.Printf("Failed to encode deployment %s details: %v", deploymentId, err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	packageId := vars["packageId"]
+	pkg, err := repo.FindPackage(packageId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !packageAllowed(w, r, "PackageBundle", pkg.Id, pkg.Tags) {
 		return
 	}
 
-	// If we didn't find it, 404
-	w.WriteHeader(http.StatusNotFound)
-	if err := json.NewEncoder(w).Encode(jsonErr{Code: http.StatusNotFound, Text: "Not Found"}); err != nil {
-		log.Error.Printf("Failed to return 404, encoding error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	// Build the bundle before writing anything so a missing template
+	// can still be reported with the right status code
+	var bundle bytes.Buffer
+	if err := repo.ExportBundle(packageId, &bundle); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, ERR_INTERNAL, fmt.Sprintf("Failed to export package %s: %v", packageId, err))
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tar.gz\"", packageId))
+	w.WriteHeader(http.StatusOK)
+	if _, err := bundle.WriteTo(w); err != nil {
+		log.Error.Printf("Failed to write package %s bundle: %v", packageId, err)
+	}
 }
 
-func PackageDeploy(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+// Install a package bundle, the bundle is either the raw request
+// body or the "bundle" field of a multipart form. The package can
+// be installed under a different id with ?id=
+func PackageImport(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if file, _, err := r.FormFile("bundle"); err == nil {
+		defer file.Close()
+		body = file
+	}
 
-	packageId := vars["packageId"]
-	pkg, err := repo.FindPackage(packageId)
-	if err == nil {
+	bundle, err := deployment.ReadBundle(body)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_BUNDLE, err.Error())
+		return
+	}
+	// The package is checked under the id it will be installed as
+	packageId := r.FormValue("id")
+	if packageId == "" {
+		packageId = bundle.Package.Id
+	}
+	if !packageAllowed(w, r, "PackageImport", packageId, bundle.Tags()) {
+		return
+	}
 
-		w.WriteHeader(http.StatusOK)
+	pkg, err := repo.InstallBundle(bundle, r.FormValue("id"))
+	if defErr, ok := err.(*deployment.PackageDefError); ok {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, defErr.Error())
+		return
+	}
+	switch err {
+	case nil:
+		auditResource(r, "/packages/"+pkg.Id)
+		writeJSON(w, r, http.StatusCreated, pkg)
+	case deployment.ErrPackageExists:
+		writeError(w, r, err)
+	case deployment.ErrInvalidPackageId:
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid package id", FieldError{Field: "id", Message: err.Error()})
+	default:
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_BUNDLE, err.Error())
+	}
+}
 
-		if err := r.ParseForm(); err != nil {
-			log.Warning.Printf("Failed to parse deployment request details: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			if err := json.NewEncoder(w).Encode(jsonErr{Code: http.StatusBadRequest, Text: "Bad Request"}); err != nil {
-				log.Error.Printf("Failed to return 400, encoding error: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-		}
+// List deployed packages
+func Deployments(w http.ResponseWriter, r *http.Request) {
+	query, fields := parseDeploymentQuery(r)
+	if len(fields) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid deployment query", fields...)
+		return
+	}
+	deployments, next, err := repo.QueryDeployments(query)
+	switch err {
+	case nil:
+	case deployment.ErrInvalidSort:
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid deployment query", FieldError{Field: "sort", Message: err.Error()})
+		return
+	case deployment.ErrInvalidCursor:
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid deployment query", FieldError{Field: "cursor", Message: err.Error()})
+		return
+	default:
+		writeError(w, r, err)
+		return
+	}
 
-		watch := true
-		if val, ok := r.Form["watch"]; ok {
-			watch, _ = strconv.ParseBool(val[0])
-		}
+	if next != "" {
+		nextUrl := *r.URL
+		values := nextUrl.Query()
+		values.Set("cursor", next)
+		nextUrl.RawQuery = values.Encode()
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", "<"+nextUrl.RequestURI()+">; rel=\"next\"")
+	}
+	writeJSON(w, r, http.StatusOK, deployments)
+}
 
-		// Parse out post vairables to be used as deployment template replacements
-		items := make(map[string]string)
-		for key, values := range r.PostForm {
-			if len(values) > 0 {
-				items[key] = values[0]
+// Build a deployment query from the request parameters, variables
+// are matched with var.<name>=<value> and times are RFC 3339
+func parseDeploymentQuery(r *http.Request) (deployment.DeploymentQuery, []FieldError) {
+	var query deployment.DeploymentQuery
+	var fields []FieldError
+	values := r.URL.Query()
+	for _, status := range values["status"] {
+		for _, s := range strings.Split(status, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				query.Status = append(query.Status, s)
 			}
 		}
+	}
+	query.PackageId = values.Get("packageId")
+	query.Template = values.Get("template")
+	query.Sort = values.Get("sort")
+	query.Cursor = values.Get("cursor")
+	for key, value := range values {
+		if strings.HasPrefix(key, "var.") && len(value) > 0 {
+			if query.Variables == nil {
+				query.Variables = make(map[string]string)
+			}
+			query.Variables[strings.TrimPrefix(key, "var.")] = value[0]
+		}
+	}
 
-		deployment := pkg.DeployPackage(repo, items, watch)
-		if err := json.NewEncoder(w).Encode(deployment); err != nil {
-			log.Error.Printf("Failed to encode deployment %s response details: %v", deployment.Id, err)
-			w.WriteHeader(http.StatusInternalServerError)
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			fields = append(fields, FieldError{Field: "since", Message: "must be an RFC 3339 time"})
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			fields = append(fields, FieldError{Field: "until", Message: "must be an RFC 3339 time"})
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			fields = append(fields, FieldError{Field: "limit", Message: "must be a positive integer"})
 		}
+	}
+	return query, fields
+}
+
+// Return deployment details for deploymentId
+func DeploymentDetails(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	deploymentId := vars["deploymentId"]
+	d, err := repo.FindDeployment(deploymentId)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	writeJSONTagged(w, r, d)
+}
 
-	// If we didn't find it, 404
-	w.WriteHeader(http.StatusNotFound)
-	if err := json.NewEncoder(w).Encode(jsonErr{Code: http.StatusNotFound, Text: "Not Found"}); err != nil {
-		log.Error.Printf("Failed to return 404, encoding error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+// Run an existing deployment again, the body may override variables,
+// pick a single template and give a reason for the redeploy
+func DeploymentRedeploy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var opts deployment.RedeployOptions
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&opts); err != nil && err != io.EOF {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse redeploy request: "+err.Error())
+		return
+	}
+	opts.RequestedBy = requester(r)
+	if !deploymentAllowed(w, r, "DeploymentRedeploy", vars["deploymentId"]) {
+		return
 	}
 
+	auditVariables(r, opts.Variables)
+	d, err := repo.Redeploy(vars["deploymentId"], opts)
+	switch err {
+	case nil:
+		auditDetail(r, "deployment "+d.Id)
+		writeJSON(w, r, http.StatusOK, d)
+	case deployment.ErrTemplateNotFound:
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid redeploy request", FieldError{Field: "template", Message: err.Error()})
+	case deployment.ErrInvalidCallback, deployment.ErrCallbackNotAllowed:
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid redeploy request", FieldError{Field: "callback_url", Message: err.Error()})
+	default:
+		writeError(w, r, err)
+	}
 }
 
-func PackageDeployTemplate(w http.ResponseWriter, r *http.Request) {
+// Undo a finished deployment, its undeploy commands are run and the
+// files its templates wrote are removed
+func DeploymentUndeploy(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	if !deploymentAllowed(w, r, "DeploymentUndeploy", vars["deploymentId"]) {
+		return
+	}
 
-	packageId := vars["packageId"]
-	templateName := vars["templateName"]
-	pkg, err := repo.FindPackage(packageId)
-	if err == nil {
+	d, err := repo.Undeploy(vars["deploymentId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusAccepted, d)
+}
 
-		w.WriteHeader(http.StatusOK)
+// Whether the request may act on the package of a deployment, a
+// problem is written when it may not or the deployment is unknown
+func deploymentAllowed(w http.ResponseWriter, r *http.Request, routeName string, deploymentId string) bool {
+	d, err := repo.FindDeployment(deploymentId)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	return packageAllowed(w, r, routeName, d.PackageId, d.Tags)
+}
 
-		if err := r.ParseForm(); err != nil {
-			log.Warning.Printf("Failed to parse deployment request details: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			if err := json.NewEncoder(w).Encode(jsonErr{Code: http.StatusBadRequest, Text: "Bad Request"}); err != nil {
-				log.Error.Printf("Failed to return 400, encoding error: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+// Deploy an ordered list of packages as one unit, when one of them
+// fails the ones before it are undeployed again
+func DeploymentBatch(w http.ResponseWriter, r *http.Request) {
+	var req deployment.BatchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse batch request: "+err.Error())
+		return
+	}
+	req.RequestedBy = requester(r)
+	for _, member := range req.Deployments {
+		// Unknown packages are reported by DeployBatch
+		if pkg, err := repo.FindPackage(member.PackageId); err == nil && !packageAllowed(w, r, "DeploymentBatch", pkg.Id, pkg.Tags) {
+			return
 		}
+	}
 
-		watch := false
-		if val, ok := r.Form["watch"]; ok {
-			watch, _ = strconv.ParseBool(val[0])
+	// Variables are recorded as <member index>.<name>
+	variables := make(map[string]string)
+	for idx, member := range req.Deployments {
+		for name, value := range member.Variables {
+			variables[fmt.Sprintf("%d.%s", idx, name)] = value
 		}
+	}
+	auditVariables(r, variables)
+	batch, err := repo.DeployBatch(req)
+	if err == nil {
+		auditDetail(r, "batch "+batch.Id)
+		writeJSON(w, r, http.StatusAccepted, batch)
+		return
+	}
+	if err == deployment.ErrEmptyBatch {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid batch request", FieldError{Field: "deployments", Message: err.Error()})
+		return
+	}
+	memberErr, ok := err.(*deployment.BatchMemberError)
+	if !ok {
+		writeError(w, r, err)
+		return
+	}
+	switch memberErr.Err {
+	case deployment.ErrPackageNotFound:
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid batch request", FieldError{Field: fmt.Sprintf("deployments[%d].packageId", memberErr.Index), Message: memberErr.Err.Error()})
+	case deployment.ErrTemplateNotFound:
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid batch request", FieldError{Field: fmt.Sprintf("deployments[%d].template", memberErr.Index), Message: memberErr.Err.Error()})
+	default:
+		writeError(w, r, memberErr.Err)
+	}
+}
 
-		// Parse out post vairables to be used as deployment template replacements
-		items := make(map[string]string)
-		for key, values := range r.PostForm {
-			if len(values) > 0 {
-				items[key] = values[0]
-			}
-		}
+// Return a batch with the status of each of its deployments
+func BatchDetails(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
 
-		deployment := pkg.DeployPackageTemplate(repo, templateName, items, watch)
-		if err := json.NewEncoder(w).Encode(deployment); err != nil {
-			log.Error.Printf("Failed to encode deployment %s response details: %v", deployment.Id, err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	batch, err := repo.FindBatch(vars["batchId"])
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	writeJSON(w, r, http.StatusOK, batch)
+}
 
-	// If we didn't find it, 404
-	w.WriteHeader(http.StatusNotFound)
-	if err := json.NewEncoder(w).Encode(jsonErr{Code: http.StatusNotFound, Text: "Not Found"}); err != nil {
-		log.Error.Printf("Failed to return 404, encoding error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+// Who made the request, recorded with deployments that keep a history
+func requester(r *http.Request) string {
+	if identity, ok := auth.IdentityFrom(r); ok {
+		return identity.Subject
 	}
-
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func CurrentUser(w http.ResponseWriter, r *http.Request) {
-}
+// Accept a deployment forwarded by another machine during recovery
+func DeploymentForward(w http.ResponseWriter, r *http.Request) {
+	var d deployment.Deployment
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&d); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse forwarded deployment: "+err.Error())
+		return
+	}
+	if d.Id == "" {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid forwarded deployment", FieldError{Field: "id", Message: "is required"})
+		return
+	}
 
-func Authenticate(w http.ResponseWriter, r *http.Request) {
+	if err := repo.AcceptDeployment(&d); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusAccepted, d)
 }
 
-func Users(w http.ResponseWriter, r *http.Request) {
+type deployForm struct {
+	variables   map[string]string
+	watch       bool
+	callbackUrl string
 }
 
-func UserDetails(w http.ResponseWriter, r *http.Request) {
+// Parse the form of a deploy request, form fields are the template
+// variables except for callback_url, and the watch parameter turns
+// watching on or off
+func parseDeployForm(r *http.Request, watch bool) (deployForm, []FieldError) {
+	form := deployForm{watch: watch}
+	if err := r.ParseForm(); err != nil {
+		return form, []FieldError{{Field: "body", Message: err.Error()}}
+	}
+
+	var fields []FieldError
+	if val, ok := r.Form["watch"]; ok {
+		parsed, err := strconv.ParseBool(val[0])
+		if err != nil {
+			fields = append(fields, FieldError{Field: "watch", Message: "must be a boolean"})
+		}
+		form.watch = parsed
+	}
+
+	form.callbackUrl = r.PostForm.Get("callback_url")
+	if err := repo.ValidateCallback(form.callbackUrl); err != nil {
+		fields = append(fields, FieldError{Field: "callback_url", Message: err.Error()})
+	}
+
+	// Parse out post vairables to be used as deployment template replacements
+	form.variables = make(map[string]string)
+	for key, values := range r.PostForm {
+		if len(values) > 0 && key != "callback_url" {
+			form.variables[key] = values[0]
+		}
+	}
+	return form, fields
 }
 
-func UpdateUser(w http.ResponseWriter, r *http.Request) {
+func PackageDeploy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	packageId := vars["packageId"]
+	pkg, err := repo.FindPackage(packageId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !packageAllowed(w, r, "PackageDeploy", pkg.Id, pkg.Tags) {
+		return
+	}
+
+	form, fields := parseDeployForm(r, true)
+	if len(fields) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid deployment request", fields...)
+		return
+	}
+
+	auditVariables(r, form.variables)
+	d := pkg.DeployPackage(repo, form.variables, form.watch, form.callbackUrl)
+	auditDetail(r, "deployment "+d.Id)
+	writeJSON(w, r, http.StatusOK, d)
 }
 
-func CreateUser(w http.ResponseWriter, r *http.Request) {
+func PackageDeployTemplate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	packageId := vars["packageId"]
+	templateName := vars["templateName"]
+	pkg, err := repo.FindPackage(packageId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !packageAllowed(w, r, "PackageDeployTemplate", pkg.Id, pkg.Tags) {
+		return
+	}
+	if !pkg.HasTemplate(templateName) {
+		writeError(w, r, deployment.ErrTemplateNotFound)
+		return
+	}
+
+	form, fields := parseDeployForm(r, false)
+	if len(fields) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid deployment request", fields...)
+		return
+	}
+
+	auditVariables(r, form.variables)
+	d := pkg.DeployPackageTemplate(repo, templateName, form.variables, form.watch, form.callbackUrl)
+	auditDetail(r, "deployment "+d.Id)
+	writeJSON(w, r, http.StatusOK, d)
 }
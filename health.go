@@ -0,0 +1,132 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cchamplin/deployd/log"
+)
+
+const (
+	CHECK_PASS = "pass"
+	CHECK_FAIL = "fail"
+)
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// A failing live check means restarting the process is the only fix
+	live bool
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Implemented by cluster backends that can report on their connection
+type backendHealth interface {
+	Ping() error
+	KeepAliveHealth() (bool, string, error)
+}
+
+func runHealthChecks() []HealthCheck {
+	var checks []HealthCheck
+
+	if health, ok := clstr.Backend.(backendHealth); ok {
+		backend := HealthCheck{Name: "backend", Status: CHECK_PASS}
+		if err := health.Ping(); err != nil {
+			backend.Status = CHECK_FAIL
+			backend.Detail = err.Error()
+		}
+		checks = append(checks, backend)
+
+		active, status, err := health.KeepAliveHealth()
+		keepAlive := HealthCheck{Name: "keepalive", Status: CHECK_PASS, Detail: status, live: !active}
+		if err != nil {
+			keepAlive.Status = CHECK_FAIL
+			keepAlive.Detail = fmt.Sprintf("%v (status: %s)", err, status)
+		}
+		checks = append(checks, keepAlive)
+	} else {
+		checks = append(checks, HealthCheck{Name: "backend", Status: CHECK_PASS, Detail: "clustering disabled"})
+	}
+
+	journal := HealthCheck{Name: "journal", Status: CHECK_PASS}
+	if err := repo.JournalWritable(); err != nil {
+		journal.Status = CHECK_FAIL
+		journal.Detail = err.Error()
+	}
+	checks = append(checks, journal)
+
+	count := repo.PackageCount()
+	packages := HealthCheck{Name: "packages", Status: CHECK_PASS, Detail: fmt.Sprintf("%d packages loaded", count)}
+	if count == 0 {
+		packages.Status = CHECK_FAIL
+	}
+	checks = append(checks, packages)
+
+	replay := HealthCheck{Name: "replay", Status: CHECK_PASS, Detail: "journal replay finished"}
+	if !repo.Replayed() {
+		replay.Status = CHECK_FAIL
+		replay.Detail = "journal replay in progress"
+	}
+	checks = append(checks, replay)
+
+	return checks
+}
+
+// Liveness, only fails when a check can't recover on its own
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, runHealthChecks(), func(check HealthCheck) bool {
+		return check.Status == CHECK_FAIL && check.live
+	})
+}
+
+// Readiness, fails until every check passes
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, runHealthChecks(), func(check HealthCheck) bool {
+		return check.Status == CHECK_FAIL
+	})
+}
+
+func writeHealthReport(w http.ResponseWriter, checks []HealthCheck, failed func(HealthCheck) bool) {
+	report := HealthReport{Status: CHECK_PASS, Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if failed(check) {
+			report.Status = CHECK_FAIL
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error.Printf("Failed to encode health report: %v", err)
+	}
+}
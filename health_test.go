@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cchamplin/deployd/cluster"
+	"github.com/cchamplin/deployd/deployment"
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// Reports whatever keepalive state the test sets
+type testHealthBackend struct {
+	cluster.Backend
+	keepAlive error
+}
+
+func (b *testHealthBackend) Ping() error {
+	return nil
+}
+
+func (b *testHealthBackend) KeepAliveHealth() (bool, string, error) {
+	return b.keepAlive == nil, "Started", b.keepAlive
+}
+
+func TestReadyz(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-health")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "packages.json"), []byte(`[{"id": "php-fpm"}]`), 0644))
+	repo = new(deployment.Repository)
+	repo.Init(dir, true, []string{"*"}, nil, nil, nil)
+	defer func() { repo = nil }()
+	backend := &testHealthBackend{keepAlive: errors.New("keepalive has stopped")}
+	clstr.Backend = backend
+	defer func() { clstr.Backend = nil }()
+
+	readyz := func() (int, HealthReport) {
+		w := httptest.NewRecorder()
+		NewRouter().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		var report HealthReport
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+		return w.Code, report
+	}
+
+	code, report := readyz()
+	assert.Equal(t, 503, code)
+	assert.Equal(t, CHECK_FAIL, report.Status)
+	for _, check := range report.Checks {
+		if check.Name == "keepalive" {
+			assert.Equal(t, CHECK_FAIL, check.Status)
+		} else {
+			assert.Equal(t, CHECK_PASS, check.Status, check.Name)
+		}
+	}
+
+	backend.keepAlive = nil
+	code, report = readyz()
+	assert.Equal(t, 200, code)
+	assert.Equal(t, CHECK_PASS, report.Status)
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,6 +17,8 @@ import (
 type Journal interface {
 	WriteEntry(entry interface{}) bool
 	ReadEntries(marshalFactory func() interface{}) []interface{}
+	Writable() error
+	Sync() error
 }
 
 type FileJournal struct {
@@ -96,6 +100,38 @@ func (j FileJournal) WriteEntry(entry interface{}) bool {
 	return true
 }
 
+// Flush the journal file to disk regardless of the sync settings
+func (j FileJournal) Sync() error {
+	if j.mutex != nil {
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+	}
+	f, err := os.OpenFile(j.FilePath+"deployd.j001", os.O_WRONLY, 0655)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Check that entries can be written without writing one
+func (j FileJournal) Writable() error {
+	filename := j.FilePath + "deployd.j001"
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0655)
+	if os.IsNotExist(err) {
+		f, err = ioutil.TempFile(filepath.Dir(filename), ".deployd-probe")
+		if err == nil {
+			defer os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func (j FileJournal) ReadEntries(marshalFactory func() interface{}) (entries []interface{}) {
 	filename := j.FilePath + "deployd.j001"
 	f, err := os.OpenFile(filename, os.O_RDONLY, 0000)
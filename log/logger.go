@@ -23,10 +23,13 @@
 package log
 
 import (
+	"context"
 	"io"
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/satori/go.uuid"
 )
 
 var (
@@ -59,18 +62,77 @@ func InitLogger(
 		log.Ldate|log.Ltime|log.Lshortfile)
 }
 
+const RequestIdHeader = "X-Request-Id"
+
+type requestIdKey struct{}
+
+// Tag every request with an id that is returned to the client and
+// included in the request log, a client supplied id is kept when
+// it's reasonable
+func RequestTracker(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if !validRequestId(id) {
+			id = uuid.NewV4().String()
+		}
+		w.Header().Set(RequestIdHeader, id)
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// The id RequestTracker gave the request
+func RequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// Remembers the status a handler answered with
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	if s.Status == 0 {
+		s.Status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *StatusRecorder) Write(data []byte) (int, error) {
+	if s.Status == 0 {
+		s.Status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
 func Logger(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		recorder := &StatusRecorder{ResponseWriter: w}
 
-		inner.ServeHTTP(w, r)
+		inner.ServeHTTP(recorder, r)
 
 		Trace.Printf(
-			"%s\t%s\t%s\t%s",
+			"%s\t%s\t%s\t%d\t%s\t%s",
 			r.Method,
 			r.RequestURI,
 			name,
+			recorder.Status,
 			time.Since(start),
+			RequestId(r),
 		)
 	})
 }
@@ -23,14 +23,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	golog "log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	GoTemplate "text/template"
+	"time"
 
+	"github.com/cchamplin/deployd/audit"
+	"github.com/cchamplin/deployd/auth"
+	_ "github.com/cchamplin/deployd/backends/audit"
+	_ "github.com/cchamplin/deployd/backends/auth"
 	backends "github.com/cchamplin/deployd/backends/cluster"
 	"github.com/cchamplin/deployd/cluster"
 	"github.com/cchamplin/deployd/conf"
@@ -41,6 +49,40 @@ import (
 var repo *deployment.Repository
 var clstr cluster.Cluster
 
+const DefaultShutdownTimeout = 60 * time.Second
+
+var shutdownComplete = make(chan struct{})
+
+// Implemented by cluster backends that can leave the cluster on purpose
+type deregisterer interface {
+	Deregister()
+}
+
+// Stop taking requests on SIGTERM or SIGINT, give running deployments
+// time to finish, flush the journal and then leave the cluster
+func shutdownOnSignal(server *http.Server, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Info.Printf("Received %v, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error.Printf("Failed to stop serving requests: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if !repo.Shutdown(time.Until(deadline)) {
+			log.Warning.Printf("Shutting down with deployments still running")
+		}
+	}
+	if backend, ok := clstr.Backend.(deregisterer); ok {
+		backend.Deregister()
+	}
+	log.Info.Printf("Shutdown complete")
+	close(shutdownComplete)
+}
+
 func main() {
 	// TODO refactor this, probably split it out into a separate file
 	// TODO handle environment variables for alternative mechanism to set flags
@@ -61,6 +103,15 @@ func main() {
 	} else {
 		log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, os.Stderr)
 	}
+
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "package":
+			os.Exit(packageCommand(*configFlag, flag.Args()[1:]))
+		default:
+			golog.Fatalf("Unknown command %s", flag.Arg(0))
+		}
+	}
 	var config *conf.ServerConfiguration
 	if configFromFlag != nil && len(*configFromFlag) > 0 {
 		if endpointFlag == nil || len(*endpointFlag) == 0 {
@@ -86,7 +137,10 @@ func main() {
 		} else {
 			clstr.Init(backend, *configFlag)
 		}
-		backend.Init(&clstr, cluster.LocalMachine(config.Addr+":"+strconv.Itoa(config.Port), config.AllowedTags))
+		machine := cluster.LocalMachine(config.Addr+":"+strconv.Itoa(config.Port), config.AllowedTags)
+		machine.AllowUntagged = config.AllowUntagged
+		machine.Secure = config.TLSCert != ""
+		backend.Init(&clstr, machine)
 
 	}
 	// Initialize repo
@@ -103,11 +157,82 @@ func main() {
 		funcMap = GoTemplate.FuncMap{"getv": clstr.Backend.GetValue, "getvs": clstr.Backend.GetValues, "gets": clstr.Backend.GetString}
 	}
 
+	repo.ConfigureCallbacks(config.CallbackHosts, config.CallbackSecret)
 	repo.Init(*configFlag, config.AllowUntagged, config.AllowedTags, journal, funcMap, clstr.Backend)
 
+	endpoint := config.Addr + ":" + strconv.Itoa(config.Port)
+	if len(config.Auth) > 0 {
+		// The default backend keeps users.json in the config directory
+		if _, ok := config.Auth["path"]; !ok {
+			config.Auth["path"] = *configFlag
+		}
+		a, err := auth.AuthFromConfig(config.Auth)
+		if err != nil {
+			golog.Fatalf("Failed to configure authentication: %v", err)
+		}
+		authenticator = a
+		// Revoked tokens are shared through the cluster so every node
+		// rejects them
+		if list, ok := clstr.Backend.(auth.RevocationList); ok && !*clusterFlag {
+			authenticator.Revocations = list
+		}
+		if len(authenticator.CertRules) > 0 && config.ClientCA == "" {
+			log.Warning.Printf("client-certs rules are configured without a client-ca, no certificate will be accepted")
+		}
+		// Other machines accept our forwarded deployments with a token
+		// signed by the key they share with us
+		cluster.ForwardAuthorization = func() string {
+			token, _, err := authenticator.CreateToken(auth.User{Id: "machine:" + endpoint, Name: endpoint, Roles: []string{"cluster"}})
+			if err != nil {
+				log.Error.Printf("Failed to sign forwarding token: %v", err)
+			}
+			return "Bearer " + token
+		}
+	} else {
+		log.Warning.Printf("No auth section is configured, anyone who can reach the API can deploy packages")
+	}
+	if len(config.Audit) > 0 {
+		l, err := audit.FromConfig(config.Audit)
+		if err != nil {
+			golog.Fatalf("Failed to configure the audit log: %v", err)
+		}
+		auditLog = l
+	}
+
 	// Intialize the router
 	router := NewRouter()
 
 	// Start the server
-	golog.Fatal(http.ListenAndServe(config.Addr+":"+strconv.Itoa(config.Port), router))
+	server := &http.Server{Addr: config.Addr + ":" + strconv.Itoa(config.Port), Handler: router}
+	if config.TLSCert != "" {
+		tlsConfig, store, err := serverTLSConfig(config)
+		if err != nil {
+			golog.Fatalf("Failed to configure TLS: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+		cluster.ForwardTLSConfig = store.clientTLSConfig
+	}
+
+	shutdownTimeout := DefaultShutdownTimeout
+	if config.ShutdownTimeout != "" {
+		timeout, err := time.ParseDuration(config.ShutdownTimeout)
+		if err != nil {
+			golog.Fatalf("Invalid shutdown-timeout %s: %v", config.ShutdownTimeout, err)
+		}
+		shutdownTimeout = timeout
+	}
+	go shutdownOnSignal(server, shutdownTimeout)
+
+	var err error
+	if server.TLSConfig != nil {
+		log.Info.Printf("Serving over TLS")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		golog.Fatal(err)
+	}
+	// Serving stops as soon as shutdown begins, wait for it to finish
+	<-shutdownComplete
 }
@@ -0,0 +1,643 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cchamplin/deployd/audit"
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/deployment"
+	"github.com/cchamplin/deployd/log"
+)
+
+// Description of a single method on a route, path parameters are
+// taken from the route pattern
+type apiOperation struct {
+	Summary     string
+	Params      []apiParam
+	BodyType    string
+	BodySchema  interface{}
+	Responses   map[int]apiResponse
+	Description string
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+	Type        string
+	Repeated    bool
+}
+
+type apiResponse struct {
+	Description string
+	ContentType string
+	// A value of the type the response carries, a slice for lists
+	Schema interface{}
+}
+
+var (
+	errorResponse = func(description string) apiResponse {
+		return apiResponse{Description: description, ContentType: "application/problem+json", Schema: Problem{}}
+	}
+	packageErrors = map[int]apiResponse{
+		http.StatusForbidden: errorResponse("Package tags are not allowed on this machine or your permissions exclude the package"),
+		http.StatusNotFound:  errorResponse("No such package"),
+	}
+	// Answered to modifying requests without a current If-Match
+	preconditionErrors = map[int]apiResponse{
+		http.StatusPreconditionFailed:   errorResponse("The resource changed since the If-Match ETag was read"),
+		http.StatusPreconditionRequired: errorResponse("The request has no If-Match header"),
+	}
+	userErrors = map[int]apiResponse{
+		http.StatusNotFound:       errorResponse("No such user or authentication is not configured"),
+		http.StatusNotImplemented: errorResponse("The authentication backend does not manage users"),
+	}
+	apiKeyErrors = map[int]apiResponse{
+		http.StatusNotFound:       errorResponse("No such API key or authentication is not configured"),
+		http.StatusNotImplemented: errorResponse("The authentication backend does not store API keys"),
+	}
+	// Answered by routes that require a token
+	authErrors = map[int]apiResponse{
+		http.StatusUnauthorized: errorResponse("The bearer token or API key is missing, invalid or expired"),
+		http.StatusForbidden:    errorResponse("None of the token's roles grant the permission"),
+	}
+	// Every route can answer with these
+	commonErrors = map[int]apiResponse{
+		http.StatusMethodNotAllowed:    errorResponse("The method is not allowed on the route"),
+		http.StatusInternalServerError: errorResponse("Unexpected failure, see the logs for the request id"),
+	}
+)
+
+const (
+	notModifiedDescription = "The response carries an ETag, a request whose If-None-Match lists it is answered with 304."
+	ifMatchDescription     = "The If-Match header must carry the ETag the change was made against."
+)
+
+func withResponses(responses map[int]apiResponse, more map[int]apiResponse) map[int]apiResponse {
+	merged := make(map[int]apiResponse, len(responses)+len(more))
+	for code, response := range responses {
+		merged[code] = response
+	}
+	for code, response := range more {
+		merged[code] = response
+	}
+	return merged
+}
+
+// Every route in the routes table is described here by route name
+// and method, TestOpenAPIDescribesRoutes keeps the two in step
+var apiDocs = map[string]map[string]apiOperation{
+	"Index": {
+		"GET": {Summary: "Service banner", Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "The service is running", ContentType: "text/plain"},
+		}},
+	},
+	"OpenAPI": {
+		"GET": {Summary: "This document", Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "The OpenAPI 3 description of the API"},
+		}},
+	},
+	"Healthz": {
+		"GET": {Summary: "Liveness, fails only when restarting is the remedy", Responses: map[int]apiResponse{
+			http.StatusOK:                 {Description: "Alive", Schema: HealthReport{}},
+			http.StatusServiceUnavailable: {Description: "A check failed that won't recover", Schema: HealthReport{}},
+		}},
+	},
+	"Readyz": {
+		"GET": {Summary: "Readiness, fails until every check passes", Responses: map[int]apiResponse{
+			http.StatusOK:                 {Description: "Ready", Schema: HealthReport{}},
+			http.StatusServiceUnavailable: {Description: "At least one check failed", Schema: HealthReport{}},
+		}},
+	},
+	"Packages": {
+		"GET": {Summary: "List the packages allowed on this machine", Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "Packages", Schema: []deployment.Package{}},
+		}},
+		"POST": {Summary: "List the packages allowed on this machine", Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "Packages", Schema: []deployment.Package{}},
+		}},
+	},
+	"PackageImport": {
+		"POST": {
+			Summary:     "Install a package bundle",
+			Description: "The bundle is the raw request body or the bundle field of a multipart form.",
+			Params:      []apiParam{{Name: "id", Description: "Install the package under this id instead"}},
+			BodyType:    "application/gzip",
+			Responses: map[int]apiResponse{
+				http.StatusCreated:    {Description: "The installed package", Schema: deployment.Package{}},
+				http.StatusBadRequest: errorResponse("The bundle is invalid"),
+				http.StatusConflict:   errorResponse("A package with the id already exists"),
+			},
+		},
+	},
+	"PackageDetails": {
+		"GET": {Summary: "Package details", Description: notModifiedDescription, Responses: withResponses(packageErrors, map[int]apiResponse{
+			http.StatusOK:          {Description: "The package", Schema: deployment.Package{}},
+			http.StatusNotModified: {Description: "The package still matches If-None-Match"},
+		})},
+		"PUT": {
+			Summary:     "Replace a package definition",
+			Description: ifMatchDescription + " Only packages defined in JSON files can be edited.",
+			BodyType:    "application/json",
+			BodySchema:  deployment.PackageDef{},
+			Responses: withResponses(packageErrors, withResponses(preconditionErrors, map[int]apiResponse{
+				http.StatusOK:         {Description: "The updated package", Schema: deployment.Package{}},
+				http.StatusBadRequest: errorResponse("The definition is invalid"),
+				http.StatusConflict:   errorResponse("The package can't be edited through the API"),
+			})),
+		},
+	},
+	"PackageBundle": {
+		"GET": {Summary: "Export a package as a bundle", Responses: withResponses(packageErrors, map[int]apiResponse{
+			http.StatusOK:                  {Description: "The package bundle", ContentType: "application/gzip"},
+			http.StatusInternalServerError: errorResponse("The package could not be exported"),
+		})},
+	},
+	"PackageDeploy": {
+		"POST": {
+			Summary:     "Deploy a package",
+			Description: "Form fields are the template variables of the deployment.",
+			Params:      []apiParam{{Name: "watch", Description: "Redeploy templates when watched keys change", Type: "boolean"}},
+			BodyType:    "application/x-www-form-urlencoded",
+			BodySchema:  map[string]string{},
+			Responses: withResponses(packageErrors, map[int]apiResponse{
+				http.StatusOK:         {Description: "The started deployment", Schema: deployment.Deployment{}},
+				http.StatusBadRequest: errorResponse("The form could not be parsed"),
+			}),
+		},
+	},
+	"PackageDeployTemplate": {
+		"POST": {
+			Summary:     "Deploy a single template of a package",
+			Description: "Form fields are the template variables of the deployment.",
+			Params:      []apiParam{{Name: "watch", Description: "Redeploy the template when watched keys change", Type: "boolean"}},
+			BodyType:    "application/x-www-form-urlencoded",
+			BodySchema:  map[string]string{},
+			Responses: withResponses(packageErrors, map[int]apiResponse{
+				http.StatusOK:         {Description: "The started deployment", Schema: deployment.Deployment{}},
+				http.StatusBadRequest: errorResponse("The form could not be parsed"),
+				http.StatusNotFound:   errorResponse("No such package or template"),
+			}),
+		},
+	},
+	"Deployments": {
+		"GET": {
+			Summary:     "List deployments",
+			Description: "Variables are matched with var.<name>=<value>. The cursor for the next page is returned in the X-Next-Cursor and Link headers.",
+			Params: []apiParam{
+				{Name: "status", Description: "Deployment status, repeated or comma separated", Repeated: true},
+				{Name: "packageId", Description: "Package the deployment was made from"},
+				{Name: "template", Description: "Template of a single template deployment"},
+				{Name: "since", Description: "Created at or after, RFC 3339", Type: "date-time"},
+				{Name: "until", Description: "Created before, RFC 3339", Type: "date-time"},
+				{Name: "sort", Description: "createdAt, startedAt, finishedAt, status, packageId or id, prefixed with - for descending order"},
+				{Name: "limit", Description: "Page size", Type: "integer"},
+				{Name: "cursor", Description: "Cursor of the page to return"},
+			},
+			Responses: map[int]apiResponse{
+				http.StatusOK:         {Description: "Deployments", Schema: []deployment.Deployment{}},
+				http.StatusBadRequest: errorResponse("The query is invalid"),
+			},
+		},
+	},
+	"Audit": {
+		"GET": {
+			Summary:     "Query the audit log",
+			Description: "Every request that changes something and every login is recorded. Entries are returned newest first, secret variable values are redacted.",
+			Params: []apiParam{
+				{Name: "action", Description: "Route name of the action, e.g. PackageDeploy or Login"},
+				{Name: "principal", Description: "Who made the request"},
+				{Name: "resource", Description: "Prefix of the resource acted on, e.g. /packages/php"},
+				{Name: "since", Description: "Recorded at or after, RFC 3339", Type: "date-time"},
+				{Name: "until", Description: "Recorded before, RFC 3339", Type: "date-time"},
+				{Name: "limit", Description: "Maximum number of entries, 100 by default", Type: "integer"},
+			},
+			Responses: map[int]apiResponse{
+				http.StatusOK:         {Description: "Matching entries", Schema: []audit.Entry{}},
+				http.StatusBadRequest: errorResponse("The query is invalid"),
+				http.StatusNotFound:   errorResponse("The audit log is not configured"),
+			},
+		},
+	},
+	"DeploymentDetails": {
+		"GET": {Summary: "Deployment details", Description: notModifiedDescription, Responses: map[int]apiResponse{
+			http.StatusOK:          {Description: "The deployment", Schema: deployment.Deployment{}},
+			http.StatusNotModified: {Description: "The deployment still matches If-None-Match"},
+			http.StatusNotFound:    errorResponse("No such deployment"),
+		}},
+	},
+	"DeploymentRedeploy": {
+		"POST": {
+			Summary:    "Run a deployment again with its stored variables",
+			BodyType:   "application/json",
+			BodySchema: deployment.RedeployOptions{},
+			Responses: map[int]apiResponse{
+				http.StatusOK:         {Description: "The new deployment", Schema: deployment.Deployment{}},
+				http.StatusBadRequest: errorResponse("The request is invalid or names an unknown template"),
+				http.StatusForbidden:  errorResponse("Package tags are not allowed on this machine"),
+				http.StatusNotFound:   errorResponse("No such deployment or package"),
+			},
+		},
+	},
+	"DeploymentUndeploy": {
+		"POST": {
+			Summary: "Undo a finished deployment",
+			Responses: withResponses(packageErrors, map[int]apiResponse{
+				http.StatusAccepted: {Description: "The deployment being undeployed", Schema: deployment.Deployment{}},
+				http.StatusNotFound: errorResponse("No such deployment or package"),
+				http.StatusConflict: errorResponse("The deployment is still running"),
+			}),
+		},
+	},
+	"DeploymentBatch": {
+		"POST": {
+			Summary:    "Deploy several packages as one unit, rolling back on failure",
+			BodyType:   "application/json",
+			BodySchema: deployment.BatchRequest{},
+			Responses: map[int]apiResponse{
+				http.StatusAccepted:   {Description: "The batch was started", Schema: deployment.Batch{}},
+				http.StatusBadRequest: errorResponse("The request is invalid or names an unknown package or template"),
+				http.StatusForbidden:  errorResponse("Package tags are not allowed on this machine"),
+			},
+		},
+	},
+	"BatchDetails": {
+		"GET": {
+			Summary: "A batch and the status of its deployments",
+			Responses: map[int]apiResponse{
+				http.StatusOK:       {Description: "The batch", Schema: deployment.Batch{}},
+				http.StatusNotFound: errorResponse("No such batch"),
+			},
+		},
+	},
+	"DeploymentForward": {
+		"POST": {
+			Summary:    "Accept a deployment forwarded by another machine during recovery",
+			BodyType:   "application/json",
+			BodySchema: deployment.Deployment{},
+			Responses: withResponses(packageErrors, map[int]apiResponse{
+				http.StatusAccepted:   {Description: "The deployment was accepted", Schema: deployment.Deployment{}},
+				http.StatusBadRequest: errorResponse("The deployment could not be parsed"),
+				http.StatusConflict:   errorResponse("The package definition does not match"),
+			}),
+		},
+	},
+	"CurrentUser": {
+		"GET": {Summary: "The identity and roles of the request's token", Responses: map[int]apiResponse{
+			http.StatusOK:       {Description: "The identity", Schema: auth.Identity{}},
+			http.StatusNotFound: errorResponse("Authentication is not configured"),
+		}},
+	},
+	"Login": {
+		"POST": {
+			Summary:     "Exchange a username and password for a bearer token",
+			Description: "The credentials are a JSON body or the username and password form fields.",
+			BodyType:    "application/json",
+			BodySchema:  LoginRequest{},
+			Responses: map[int]apiResponse{
+				http.StatusOK:           {Description: "The signed access token and refresh token", Schema: TokenResponse{}},
+				http.StatusBadRequest:   errorResponse("The username or password is missing"),
+				http.StatusUnauthorized: errorResponse("The credentials are invalid"),
+				http.StatusNotFound:     errorResponse("Authentication is not configured"),
+			},
+		},
+	},
+	"Logout": {
+		"DELETE": {
+			Summary:     "Revoke the request's bearer token and a refresh token",
+			Description: "The refresh token is a JSON body or the refreshToken form field. Revoked tokens are rejected by every node.",
+			BodyType:    "application/json",
+			BodySchema:  RefreshRequest{},
+			Responses: map[int]apiResponse{
+				http.StatusNoContent:    {Description: "The tokens were revoked"},
+				http.StatusBadRequest:   errorResponse("Neither a bearer token nor a refresh token was given"),
+				http.StatusUnauthorized: errorResponse("The refresh token is invalid or belongs to another user"),
+				http.StatusNotFound:     errorResponse("Authentication is not configured"),
+			},
+		},
+	},
+	"RefreshToken": {
+		"POST": {
+			Summary:     "Exchange a refresh token for a new access token and refresh token",
+			Description: "The refresh token is a JSON body or the refreshToken form field. It is revoked once used.",
+			BodyType:    "application/json",
+			BodySchema:  RefreshRequest{},
+			Responses: map[int]apiResponse{
+				http.StatusOK:           {Description: "The new tokens", Schema: TokenResponse{}},
+				http.StatusBadRequest:   errorResponse("The refresh token is missing"),
+				http.StatusUnauthorized: errorResponse("The refresh token is invalid, expired or was already used"),
+				http.StatusNotFound:     errorResponse("Authentication is not configured"),
+			},
+		},
+	},
+	"Users": {
+		"GET": {Summary: "List users", Responses: withResponses(userErrors, map[int]apiResponse{
+			http.StatusOK: {Description: "Users, without their password hashes", Schema: []auth.User{}},
+		})},
+		"POST": {
+			Summary:    "Create a user",
+			BodyType:   "application/json",
+			BodySchema: UserRequest{},
+			Responses: withResponses(userErrors, map[int]apiResponse{
+				http.StatusCreated:    {Description: "The created user", Schema: auth.User{}},
+				http.StatusBadRequest: errorResponse("The user is invalid or names an unknown role"),
+				http.StatusConflict:   errorResponse("A user with the id already exists"),
+			}),
+		},
+	},
+	"APIKeys": {
+		"GET": {Summary: "List API keys, without their secrets", Responses: withResponses(apiKeyErrors, map[int]apiResponse{
+			http.StatusOK: {Description: "API keys, revoked ones included", Schema: []auth.APIKey{}},
+		})},
+		"POST": {
+			Summary:     "Create an API key owned by the caller",
+			Description: "The key is only returned in this response. It can't be given permissions the caller's roles don't grant.",
+			BodyType:    "application/json",
+			BodySchema:  APIKeyRequest{},
+			Responses: withResponses(apiKeyErrors, map[int]apiResponse{
+				http.StatusCreated:    {Description: "The key and its details", Schema: APIKeyResponse{}},
+				http.StatusBadRequest: errorResponse("The key is invalid or has permissions the caller lacks"),
+			}),
+		},
+	},
+	"APIKeyDetails": {
+		"GET": {Summary: "API key details", Responses: withResponses(apiKeyErrors, map[int]apiResponse{
+			http.StatusOK: {Description: "The key, without its secret", Schema: auth.APIKey{}},
+		})},
+		"DELETE": {Summary: "Revoke an API key", Responses: withResponses(apiKeyErrors, map[int]apiResponse{
+			http.StatusNoContent: {Description: "The key was revoked"},
+		})},
+	},
+	"UserDetails": {
+		"GET": {Summary: "User details", Description: notModifiedDescription, Responses: withResponses(userErrors, map[int]apiResponse{
+			http.StatusOK:          {Description: "The user", Schema: auth.User{}},
+			http.StatusNotModified: {Description: "The user still matches If-None-Match"},
+		})},
+		"PUT": {
+			Summary:     "Replace a user, the password is kept unless a new one is given",
+			Description: ifMatchDescription,
+			BodyType:    "application/json",
+			BodySchema:  UserRequest{},
+			Responses: withResponses(userErrors, withResponses(preconditionErrors, map[int]apiResponse{
+				http.StatusOK:         {Description: "The updated user", Schema: auth.User{}},
+				http.StatusBadRequest: errorResponse("The user is invalid or names an unknown role"),
+			})),
+		},
+		"DELETE": {
+			Summary:     "Delete a user",
+			Description: ifMatchDescription,
+			Responses: withResponses(userErrors, withResponses(preconditionErrors, map[int]apiResponse{
+				http.StatusNoContent: {Description: "The user was deleted"},
+			})),
+		},
+	},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// Builds the OpenAPI 3 document from the routes table and apiDocs
+func openAPIDocument() map[string]interface{} {
+	builtinRoles := auth.BuiltinRoles()
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+
+	for _, route := range routes {
+		docs := apiDocs[route.Name]
+		path := pathParamPattern.ReplaceAllString(routePath(route), "{$1}")
+		item, ok := paths[path]
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+
+		for _, method := range route.Methods {
+			operation, ok := docs[method]
+			if !ok {
+				continue
+			}
+
+			var params []interface{}
+			for _, match := range pathParamPattern.FindAllStringSubmatch(route.Pattern, -1) {
+				params = append(params, map[string]interface{}{
+					"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+				})
+			}
+			for _, param := range operation.Params {
+				params = append(params, map[string]interface{}{
+					"name": param.Name, "in": "query", "description": param.Description, "schema": paramSchema(param),
+				})
+			}
+
+			// Documented with the built-in roles, configured roles can
+			// open up more routes
+			public := builtinRoles.Allowed([]string{auth.ANONYMOUS}, route.Name, auth.MethodFlag(method))
+			responses := withResponses(commonErrors, operation.Responses)
+			if !public {
+				responses = withResponses(authErrors, responses)
+			}
+			op := map[string]interface{}{
+				"operationId": route.Name + strings.Title(strings.ToLower(method)),
+				"summary":     operation.Summary,
+				"responses":   responsesDocument(responses, schemas),
+			}
+			if public {
+				op["security"] = []interface{}{}
+			}
+			if operation.Description != "" {
+				op["description"] = operation.Description
+			}
+			if len(params) > 0 {
+				op["parameters"] = params
+			}
+			if operation.BodyType != "" {
+				schema := map[string]interface{}{"type": "string", "format": "binary"}
+				if operation.BodySchema != nil {
+					schema = schemaFor(reflect.TypeOf(operation.BodySchema), schemas)
+				}
+				op["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content":  map[string]interface{}{operation.BodyType: map[string]interface{}{"schema": schema}},
+				}
+			}
+			item[strings.ToLower(method)] = op
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "deployd",
+			"description": "Deploys packages of templates and commands across a cluster",
+			"version":     "1",
+		},
+		"paths": paths,
+		"security": []interface{}{
+			map[string]interface{}{"bearerAuth": []interface{}{}},
+			map[string]interface{}{"apiKeyAuth": []interface{}{}},
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": "An API key from POST /v1/apikeys, sent as ApiKey <key>",
+				},
+			},
+		},
+	}
+}
+
+func paramSchema(param apiParam) map[string]interface{} {
+	schema := map[string]interface{}{"type": "string"}
+	switch param.Type {
+	case "boolean", "integer":
+		schema["type"] = param.Type
+	case "date-time":
+		schema["format"] = param.Type
+	}
+	if param.Repeated {
+		return map[string]interface{}{"type": "array", "items": schema}
+	}
+	return schema
+}
+
+func responsesDocument(responses map[int]apiResponse, schemas map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for code, response := range responses {
+		doc := map[string]interface{}{"description": response.Description}
+		if response.Schema != nil {
+			contentType := response.ContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			doc["content"] = map[string]interface{}{
+				contentType: map[string]interface{}{"schema": schemaFor(reflect.TypeOf(response.Schema), schemas)},
+			}
+		} else if response.ContentType != "" {
+			doc["content"] = map[string]interface{}{response.ContentType: map[string]interface{}{}}
+		}
+		result[strconv.Itoa(code)] = doc
+	}
+	return result
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Schema for a type following the encoding/json rules, our own named
+// structs are added to schemas and referenced. Types from other
+// packages are described as free form objects.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if !strings.HasPrefix(t.PkgPath(), "github.com/cchamplin/deployd") {
+			return map[string]interface{}{"type": "object"}
+		}
+		name := schemaName(t)
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, ok := schemas[name]; ok {
+			return ref
+		}
+		// Reserve the name first so recursive types terminate
+		schemas[name] = nil
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			// Embedded structs are flattened like encoding/json does
+			if field.Anonymous && field.Tag.Get("json") == "" && field.Type.Kind() == reflect.Struct {
+				schemaFor(field.Type, schemas)
+				if embedded, ok := schemas[schemaName(field.Type)].(map[string]interface{}); ok {
+					for embeddedName, schema := range embedded["properties"].(map[string]interface{}) {
+						properties[embeddedName] = schema
+					}
+				}
+				continue
+			}
+			fieldName := field.Name
+			if tag := field.Tag.Get("json"); tag != "" {
+				tagName := strings.Split(tag, ",")[0]
+				if tagName == "-" {
+					continue
+				}
+				if tagName != "" {
+					fieldName = tagName
+				}
+			}
+			properties[fieldName] = schemaFor(field.Type, schemas)
+		}
+		schemas[name] = map[string]interface{}{"type": "object", "properties": properties}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+func schemaName(t reflect.Type) string {
+	switch t {
+	case reflect.TypeOf(Problem{}):
+		return "Error"
+	}
+	return t.Name()
+}
+
+// Built by NewRouter, the routes table can't be referenced from a
+// handler it contains
+var openAPISpec map[string]interface{}
+
+// Serve the OpenAPI description of the API
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(openAPISpec); err != nil {
+		log.Error.Printf("Failed to encode OpenAPI document: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPIDescribesRoutes(t *testing.T) {
+	names := make(map[string]bool)
+	for _, route := range routes {
+		names[route.Name] = true
+		for _, method := range route.Methods {
+			_, ok := apiDocs[route.Name][method]
+			assert.True(t, ok, "route %s %s %s is not described in apiDocs", route.Name, method, route.Pattern)
+		}
+	}
+	for name := range apiDocs {
+		assert.True(t, names[name], "apiDocs describes %s which is not in the routes table", name)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	w := httptest.NewRecorder()
+	NewRouter().ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	assert.Equal(t, 200, w.Code)
+
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.True(t, strings.HasPrefix(doc.OpenAPI, "3."))
+
+	for _, route := range routes {
+		for _, method := range route.Methods {
+			_, ok := doc.Paths[routePath(route)][strings.ToLower(method)]
+			assert.True(t, ok, "%s %s is missing from the document", method, routePath(route))
+		}
+	}
+	for _, schema := range []string{"Deployment", "Package", "Template", "Error"} {
+		assert.NotNil(t, doc.Components.Schemas[schema], "schema %s is missing", schema)
+	}
+	assert.Contains(t, doc.Components.Schemas["Deployment"]["properties"], "packageId")
+}
@@ -35,23 +35,68 @@ func addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// Every route is served under the version prefix, the unprefixed
+// paths are kept as deprecated aliases
+const APIVersionPrefix = "/v1"
+
+// Probes are pointed at these paths, they aren't part of the
+// versioned API
+var unversionedRoutes = map[string]bool{
+	"Healthz": true,
+	"Readyz":  true,
+}
+
+// The path a route is served at
+func routePath(route Route) string {
+	if unversionedRoutes[route.Name] {
+		return route.Pattern
+	}
+	return APIVersionPrefix + route.Pattern
+}
+
+// Mark responses from an unprefixed path as deprecated and point to
+// the versioned one
+func deprecatedAlias(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+APIVersionPrefix+r.URL.Path+">; rel=\"successor-version\"")
+		fn(w, r)
+	}
+}
+
 func NewRouter() *mux.Router {
 
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range routes {
 		var handler http.Handler
 
-		handler = addDefaultHeaders(route.HandlerFunc)
+		handler = addDefaultHeaders(authorizeRoute(route.Name, auditRoute(route.Name, route.HandlerFunc)))
 		handler = log.Logger(handler, route.Name)
+		handler = log.RequestTracker(handler)
 
+		// The path is matched before the method, a route that only
+		// matches the method would hide a 405 from an earlier one
 		router.
+			Path(routePath(route)).
 			Methods(route.Methods...).
-			Path(route.Pattern).
 			//Headers("Content-Type", "application/json; charset=UTF-8").
 			Name(route.Name).
 			Handler(handler)
 
+		if unversionedRoutes[route.Name] {
+			continue
+		}
+		handler = addDefaultHeaders(deprecatedAlias(authorizeRoute(route.Name, auditRoute(route.Name, route.HandlerFunc))))
+		handler = log.Logger(handler, route.Name)
+		handler = log.RequestTracker(handler)
+		router.
+			Path(route.Pattern).
+			Methods(route.Methods...).
+			Handler(handler)
 	}
+	router.NotFoundHandler = log.RequestTracker(log.Logger(http.HandlerFunc(notFound), "NotFound"))
+	router.MethodNotAllowedHandler = log.RequestTracker(log.Logger(http.HandlerFunc(methodNotAllowed), "MethodNotAllowed"))
+	openAPISpec = openAPIDocument()
 
 	return router
 }
@@ -40,18 +40,48 @@ var routes = Routes{
 		"/",
 		Index,
 	},
+	Route{
+		"OpenAPI",
+		[]string{"GET"},
+		"/openapi.json",
+		OpenAPI,
+	},
+	Route{
+		"Healthz",
+		[]string{"GET"},
+		"/healthz",
+		Healthz,
+	},
+	Route{
+		"Readyz",
+		[]string{"GET"},
+		"/readyz",
+		Readyz,
+	},
 	Route{
 		"Packages",
 		[]string{"GET", "POST"},
 		"/packages",
 		Packages,
 	},
+	Route{
+		"PackageImport",
+		[]string{"POST"},
+		"/packages/import",
+		PackageImport,
+	},
 	Route{
 		"PackageDetails",
 		[]string{"GET", "PUT"},
 		"/packages/{packageId}",
 		PackageDetails,
 	},
+	Route{
+		"PackageBundle",
+		[]string{"GET"},
+		"/packages/{packageId}/bundle",
+		PackageBundle,
+	},
 	Route{
 		"PackageDeploy",
 		[]string{"POST"},
@@ -70,12 +100,42 @@ var routes = Routes{
 		"/deployments",
 		Deployments,
 	},
+	Route{
+		"DeploymentBatch",
+		[]string{"POST"},
+		"/deployments/batch",
+		DeploymentBatch,
+	},
+	Route{
+		"BatchDetails",
+		[]string{"GET"},
+		"/deployments/batch/{batchId}",
+		BatchDetails,
+	},
 	Route{
 		"DeploymentDetails",
 		[]string{"GET"},
 		"/deployments/{deploymentId}",
 		DeploymentDetails,
 	},
+	Route{
+		"DeploymentRedeploy",
+		[]string{"POST"},
+		"/deployments/{deploymentId}/redeploy",
+		DeploymentRedeploy,
+	},
+	Route{
+		"DeploymentUndeploy",
+		[]string{"POST"},
+		"/deployments/{deploymentId}/undeploy",
+		DeploymentUndeploy,
+	},
+	Route{
+		"DeploymentForward",
+		[]string{"POST"},
+		"/deployments/forward",
+		DeploymentForward,
+	},
 	Route{
 		"CurrentUser",
 		[]string{"GET"},
@@ -88,6 +148,18 @@ var routes = Routes{
 		"/auth",
 		Authenticate,
 	},
+	Route{
+		"Logout",
+		[]string{"DELETE"},
+		"/auth",
+		Logout,
+	},
+	Route{
+		"RefreshToken",
+		[]string{"POST"},
+		"/auth/refresh",
+		RefreshToken,
+	},
 	Route{
 		"Users",
 		[]string{"GET", "POST"},
@@ -96,8 +168,26 @@ var routes = Routes{
 	},
 	Route{
 		"UserDetails",
-		[]string{"GET", "PUT"},
+		[]string{"GET", "PUT", "DELETE"},
 		"/users/{userId}",
 		UserDetails,
 	},
+	Route{
+		"APIKeys",
+		[]string{"GET", "POST"},
+		"/apikeys",
+		APIKeys,
+	},
+	Route{
+		"APIKeyDetails",
+		[]string{"GET", "DELETE"},
+		"/apikeys/{keyId}",
+		APIKeyDetails,
+	},
+	Route{
+		"Audit",
+		[]string{"GET"},
+		"/audit",
+		Audit,
+	},
 }
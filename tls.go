@@ -0,0 +1,210 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cchamplin/deployd/conf"
+	"github.com/cchamplin/deployd/log"
+)
+
+// How often certificate files are checked for changes
+var CertificatePollInterval = 30 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Holds the server certificate and client CA pool, both are reloaded
+// from disk when the files change so they can be rotated in place
+type certificateStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modified map[string]time.Time
+}
+
+func newCertificateStore(certFile, keyFile, caFile string) (*certificateStore, error) {
+	store := &certificateStore{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *certificateStore) load() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading %s: %v", s.certFile, err)
+	}
+	var pool *x509.CertPool
+	if s.caFile != "" {
+		data, err := ioutil.ReadFile(s.caFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %v", s.caFile, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("loading %s: no certificates found", s.caFile)
+		}
+	}
+
+	s.mutex.Lock()
+	s.cert = &cert
+	s.clientCA = pool
+	s.modified = s.modTimes()
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *certificateStore) modTimes() map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, file := range []string{s.certFile, s.keyFile, s.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			times[file] = info.ModTime()
+		}
+	}
+	return times
+}
+
+func (s *certificateStore) changed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for file, modified := range s.modTimes() {
+		if !modified.Equal(s.modified[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload whenever the files change or on SIGHUP, a failed reload
+// keeps serving the previous certificates
+func (s *certificateStore) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(CertificatePollInterval)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Info.Printf("Received SIGHUP, reloading certificates")
+			case <-ticker.C:
+				if !s.changed() {
+					continue
+				}
+				log.Info.Printf("Certificate files changed, reloading certificates")
+			}
+			if err := s.load(); err != nil {
+				log.Error.Printf("Failed to reload certificates: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert, nil
+}
+
+func (s *certificateStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert, nil
+}
+
+// Used when forwarding deployments to other machines, peers are
+// verified against the client CA and shown our own certificate so
+// machines that require client certificates accept us
+func (s *certificateStore) clientTLSConfig() *tls.Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              s.clientCA,
+		GetClientCertificate: s.getClientCertificate,
+	}
+}
+
+func serverTLSConfig(config *conf.ServerConfiguration) (*tls.Config, *certificateStore, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if config.TLSMinVersion != "" {
+		version, ok := tlsVersions[config.TLSMinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown tls-min-version %s", config.TLSMinVersion)
+		}
+		minVersion = version
+	}
+	if config.ClientCertRequired && config.ClientCA == "" {
+		return nil, nil, fmt.Errorf("client-cert-required needs a client-ca")
+	}
+
+	store, err := newCertificateStore(config.TLSCert, config.TLSKey, config.ClientCA)
+	if err != nil {
+		return nil, nil, err
+	}
+	store.watch()
+
+	clientAuth := tls.NoClientCert
+	if config.ClientCertRequired {
+		clientAuth = tls.RequireAndVerifyClientCert
+	} else if config.ClientCA != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: store.getCertificate,
+		ClientAuth:     clientAuth,
+	}
+	// The client CA pool can't be swapped on a shared config, so every
+	// handshake gets a copy carrying the current pool
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		store.mutex.RLock()
+		defer store.mutex.RUnlock()
+		perConn := tlsConfig.Clone()
+		perConn.GetConfigForClient = nil
+		perConn.ClientCAs = store.clientCA
+		return perConn, nil
+	}
+	return tlsConfig, store, nil
+}
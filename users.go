@@ -0,0 +1,226 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Caleb Champlin (caleb.champlin@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/gorilla/mux"
+)
+
+// Body of POST /users and PUT /users/{userId}, a PUT replaces every
+// field and keeps the password unless a new one is given
+type UserRequest struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Roles    []string `json:"roles"`
+	Password string   `json:"password,omitempty"`
+	Disabled bool     `json:"disabled"`
+}
+
+// The user store of the configured backend, a problem is written
+// when there is none
+func userStore(w http.ResponseWriter, r *http.Request) (auth.UserStore, bool) {
+	if authenticator == nil {
+		writeProblem(w, r, http.StatusNotFound, ERR_AUTH_DISABLED, "Authentication is not configured")
+		return nil, false
+	}
+	store := authenticator.Users()
+	if store == nil {
+		writeProblem(w, r, http.StatusNotImplemented, ERR_USERS_NOT_SUPPORTED, "The authentication backend does not manage users")
+		return nil, false
+	}
+	return store, true
+}
+
+// The password hash is part of the tag, only the tag leaves the
+// server, so a password change makes older tags stale
+func userETag(user auth.User) string {
+	etag, _ := jsonETag(user)
+	return etag
+}
+
+func parseUserRequest(w http.ResponseWriter, r *http.Request) (UserRequest, bool) {
+	var req UserRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Failed to parse user: "+err.Error())
+		return req, false
+	}
+	var fields []FieldError
+	if req.Password != "" && len(req.Password) < auth.MinPasswordLength {
+		fields = append(fields, FieldError{Field: "password", Message: fmt.Sprintf("must be at least %d characters", auth.MinPasswordLength)})
+	}
+	roles := authenticator.AllRoles()
+	for idx, role := range req.Roles {
+		if _, ok := roles.Find(role); !ok {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("roles[%d]", idx), Message: "no such role " + role})
+		}
+	}
+	if len(fields) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid user", fields...)
+		return req, false
+	}
+	return req, true
+}
+
+// Apply a request to a user, the password is hashed here so it is
+// never stored or logged in the clear
+func (req UserRequest) apply(user *auth.User) error {
+	user.Name = req.Name
+	user.Roles = req.Roles
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	user.Disabled = req.Disabled
+	if req.Password != "" {
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = hash
+	}
+	return nil
+}
+
+// List users or create one
+func Users(w http.ResponseWriter, r *http.Request) {
+	store, ok := userStore(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "POST" {
+		CreateUser(w, r, store)
+		return
+	}
+
+	users, err := store.GetUsers()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	public := make([]auth.User, len(users))
+	for idx, user := range users {
+		public[idx] = user.Public()
+	}
+	writeJSON(w, r, http.StatusOK, public)
+}
+
+func CreateUser(w http.ResponseWriter, r *http.Request, store auth.UserStore) {
+	req, ok := parseUserRequest(w, r)
+	if !ok {
+		return
+	}
+	if !auth.ValidUserId(req.Id) {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid user", FieldError{Field: "id", Message: auth.ErrInvalidUserId.Error()})
+		return
+	}
+
+	user := auth.User{Id: req.Id}
+	if err := req.apply(&user); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user, err := store.CreateUser(user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auditResource(r, "/users/"+user.Id)
+	w.Header().Set("ETag", userETag(user))
+	w.Header().Set("Location", APIVersionPrefix+"/users/"+user.Id)
+	writeJSON(w, r, http.StatusCreated, user.Public())
+}
+
+// Return, replace or delete a user, changes need the user's ETag in
+// If-Match
+func UserDetails(w http.ResponseWriter, r *http.Request) {
+	store, ok := userStore(w, r)
+	if !ok {
+		return
+	}
+	userId := mux.Vars(r)["userId"]
+
+	switch r.Method {
+	case "PUT":
+		UpdateUser(w, r, store, userId)
+	case "DELETE":
+		DeleteUser(w, r, store, userId)
+	default:
+		user, err := authenticator.Backend.GetUser(userId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeTagged(w, r, userETag(user), user.Public())
+	}
+}
+
+func UpdateUser(w http.ResponseWriter, r *http.Request, store auth.UserStore, userId string) {
+	ifMatch, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	req, ok := parseUserRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Id != "" && req.Id != userId {
+		writeProblem(w, r, http.StatusBadRequest, ERR_VALIDATION, "Invalid user", FieldError{Field: "id", Message: "does not match the user being updated"})
+		return
+	}
+
+	user, err := store.UpdateUser(userId, func(user *auth.User) error {
+		if !ifMatchListed(ifMatch, userETag(*user)) {
+			return auth.ErrUserChanged
+		}
+		return req.apply(user)
+	})
+	auditDetail(r, fmt.Sprintf("roles %v, disabled %t, password changed %t", req.Roles, req.Disabled, req.Password != ""))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeTagged(w, r, userETag(user), user.Public())
+}
+
+func DeleteUser(w http.ResponseWriter, r *http.Request, store auth.UserStore, userId string) {
+	ifMatch, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	err := store.DeleteUser(userId, func(user auth.User) error {
+		if !ifMatchListed(ifMatch, userETag(user)) {
+			return auth.ErrUserChanged
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cchamplin/deployd/auth"
+	"github.com/cchamplin/deployd/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserEndpoints(t *testing.T) {
+	log.InitLogger(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir("", "deployd-users")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	authenticator, err = auth.AuthFromConfig(map[string]interface{}{"path": dir, "secret": "0123456789abcdef0123456789abcdef"})
+	assert.Nil(t, err)
+	defer func() { authenticator = nil }()
+	token, _, err := authenticator.CreateToken(auth.User{Id: "root", Roles: []string{auth.ADMINISTRATOR}})
+	assert.Nil(t, err)
+
+	router := NewRouter()
+	request := func(method string, path string, body string, ifMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("POST", "/v1/users", `{"id": "alice", "roles": ["operator"], "password": "short"}`, "")
+	assert.Equal(t, 400, w.Code)
+	w = request("POST", "/v1/users", `{"id": "alice", "roles": ["nobody"], "password": "correct horse"}`, "")
+	assert.Equal(t, "roles[0]", decodeProblem(t, w).Errors[0].Field)
+	w = request("POST", "/v1/users", `{"id": "alice", "roles": ["operator"], "password": "correct horse"}`, "")
+	assert.Equal(t, 201, w.Code)
+	assert.NotContains(t, w.Body.String(), "passwordHash")
+	assert.Equal(t, 409, request("POST", "/v1/users", `{"id": "alice"}`, "").Code)
+
+	_, _, err = authenticator.Login(map[string]string{"username": "alice", "password": "correct horse"})
+	assert.Nil(t, err)
+
+	w = request("GET", "/v1/users/alice", "", "")
+	assert.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	assert.Equal(t, 428, request("PUT", "/v1/users/alice", `{"name": "Alice", "roles": ["operator"]}`, "").Code)
+	w = request("PUT", "/v1/users/alice", `{"name": "Alice", "roles": ["operator"]}`, etag)
+	assert.Equal(t, 200, w.Code)
+	var user auth.User
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &user))
+	assert.Equal(t, "Alice", user.Name)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	// The password is kept when none is given
+	_, _, err = authenticator.Login(map[string]string{"username": "alice", "password": "correct horse"})
+	assert.Nil(t, err)
+
+	// A password change alone makes the ETag stale
+	renamed := w.Header().Get("ETag")
+	w = request("PUT", "/v1/users/alice", `{"name": "Alice", "roles": ["operator"], "password": "battery staple"}`, renamed)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "passwordHash")
+	assert.NotEqual(t, renamed, w.Header().Get("ETag"))
+	assert.Equal(t, 412, request("PUT", "/v1/users/alice", `{"name": "Alice", "roles": ["operator"]}`, renamed).Code)
+
+	// The first ETag is stale now
+	assert.Equal(t, 412, request("PUT", "/v1/users/alice", `{"roles": []}`, etag).Code)
+	assert.Equal(t, 412, request("DELETE", "/v1/users/alice", "", etag).Code)
+	assert.Equal(t, 204, request("DELETE", "/v1/users/alice", "", w.Header().Get("ETag")).Code)
+	assert.Equal(t, 404, request("GET", "/v1/users/alice", "", "").Code)
+}